@@ -0,0 +1,124 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/grpclog"
+)
+
+// grpcVerbosityFromEnv returns the default --grpc-verbosity value: gRPC's
+// own GRPC_GO_LOG_VERBOSITY_LEVEL environment variable if it is set to a
+// valid integer, or 0 (gRPC's transport-level dial-state logging suppressed)
+// otherwise. This lets --grpc-verbosity's default still honor the env var
+// gRPC users already know, while allowing the flag to override it.
+func grpcVerbosityFromEnv() int {
+	v := os.Getenv("GRPC_GO_LOG_VERBOSITY_LEVEL")
+	if v == "" {
+		return 0
+	}
+	level, err := strconv.Atoi(v)
+	if err != nil {
+		return 0
+	}
+	return level
+}
+
+// glogGRPCLogger routes gRPC's internal logging (dial attempts, state
+// transitions, transport errors) through glog instead of gRPC's own
+// standalone logger, so it interleaves with the rest of this process's log
+// stream instead of going to an uncorrelated destination. Info logs are
+// suppressed unless verbosity is at least 1, since gRPC's non-transport
+// packages log routine Info messages unconditionally and would otherwise
+// spam the default log stream. Within V(), grpc's transport package
+// additionally checks V(2) itself before emitting its dial-state transition
+// logs, so --grpc-verbosity must be at least 2 to see those. Warning and
+// Error are always passed through, since those indicate an actual problem
+// worth seeing regardless of verbosity.
+type glogGRPCLogger struct {
+	verbosity int
+}
+
+// setupGRPCLogging installs a glogGRPCLogger as gRPC's logger. It must be
+// called before any gRPC dialing happens, and only once: grpclog.SetLoggerV2
+// is not safe to call concurrently with gRPC's own use of the logger it
+// replaces.
+func setupGRPCLogging(verbosity int) {
+	grpclog.SetLoggerV2(&glogGRPCLogger{verbosity: verbosity})
+}
+
+func (g *glogGRPCLogger) Info(args ...interface{}) {
+	if g.verbosity > 0 {
+		glog.InfoDepth(2, args...)
+	}
+}
+
+func (g *glogGRPCLogger) Infoln(args ...interface{}) {
+	if g.verbosity > 0 {
+		glog.InfoDepth(2, fmt.Sprintln(args...))
+	}
+}
+
+func (g *glogGRPCLogger) Infof(format string, args ...interface{}) {
+	if g.verbosity > 0 {
+		glog.InfoDepth(2, fmt.Sprintf(format, args...))
+	}
+}
+
+func (g *glogGRPCLogger) Warning(args ...interface{}) {
+	glog.WarningDepth(2, args...)
+}
+
+func (g *glogGRPCLogger) Warningln(args ...interface{}) {
+	glog.WarningDepth(2, fmt.Sprintln(args...))
+}
+
+func (g *glogGRPCLogger) Warningf(format string, args ...interface{}) {
+	glog.WarningDepth(2, fmt.Sprintf(format, args...))
+}
+
+func (g *glogGRPCLogger) Error(args ...interface{}) {
+	glog.ErrorDepth(2, args...)
+}
+
+func (g *glogGRPCLogger) Errorln(args ...interface{}) {
+	glog.ErrorDepth(2, fmt.Sprintln(args...))
+}
+
+func (g *glogGRPCLogger) Errorf(format string, args ...interface{}) {
+	glog.ErrorDepth(2, fmt.Sprintf(format, args...))
+}
+
+func (g *glogGRPCLogger) Fatal(args ...interface{}) {
+	glog.FatalDepth(2, args...)
+}
+
+func (g *glogGRPCLogger) Fatalln(args ...interface{}) {
+	glog.FatalDepth(2, fmt.Sprintln(args...))
+}
+
+func (g *glogGRPCLogger) Fatalf(format string, args ...interface{}) {
+	glog.FatalDepth(2, fmt.Sprintf(format, args...))
+}
+
+func (g *glogGRPCLogger) V(l int) bool {
+	return g.verbosity >= l
+}
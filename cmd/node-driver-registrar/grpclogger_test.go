@@ -0,0 +1,63 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGrpcVerbosityFromEnv(t *testing.T) {
+	oldEnv, hadEnv := os.LookupEnv("GRPC_GO_LOG_VERBOSITY_LEVEL")
+	defer func() {
+		if hadEnv {
+			os.Setenv("GRPC_GO_LOG_VERBOSITY_LEVEL", oldEnv)
+		} else {
+			os.Unsetenv("GRPC_GO_LOG_VERBOSITY_LEVEL")
+		}
+	}()
+
+	os.Unsetenv("GRPC_GO_LOG_VERBOSITY_LEVEL")
+	if got := grpcVerbosityFromEnv(); got != 0 {
+		t.Errorf("got %d with no env var set, want 0", got)
+	}
+
+	os.Setenv("GRPC_GO_LOG_VERBOSITY_LEVEL", "3")
+	if got := grpcVerbosityFromEnv(); got != 3 {
+		t.Errorf("got %d, want 3", got)
+	}
+
+	os.Setenv("GRPC_GO_LOG_VERBOSITY_LEVEL", "not-a-number")
+	if got := grpcVerbosityFromEnv(); got != 0 {
+		t.Errorf("got %d with an invalid env var, want 0", got)
+	}
+}
+
+func TestGlogGRPCLoggerV(t *testing.T) {
+	l := &glogGRPCLogger{verbosity: 0}
+	if l.V(2) {
+		t.Error("expected V(2) to be false at the default verbosity, which would otherwise spam transport-level dial-state logs")
+	}
+
+	l = &glogGRPCLogger{verbosity: 2}
+	if !l.V(2) {
+		t.Error("expected V(2) to be true at verbosity 2")
+	}
+	if !l.V(0) {
+		t.Error("expected V(0) to be true at verbosity 2")
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	registerapi "k8s.io/kubernetes/pkg/kubelet/apis/pluginregistration/v1alpha1"
+
+	"github.com/kubernetes-csi/node-driver-registrar/pkg/connection/fake"
+)
+
+// TestHelperProcess is not a real test. It is re-executed as a subprocess by
+// runRegistrarSubprocess, with GO_WANT_HELPER_PROCESS=1 set, so the actual
+// program's main() (including its os.Exit calls) can be driven end-to-end
+// without exiting the real test binary. This mirrors the self-exec pattern
+// used by the standard library's os/exec tests.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	os.Args = append([]string{"node-driver-registrar"}, flag.Args()...)
+	main()
+}
+
+// runRegistrarSubprocess starts the registrar binary as a subprocess (via
+// TestHelperProcess) with args, so process startup, flag parsing, and
+// os.Exit behavior are all exercised exactly as in production.
+func runRegistrarSubprocess(t *testing.T, env []string, args ...string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=TestHelperProcess", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1")
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start registrar subprocess: %v", err)
+	}
+	return cmd
+}
+
+// dialRegistrationSocket dials socketPath, retrying until it appears (the
+// subprocess needs a moment to connect to the CSI driver and start serving),
+// and returns a registerapi.RegistrationClient for it.
+func dialRegistrationSocket(t *testing.T, socketPath string) (registerapi.RegistrationClient, *grpc.ClientConn) {
+	t.Helper()
+	dialer := func(addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("unix", addr, timeout)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := grpc.Dial(socketPath, grpc.WithInsecure(), grpc.WithDialer(dialer), grpc.WithBlock(), grpc.WithTimeout(200*time.Millisecond))
+		if err == nil {
+			return registerapi.NewRegistrationClient(conn), conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting to dial registration socket %q: %v", socketPath, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// writeTestKubeconfig writes a minimal kubeconfig that parses successfully
+// but points at an address nothing is listening on, so buildConfig succeeds
+// at startup (this mode needs no real apiserver) while any API call the
+// event recorder happens to make fails fast instead of hanging.
+func writeTestKubeconfig(t *testing.T, dir string) string {
+	t.Helper()
+	path := filepath.Join(dir, "kubeconfig")
+	const contents = `apiVersion: v1
+kind: Config
+clusters:
+- cluster:
+    server: http://127.0.0.1:1
+  name: test
+contexts:
+- context:
+    cluster: test
+    user: test
+  name: test
+current-context: test
+users:
+- name: test
+  user: {}
+`
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("failed to write test kubeconfig: %v", err)
+	}
+	return path
+}
+
+// TestRegistrationServerEndToEnd drives the registrar the way kubelet's
+// plugin watcher does: it starts the real binary pointed at a temp
+// registration directory and a fake CSI driver socket, dials the advertised
+// "<driver>-reg.sock", calls GetInfo, and calls NotifyRegistrationStatus
+// with both a tolerated failure and a success.
+func TestRegistrationServerEndToEnd(t *testing.T) {
+	drv := fake.NewCSIDriver()
+	defer drv.Stop()
+	drv.DriverName = "csi.example.com"
+	drv.NodeID = "test-node-id"
+
+	dir := t.TempDir()
+	csiSocket := filepath.Join(dir, "csi.sock")
+	if err := drv.ServeUnix(csiSocket); err != nil {
+		t.Fatalf("failed to serve fake CSI driver on a unix socket: %v", err)
+	}
+
+	registrationDir := filepath.Join(dir, "registration")
+	if err := os.Mkdir(registrationDir, 0755); err != nil {
+		t.Fatalf("failed to create registration dir: %v", err)
+	}
+	kubeconfig := writeTestKubeconfig(t, dir)
+
+	cmd := runRegistrarSubprocess(t,
+		[]string{"KUBE_NODE_NAME=test-node"},
+		"--kubeconfig="+kubeconfig,
+		"--csi-address="+csiSocket,
+		"--kubelet-registration-path=/var/lib/kubelet/plugins/csi.example.com/csi.sock",
+		"--registration-dir="+registrationDir,
+		"--registration-failure-threshold=5",
+	)
+	defer cmd.Process.Kill()
+
+	regSocket := filepath.Join(registrationDir, "csi.example.com-reg.sock")
+	client, conn := dialRegistrationSocket(t, regSocket)
+	defer conn.Close()
+
+	info, err := client.GetInfo(context.Background(), &registerapi.InfoRequest{})
+	if err != nil {
+		t.Fatalf("GetInfo failed: %v", err)
+	}
+	if info.Name != "csi.example.com" {
+		t.Errorf("got PluginInfo.Name %q, want %q", info.Name, "csi.example.com")
+	}
+	if info.Endpoint != "/var/lib/kubelet/plugins/csi.example.com/csi.sock" {
+		t.Errorf("got PluginInfo.Endpoint %q, want the configured --kubelet-registration-path", info.Endpoint)
+	}
+	if info.Type != registerapi.CSIPlugin {
+		t.Errorf("got PluginInfo.Type %v, want CSIPlugin", info.Type)
+	}
+
+	if _, err := client.NotifyRegistrationStatus(context.Background(), &registerapi.RegistrationStatus{
+		PluginRegistered: false,
+		Error:            "simulated transient kubelet-side failure",
+	}); err != nil {
+		t.Fatalf("NotifyRegistrationStatus (tolerated failure) failed: %v", err)
+	}
+
+	if _, err := client.NotifyRegistrationStatus(context.Background(), &registerapi.RegistrationStatus{
+		PluginRegistered: true,
+	}); err != nil {
+		t.Fatalf("NotifyRegistrationStatus (success) failed: %v", err)
+	}
+
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatalf("failed to signal subprocess: %v", err)
+	}
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- cmd.Wait() }()
+	select {
+	case err := <-waitErr:
+		if err != nil {
+			t.Errorf("expected a clean shutdown after SIGINT, got: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("registrar subprocess did not exit after SIGINT")
+	}
+}
+
+// TestRegistrationServerExitsAfterFailureThreshold verifies that, at the
+// default --registration-failure-threshold of 1, a single failed
+// NotifyRegistrationStatus call exits the process with
+// exitRegistrationSocketFailure, instead of tolerating it.
+func TestRegistrationServerExitsAfterFailureThreshold(t *testing.T) {
+	drv := fake.NewCSIDriver()
+	defer drv.Stop()
+	drv.DriverName = "csi.example.com"
+	drv.NodeID = "test-node-id"
+
+	dir := t.TempDir()
+	csiSocket := filepath.Join(dir, "csi.sock")
+	if err := drv.ServeUnix(csiSocket); err != nil {
+		t.Fatalf("failed to serve fake CSI driver on a unix socket: %v", err)
+	}
+
+	registrationDir := filepath.Join(dir, "registration")
+	if err := os.Mkdir(registrationDir, 0755); err != nil {
+		t.Fatalf("failed to create registration dir: %v", err)
+	}
+	kubeconfig := writeTestKubeconfig(t, dir)
+
+	cmd := runRegistrarSubprocess(t,
+		[]string{"KUBE_NODE_NAME=test-node"},
+		"--kubeconfig="+kubeconfig,
+		"--csi-address="+csiSocket,
+		"--kubelet-registration-path=/var/lib/kubelet/plugins/csi.example.com/csi.sock",
+		"--registration-dir="+registrationDir,
+	)
+	defer cmd.Process.Kill()
+
+	regSocket := filepath.Join(registrationDir, "csi.example.com-reg.sock")
+	client, conn := dialRegistrationSocket(t, regSocket)
+	defer conn.Close()
+
+	// The server exits as soon as the failure threshold is hit, without
+	// necessarily flushing a response first, so the RPC itself may
+	// legitimately fail with a transport error here; only the process exit
+	// code below is asserted.
+	client.NotifyRegistrationStatus(context.Background(), &registerapi.RegistrationStatus{
+		PluginRegistered: false,
+		Error:            "simulated fatal kubelet-side failure",
+	})
+
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- cmd.Wait() }()
+	select {
+	case err := <-waitErr:
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatalf("expected the subprocess to exit with an error, got: %v", err)
+		}
+		if got, want := exitErr.ExitCode(), exitRegistrationSocketFailure; got != want {
+			t.Errorf("got exit code %d, want %d (exitRegistrationSocketFailure)", got, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("registrar subprocess did not exit after the failure threshold was exceeded")
+	}
+}
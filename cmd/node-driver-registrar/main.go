@@ -18,141 +18,1328 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	_ "net/http/pprof" // registers its handlers on http.DefaultServeMux for --debug-address
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
 	registerapi "k8s.io/kubernetes/pkg/kubelet/apis/pluginregistration/v1alpha1"
 
 	"github.com/kubernetes-csi/node-driver-registrar/pkg/connection"
 )
 
 const (
-	// Name of node annotation that contains JSON map of driver names to node
-	// names
-	annotationKey = "csi.volume.kubernetes.io/nodeid"
+	// Default name of node annotation that contains JSON map of driver names
+	// to node names
+	defaultAnnotationKey = "csi.volume.kubernetes.io/nodeid"
+
+	// Default name of node annotation that contains JSON map of driver
+	// names to the maximum number of volumes they can attach to this node
+	defaultMaxVolumesAnnotationKey = "csi.volume.kubernetes.io/max-volumes-per-node"
 
 	// Default timeout of short CSI calls like GetPluginInfo
 	csiTimeout = time.Second
 
 	// Verify (and update, if needed) the node ID at this freqeuency.
 	sleepDuration = 2 * time.Minute
+
+	// Upper bound on the backoff the annotation loop applies between
+	// iterations after consecutive failures to update the Node object.
+	maxAnnotationBackoff = 10 * time.Minute
+
+	// Valid values of --registration-socket-type. See abstractSocketsSupported
+	// (node_register_linux.go / node_register_other.go) for the platform
+	// constraint on registrationSocketTypeAbstract.
+	registrationSocketTypeUnix     = "unix"
+	registrationSocketTypeAbstract = "abstract"
+
+	// Valid values of --volume-limits-mode.
+	volumeLimitsModeAnnotation = "annotation"
+	volumeLimitsModeStatus     = "status"
+)
+
+// Process exit codes. Every fatal error path calls os.Exit with one of
+// these instead of a bare 1, so monitoring systems watching container exit
+// codes can classify crash-loop causes (CSI driver down vs. apiserver
+// unreachable vs. bad config) without parsing logs. exitGeneralError covers
+// startup/usage errors (bad flags, missing node name) that don't fit one of
+// the more specific categories, and is also used when the node-id
+// annotation loop shuts down on SIGINT/SIGTERM, which intentionally exits
+// non-zero so the DaemonSet restarts this sidecar alongside the CSI driver
+// container. A registration server shutting down on the same signals exits
+// 0 instead.
+// exitDeregistrationFailure is used instead of exitGeneralError for that
+// same shutdown path when --deregister-on-shutdown's cleanup itself failed
+// (even after --deregister-retry-attempts), so monitoring can tell a stale
+// node-id annotation entry apart from an ordinary restart.
+// exitNodeDeleted is used by --exit-on-node-deleted when this node's Node
+// object has been continuously missing for at least that long, so
+// monitoring can tell a deliberate cluster removal apart from a crash.
+// exitStartupTimeout is used by --startup-timeout when a driver has not
+// reached its first successful registration or node-id annotation within
+// that long, so monitoring can tell a wedged startup sequence apart from any
+// of the individual CSI call timeout failures above.
+const (
+	exitGeneralError              = 1
+	exitCSIConnectionFailure      = 10
+	exitCSIDriverNameFailure      = 11
+	exitCSINodeIDFailure          = 12
+	exitRegistrationSocketFailure = 13
+	exitKubeConfigFailure         = 14
+	exitRBACCheckFailure          = 15
+	exitDeregistrationFailure     = 16
+	exitNodeDeleted               = 17
+	exitStartupTimeout            = 18
 )
 
 // Command line flags
 var (
-	kubeconfig              = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
-	connectionTimeout       = flag.Duration("connection-timeout", 1*time.Minute, "Timeout for waiting for CSI driver socket.")
-	csiAddress              = flag.String("csi-address", "/run/csi/socket", "Address of the CSI driver socket.")
-	kubeletRegistrationPath = flag.String("kubelet-registration-path", "",
-		`Enables Kubelet Plugin Registration service, and returns the specified path as "endpoint" in "PluginInfo" response.
-If this option is set, the driver-registrar expose a unix domain socket to handle Kubelet Plugin Registration,
+	kubeconfig                   = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
+	kubeContext                  = flag.String("kube-context", "", "Name of the kubeconfig context to use. Only consulted when --kubeconfig is set; ignored for in-cluster config.")
+	kubeAPIQPS                   = flag.Float64("kube-api-qps", float64(rest.DefaultQPS), "QPS to use for the Kubernetes API client. Lower this on large clusters to avoid contributing to apiserver throttling when many copies of this sidecar run at once.")
+	kubeAPIBurst                 = flag.Int("kube-api-burst", rest.DefaultBurst, "Burst to use for the Kubernetes API client.")
+	connectionTimeout            = flag.Duration("connection-timeout", 1*time.Minute, "Timeout for waiting for CSI driver socket.")
+	startupTimeout               = flag.Duration("startup-timeout", 0, "If set to a nonzero duration, bound the total time from process start to this driver's first successful registration (kubelet's first successful NotifyRegistrationStatus call) or node-id annotation update, independent of any of the individual CSI call timeouts (--connection-timeout, --csi-call-timeout, --csi-getdrivername-timeout, --csi-nodegetid-timeout) already bounding the steps of that sequence. A misbehaving CSI driver whose RPCs each individually complete just under their own timeout can still wedge the overall startup sequence; exceeding --startup-timeout exits with a dedicated code instead of leaving this process running indefinitely, so the usual DaemonSet RestartPolicy retries it. Disabled (0) by default.")
+	csiCallTimeout               = flag.Duration("csi-call-timeout", csiTimeout, "Timeout for each call to the CSI driver, such as GetPluginInfo or NodeGetInfo. The default is aggressive; raise it for slow-starting drivers.")
+	csiGetDriverNameTimeout      = flag.Duration("csi-getdrivername-timeout", csiTimeout, "Timeout for each GetDriverName call to the CSI driver, made once at startup and again on every --refresh-identity-period tick. Separate from --connection-timeout, which only bounds waiting for the driver socket to appear.")
+	csiNodeGetIdTimeout          = flag.Duration("csi-nodegetid-timeout", csiTimeout, "Timeout for each NodeGetId call to the CSI driver made on every --refresh-identity-period tick. Separate from --connection-timeout, which only bounds waiting for the driver socket to appear.")
+	csiKeepaliveTime             = flag.Duration("csi-keepalive-time", connection.KeepaliveTime, "How often to ping the CSI driver over an otherwise idle connection, to notice a connection silently dropped by the kernel or an intermediary proxy. Mostly defensive, since the driver is typically a local unix socket.")
+	csiKeepaliveTimeout          = flag.Duration("csi-keepalive-timeout", connection.KeepaliveTimeout, "How long to wait for a response to a keepalive ping before considering the CSI driver connection dead.")
+	csiTLSCA                     = flag.String("csi-tls-ca", "", "Path to a PEM CA bundle used to verify the CSI driver's server certificate when --csi-address is a TCP address requiring TLS. Ignored for unix socket addresses, which are always dialed insecurely. Leave unset to use the system root CAs.")
+	csiTLSCert                   = flag.String("csi-tls-cert", "", "Path to a PEM client certificate for mTLS to the CSI driver. Must be set together with --csi-tls-key. Ignored for unix socket addresses.")
+	csiTLSKey                    = flag.String("csi-tls-key", "", "Path to the PEM private key matching --csi-tls-cert.")
+	csiSocketWatchdog            = flag.Bool("csi-socket-watchdog", false, "If set, periodically check that the --csi-address unix socket still exists on disk, and exit if it has been continuously missing for longer than --csi-socket-missing-grace. Detects a CSI driver that crashed or was uninstalled out from under a still-running registrar, so the usual DaemonSet RestartPolicy can recreate it. Has no effect for a TCP --csi-address, since there is no socket file to stat.")
+	csiSocketMissingGrace        = flag.Duration("csi-socket-missing-grace", 30*time.Second, "How long the --csi-address socket may be continuously missing before --csi-socket-watchdog exits the process. A brief disappearance (e.g. the CSI driver recreating its own socket across a quick restart) within this window does not trigger an exit.")
+	registrationDirFlag          = flag.String("registration-dir", registrationDir, "Directory kubelet's plugin watcher scans for \"<driver>-reg.sock\" registration sockets. Must be an absolute path. Only ever changed in tests; production deployments mount this from the kubelet plugin registration hostPath, which may differ from the default /registration for a kubelet run with a non-standard --root-dir.")
+	createRegistrationDir        = flag.Bool("create-registration-dir", false, "If --registration-dir does not already exist, create it (and any missing parents) instead of exiting with an error. Leave unset for the normal deployment where --registration-dir is a kubelet hostPath mount that is expected to already exist; only useful when this process is responsible for the directory itself.")
+	nodeIdAnnotation             = flag.String("nodeid-annotation-key", defaultAnnotationKey, "Annotation key for the node ID map stored on the Node object.")
+	maxVolumesAnnotation         = flag.String("maxvolumes-annotation-key", defaultMaxVolumesAnnotationKey, "Annotation key for the max-volumes-per-node map stored on the Node object.")
+	volumeLimitsMode             = flag.String("volume-limits-mode", volumeLimitsModeAnnotation, `How to publish the CSI driver's reported max volumes per node (NodeGetInfo's MaxVolumesPerNode): "annotation" (the default) writes it into the --maxvolumes-annotation-key map, for Kubernetes versions whose scheduler reads volume limits from there; "status" instead writes it to the Node object's status subresource, as Capacity/Allocatable["attachable-volumes-<driver>"], matching how in-tree volume plugins and newer external provisioners publish it, for a scheduler version that reads limits from node status rather than the annotation.`)
+	annotationFormat             = flag.String("annotation-format", "json", `How to encode the value of the node-id annotation: "json" (the default) always writes a JSON object mapping driver name to node ID, even when only one driver is present; "raw-single" writes the bare node ID string instead, but only while the map has exactly one entry, falling back to "json" (with a logged warning) once a second driver is registered. Intended for downstream tooling that expects a plain node ID and only ever runs a single CSI driver per node.`)
+	oneShot                      = flag.Bool("one-shot", false, "If set, the driver-registrar will exit successfully after the kubelet plugin watcher reports a successful registration, instead of continuing to serve the registration socket.")
+	dryRun                       = flag.Bool("dry-run", false, "If set, compute and log the node-id annotation changes getVerifyAndAddNodeId and getVerifyAndDeleteNodeId would make, without actually patching the Node object. Useful for validating RBAC or a rollout change before it can mutate anything.")
+	repairCorruptAnnotation      = flag.Bool("repair-corrupt-annotation", false, "If set, when the existing node-id annotation value looks like JSON but fails to parse (e.g. truncated or hand-edited), log a warning and overwrite it with a fresh single-entry map instead of failing indefinitely. Unset by default, since overwriting a corrupt annotation silently discards any other drivers' entries it may have contained. The deregistration path always treats corrupt input as empty, regardless of this flag.")
+	maxAnnotationBytes           = flag.Int("max-annotation-bytes", 32*1024, "Maximum size in bytes of the node-id annotation's encoded value. getVerifyAndAddNodeId refuses to write a value beyond this instead of patching the Node object, since Kubernetes caps total annotation size per object at 256KiB and a node running many CSI drivers (or a malformed merge loop) could otherwise grow this one annotation large enough to crowd out everything else on the Node. Defaults well under that API limit to leave room for other annotations.")
+	deregisterOnShutdown         = flag.Bool("deregister-on-shutdown", true, "If true (the default), remove the node-id annotation for this driver on SIGINT/SIGTERM before exiting, so volume operations are not attempted against a node with no running driver. Set to false during a rolling node upgrade where the driver is expected to restart immediately: this keeps the annotation in place and avoids a window where it looks like the driver is gone, at the cost of the annotation going briefly stale if the driver does not actually come back.")
+	forceDeregister              = flag.Bool("force-deregister", false, "By default, --deregister-on-shutdown refuses to remove a driver's node-id annotation entry if its stored value does not match this process's own discovered node ID, logging a warning instead; this guards against clearing another registrar's entry after a botched node rename reuses the same Node object. Set this to delete the entry anyway regardless of its stored value.")
+	deregisterRetryAttempts      = flag.Int("deregister-retry-attempts", 3, "How many times to attempt removing this driver's node-id annotation entry on shutdown (see --deregister-on-shutdown) before giving up, waiting --deregister-retry-interval between attempts. Each attempt already retries a Conflict error internally (see --node-update-retry-steps); this is for a failure that isn't a Conflict, such as the apiserver being briefly unreachable during the same outage that is taking this process down. Set to 1 to attempt it exactly once, with no retries.")
+	deregisterRetryInterval      = flag.Duration("deregister-retry-interval", time.Second, "How long to wait between --deregister-retry-attempts retries of the shutdown node-id annotation cleanup.")
+	exitOnNodeDeleted            = flag.Duration("exit-on-node-deleted", 0, "If set to a nonzero duration, exit the process once this node's Node object has been continuously missing from the apiserver for at least this long (see getVerifyAndAddNodeId's apierrors.IsNotFound handling), instead of retrying forever. A node is normally only deleted as part of it being removed from the cluster entirely, at which point nothing is left to annotate and this process has no further purpose; exiting lets it be cleaned up instead of idling. Defaults to 0 (disabled), since a brief apiserver-side inconsistency briefly reporting a 404 is otherwise indistinguishable from a real deletion.")
+	reconcileStaleOnStartup      = flag.Bool("reconcile-stale-on-startup", false, "If set, once per process startup, before entering the annotation resync loop, overwrite this driver's node-id annotation entry with exactly the node ID(s) NodeGetId/NodeGetInfo reports right now, dropping any others already stored. --deregister-on-shutdown normally cleans up a driver's entry on exit, but is skipped on SIGKILL or a crash, so a node ID from a previous incarnation of this driver (e.g. before a topology change) can otherwise linger forever, since the steady-state resync loop only ever merges new node IDs in. Leave disabled if something else is expected to depend on an old node ID still being present across a driver restart.")
+	alsoWriteNodeIdLabel         = flag.Bool("also-write-nodeid-label", false, "If set, in addition to the node-id annotation, mirror each driver's node ID into a label named \"csi-nodeid.<driver>\", for admission/scheduling setups that key off node labels rather than annotations. Label values cannot hold arbitrary JSON and are capped at 63 characters, so unlike the annotation, a node ID that is not already a valid label value is hashed (not truncated, to avoid collisions) before being written.")
+	annotateCSIVersion           = flag.Bool("annotate-csi-version", false, "If set, write the CSI driver's reported vendor version into a \"csi.volume.kubernetes.io/version-<driver>\" annotation on this Node, so fleet inventory tooling can see which CSI spec/vendor version each driver on each node is actually running without querying every driver directly. Skipped for a driver that does not report a vendor version. Removed on shutdown alongside the node-id annotation, subject to the same --deregister-on-shutdown setting.")
+	enableTopology               = flag.Bool("enable-topology", false, "If enabled, the driver-registrar will fetch accessible topology from the CSI driver via NodeGetInfo, and apply it as node labels. Older drivers that only implement NodeGetId are unaffected.")
+	refreshIdentityPeriod        = flag.Duration("refresh-identity-period", 0, "If set to a nonzero duration, periodically re-call GetDriverName and NodeGetId during the annotation resync loop and update the node-id annotation if NodeGetId reports a new value. Most CSI drivers report an immutable driver name and node ID; this is only useful for a driver that legitimately changes node ID, e.g. after a topology change, and defaults to disabled to preserve that assumption. A changed driver name is only logged as a warning, since that is almost always a misconfiguration.")
+	registrationSocketMode       = flag.String("registration-socket-mode", "", "Octal file mode (e.g. 0660) to apply to the registration socket after it is created. If unset, the socket is left at the owner-only mode applied via --manage-socket-umask (or an explicit chmod, if that is false). Ignored when --registration-socket-type=abstract, since abstract sockets have no filesystem entry to chmod.")
+	registrationSocketType       = flag.String("registration-socket-type", registrationSocketTypeUnix, `Type of socket to listen on for the kubelet plugin watcher registration socket: "unix" (the default) creates a regular filesystem socket at <registration-dir>/<driver>-reg.sock; "abstract" uses a Linux abstract-namespace socket sharing the same name instead, which has no filesystem entry to stat, chmod, or clean up a stale instance of, and is sometimes preferred on hardened hosts that restrict writes under /registration. Linux-only: setting this to "abstract" on any other OS is a startup error.`)
+	manageSocketUmask            = flag.Bool("manage-socket-umask", true, "If true (the default), swap the process umask to 0077 around creating the registration socket so it defaults to owner-only permissions, then restore the previous umask. Swapping the process-wide umask is not safe if another goroutine creates files concurrently, and can conflict with permissions some host setups manage externally; set this to false to instead leave the umask untouched and apply the same owner-only mode with an explicit chmod after the socket is created.")
+	nodeUpdateRetrySteps         = flag.Int("node-update-retry-steps", retry.DefaultRetry.Steps, "Maximum number of attempts getVerifyAndAddNodeId and getVerifyAndDeleteNodeId make when retrying a Node update after an optimistic-concurrency conflict, before giving up. Defaults to client-go's own retry.DefaultRetry.")
+	nodeUpdateRetryBaseDelay     = flag.Duration("node-update-retry-base-delay", retry.DefaultRetry.Duration, "Initial delay before the first retry of a conflicting Node update, which --node-update-retry-factor then scales on each subsequent attempt. Defaults to client-go's own retry.DefaultRetry.")
+	nodeUpdateRetryFactor        = flag.Float64("node-update-retry-factor", retry.DefaultRetry.Factor, "Multiplier applied to --node-update-retry-base-delay after each retry of a conflicting Node update. Defaults to client-go's own retry.DefaultRetry (1.0, i.e. no backoff growth, only --node-update-retry-steps flat retries).")
+	selfTest                     = flag.Bool("selftest", false, "Run a one-shot self-test instead of starting the registrar: connect to each configured CSI driver, discover its name and node ID, and open, dial, and tear down a temporary registration socket, all without touching the apiserver. Prints a per-step pass/fail report and exits 0 only if every step for every driver passed. Intended for use as a DaemonSet init container, to fail fast on an obviously broken node before the main sidecar container starts.")
+	fieldManager                 = flag.String("field-manager", "csi-node-driver-registrar", "Identifies this process's Node Update/Patch calls for auditing under server-side apply's managedFields, e.g. with \"kubectl get node <name> --show-managed-fields -o yaml\". The vendored client-go in this tree predates NodeInterface.Update/Patch taking an explicit field manager option, so this is applied the way that client-go version actually supports field attribution: as the Kubernetes API client's User-Agent header, which the apiserver falls back to as the field manager name when none is given explicitly.")
+	expectedDriverName           = flag.String("expected-driver-name", "", "If set, compare this against the name the CSI driver reports via GetDriverName and exit with a clear error on mismatch, instead of annotating/registering the node under whatever name the driver happened to report. Catches a misconfigured hostPath or socket mount that points this process at the wrong driver's socket.")
+	registrationSocketGroup      = flag.String("registration-socket-group", "", "Group name or numeric GID to own the registration socket after it is created. Only meaningful together with --registration-socket-mode, to grant a kubelet running as a different uid/gid access to the socket.")
+	forceSocketCleanup           = flag.Bool("force-socket-cleanup", false, "If a regular file (not a socket) already exists at the registration socket path, by default the driver-registrar exits with an actionable error rather than risk removing something unexpected. Set this to remove it automatically instead, e.g. for a registration directory known to be exclusively owned by this process across restarts. Has no effect on a stale socket left by a previous instance of this process, which is always removed regardless of this flag, nor on --registration-socket-type=abstract, which has no filesystem entry to collide with in the first place.")
+	registrationWatchdog         = flag.Bool("registration-watchdog", false, "If set, warn (and optionally exit, see --registration-watchdog-exit) when kubelet has not called GetInfo on the registration socket within --registration-watchdog-timeout of this process starting. Helps detect a registration socket that kubelet never discovered.")
+	registrationWatchdogTimeout  = flag.Duration("registration-watchdog-timeout", 5*time.Minute, "How long to wait for kubelet to call GetInfo before the registration watchdog logs a warning. Only used when --registration-watchdog is set.")
+	registrationWatchdogExit     = flag.Bool("registration-watchdog-exit", false, "If set together with --registration-watchdog, exit the process (forcing a container restart under the usual DaemonSet RestartPolicy) when the watchdog timeout elapses without a GetInfo call.")
+	registrationFailureThreshold = flag.Int("registration-failure-threshold", 1, "Number of consecutive failed NotifyRegistrationStatus calls to tolerate before exiting the process. The default of 1 preserves the previous behavior of exiting on the first failure. Raise this to ride out brief kubelet hiccups without crash-looping; a subsequent successful registration resets the counter.")
+	exitOnRegistrationFailure    = flag.Bool("exit-on-registration-failure", true, "If set (the default), exceeding --registration-failure-threshold exits the process, relying on the usual DaemonSet RestartPolicy to restart and retry registration. If false, a failure past the threshold is instead only logged and recorded against the driver's event stream, and the registration server keeps running so kubelet can retry against the same socket; use this when an external remediation system handles registration failures instead of a container restart.")
+	enableLeaderElection         = flag.Bool("enable-leader-election", false, "If set, only the elected leader among however many driver-registrar instances are contending for this node+driver's lock actually runs the node-id annotation loop; the others stand by. Reduces annotation patch conflicts when a DaemonSet briefly runs two pods per node during a surge upgrade. Has no effect on the registration socket, which every instance still serves.")
+	leaderElectionNamespace      = flag.String("leader-election-namespace", "kube-system", "Namespace of the lock object used by --enable-leader-election. Must be a namespace this process's ServiceAccount can create/get/update objects in.")
+	allowEmptyNodeID             = flag.Bool("allow-empty-nodeid", false, "If the CSI driver returns an empty node ID, the default is to treat that as fatal, since writing it into the node-id annotation would otherwise silently confuse the scheduler. If set, tolerate an empty node ID instead: log an error and skip the node-id annotation update until the driver reports a non-empty value, rather than exiting.")
+	requireEndpointExists        = flag.Bool("require-endpoint-exists", false, "If set, the driver-registrar exits with an error at startup when the driver endpoint (--driver-endpoint, or --kubelet-registration-path if that is unset) does not point at an existing socket, instead of only logging a warning.")
+	endpointWatchdog             = flag.Bool("endpoint-watchdog", false, "If set, periodically check that the driver endpoint (--driver-endpoint, or --kubelet-registration-path if that is unset) still exists on disk after registration, and log an error (optionally exiting, see --exit-on-endpoint-missing) once it has been continuously missing for longer than --endpoint-missing-grace. Detects a CSI driver uninstalled out from under a still-running registrar, whose registration socket would otherwise keep advertising a dead endpoint to kubelet indefinitely.")
+	endpointMissingGrace         = flag.Duration("endpoint-missing-grace", 30*time.Second, "How long the driver endpoint may be continuously missing before --endpoint-watchdog treats it as gone. A brief disappearance (e.g. the CSI driver recreating its own socket across a quick restart) within this window is tolerated.")
+	exitOnEndpointMissing        = flag.Bool("exit-on-endpoint-missing", false, "If set together with --endpoint-watchdog, exit the process (forcing a container restart under the usual DaemonSet RestartPolicy) once the driver endpoint has been missing for --endpoint-missing-grace, tearing down the now-stale registration. If false, the watchdog only logs an error and keeps running.")
+	shutdownGracePeriod          = flag.Duration("shutdown-grace-period", 10*time.Second, "How long to wait for in-flight GetInfo/NotifyRegistrationStatus calls to complete when the registration server is shut down (e.g. on SIGINT/SIGTERM). The gRPC server is forcibly stopped, cutting off any call still running, if draining takes longer than this.")
+	grpcMaxRecvMsgSize           = flag.Int("grpc-max-recv-msg-size", 1024*1024*4, "Maximum message size in bytes the registration gRPC server will accept from kubelet, applied via grpc.MaxRecvMsgSize. Defaults to gRPC's own default (4 MiB).")
+	registrationMaxConcurrent    = flag.Int("registration-max-concurrent", 50, "Upper bound on the registration gRPC server's concurrency and call rate: applied both as a grpc.MaxConcurrentStreams limit and as the rate (and burst) of a token-bucket limiter rejecting calls over that with codes.ResourceExhausted, via registrationRateLimitInterceptor. Guards against a buggy or malicious local client hammering the registration socket consuming unbounded resources on the node; kubelet itself calls GetInfo/NotifyRegistrationStatus only occasionally, so the default is generous enough to never affect normal operation.")
+	grpcMaxSendMsgSize           = flag.Int("grpc-max-send-msg-size", math.MaxInt32, "Maximum message size in bytes the registration gRPC server will send to kubelet, applied via grpc.MaxSendMsgSize. Increase this if a CSI driver's verbose error strings, surfaced back through NotifyRegistrationStatus, are at risk of exceeding it. Defaults to gRPC's own default (effectively unlimited).")
+	requireRBACCheck             = flag.Bool("require-rbac-check", false, "If set, the driver-registrar issues a SelfSubjectAccessReview for the \"get\" and \"patch\" verbs on the nodes resource before starting the annotation loop, and exits immediately with a clear error if the ServiceAccount lacks either, instead of only discovering the problem on the first failed Patch call. Always performed as a best-effort warning even when unset.")
+	resyncJitterFactor           = flag.Float64("resync-jitter-factor", 0.1, "Fraction of the annotation resync period to add as random jitter to each sleep between iterations, so that nodes started at the same time (e.g. after a DaemonSet rollout) do not converge on synchronized apiserver bursts. The first iteration is unaffected. 0 disables jitter.")
+	debugAddress                 = flag.String("debug-address", "", "If set, serve net/http/pprof handlers (e.g. /debug/pprof/goroutine?debug=2) on this address, for capturing goroutine dumps from a stuck registrar. Disabled by default; only enable on a trusted network.")
+	statusAddress                = flag.String("status-address", "", "If set, serve a JSON array of per-driver status (discovered driver name, node id, supported versions, registration socket path, and last successful annotation update time) at /status on this address, for kubectl exec-based debugging and sidecar health tooling. Reflects live state, including after a CSI driver reconnect. Disabled by default; only enable on a trusted network.")
+	pluginRegistrationAPIVersion = flag.String("plugin-registration-api-version", "v1alpha1", "Version of the kubelet plugin registration API to serve the registration socket as. Only \"v1alpha1\" is currently supported; see validatePluginRegistrationAPIVersion for why the newer stable \"v1\" API is not yet available.")
+	logFormat                    = flag.String("log-format", "text", `Format for operator-facing log events such as registration and GetInfo calls: "text" (glog's default format) or "json" (one JSON object per line with timestamp, level, msg, and driver/node fields where available).`)
+	logRegistrationCalls         = flag.Bool("log-registration-calls", false, "If set, log every GetInfo call (and its dry-run response, if --dry-run is also set) at Info level, instead of only at -v=2/-v=4. A busy kubelet re-probes the registration socket frequently enough that this floods logs by default; set this when debugging a specific registration issue without raising -v globally.")
+	nodeNameFile                 = flag.String("node-name-file", "", "Path to a file containing the node name, such as a downward-API volume file. Only consulted when the KUBE_NODE_NAME environment variable is empty.")
+	readyFile                    = flag.String("ready-file", "", "If set, touch this file after the node-id annotation has been successfully applied for the first time, so a readiness probe can gate on it. Removed on shutdown. Only meaningful in annotation mode (see --enable-nodeid-annotation).")
+	showVersion                  = flag.Bool("version", false, "Show version.")
+	versionOutput                = flag.String("output", "text", `Format for --version: "text" (a single human-readable line) or "json" (a JSON object with version, gitCommit, buildDate, and goVersion fields, for tooling that parses it). Ignored unless --version is also set.`)
+	probe                        = flag.Bool("probe", false, "Run a one-shot liveness probe instead of starting the registrar: dial each configured driver's registration socket (or, for a driver with no --kubelet-registration-path, the driver's --csi-address directly) and exit 0 if it responds, non-zero otherwise. Intended for use as a Pod exec liveness probe command, e.g. \"node-driver-registrar --probe --csi-address=$ADDRESS --kubelet-registration-path=$REGISTRATION_PATH --registration-dir=$REGISTRATION_DIR\", so this process does not need to expose a separate HTTP health port.")
+	printConfig                  = flag.Bool("print-config", false, "Resolve every flag and fallback environment variable (e.g. CSI_ADDRESS, KUBELET_REGISTRATION_PATH) into this process's effective configuration, print it, and exit 0 without dialing the CSI driver or contacting the apiserver. Helps confirm what a container will actually do, especially with --csi-address/--kubelet-registration-path repeated for multiple drivers or left to their environment variable fallbacks. Paths to TLS material (--csi-tls-ca/--csi-tls-cert/--csi-tls-key) are printed as configured paths, never read or printed as file contents.")
+	printConfigFormat            = flag.String("print-config-format", "json", `Format for --print-config: "json" (the default) or "yaml". Ignored unless --print-config is also set.`)
+	grpcVerbosity                = flag.Int("grpc-verbosity", grpcVerbosityFromEnv(), "Verbosity of gRPC's own internal logging (dial attempts, connection state transitions, transport errors), routed through this process's own log stream rather than gRPC's standalone logger. 0 (the default) logs only gRPC warnings and errors; 2 or higher additionally surfaces gRPC transport's dial-state transition logs, useful when debugging the reconnection feature. Defaults to the GRPC_GO_LOG_VERBOSITY_LEVEL environment variable if it is set, for parity with gRPC's own convention.")
+	enableTracing                = flag.Bool("enable-tracing", false, "If set, wrap the startup sequence (waiting for the CSI driver socket, discovering its driver name and node ID, and the first successful node-id annotation and/or kubelet registration) in timed spans tagged with driver and node name, logged at Info level once each span completes. Helps correlate node-startup latency across these phases. This tree does not vendor an OpenTelemetry SDK, so this does not export real OTLP spans (see --otel-endpoint); it is otherwise a no-op overhead-wise when left unset.")
+	otelEndpoint                 = flag.String("otel-endpoint", "", "OTLP endpoint the startup spans enabled by --enable-tracing would be exported to. Accepted for forward compatibility, but not yet implemented: setting this only logs a warning at startup, since this tree does not vendor an OpenTelemetry SDK able to export to it. Until that dependency is vendored, use --enable-tracing on its own to get the same span timings as structured log lines instead.")
+
+	// version, gitCommit, and buildDate are populated via -ldflags at build
+	// time (see the Makefile's "node-driver-registrar" target); they default to "unknown"
+	// for a "go build"/"go run" invocation that does not set them.
+	version   = "unknown"
+	gitCommit = "unknown"
+	buildDate = "unknown"
+
+	// List of plugin registration API versions this registrar advertises
+	// to kubelet's plugin watcher. Defaults to "1.0.0"; repeat
+	// --supported-version to advertise more than one.
+	supportedVersions = &stringSliceFlag{values: []string{"1.0.0"}}
+
+	// Whether to run the legacy node-id annotation loop. Unset by default,
+	// in which case its effective value depends on kubeletRegistrationPath
+	// (see enableNodeIdAnnotationEffective), to preserve this program's
+	// historical behavior of treating the two as mutually exclusive.
+	enableNodeIdAnnotation = &optionalBoolFlag{}
+
+	// Address(es) of the CSI driver socket(s) to register. Repeat
+	// --csi-address (paired positionally with a repeated
+	// --kubelet-registration-path) to run more than one driver out of a
+	// single registrar process.
+	csiAddress = &stringSliceFlag{values: []string{"/run/csi/socket"}}
+
+	// Registration socket path(s), one per entry in csiAddress. Left empty
+	// (isSet false) means no driver in this process serves a registration
+	// socket, i.e. every driver runs in annotation-only mode.
+	kubeletRegistrationPath = &stringSliceFlag{}
+
+	// Driver endpoint(s) to advertise as PluginInfo.Endpoint, one per entry
+	// in csiAddress. Left empty (isSet false) means every driver advertises
+	// its own kubeletRegistrationPath entry, preserving this program's
+	// historical behavior of treating the two as the same path.
+	driverEndpoint = &stringSliceFlag{}
+
+	// Additional node-id annotation key(s) to write the same node ID to
+	// alongside --nodeid-annotation-key, for migrating to a new key without
+	// downtime. See allNodeIdAnnotationKeys.
+	additionalNodeIdAnnotationKeys = &stringSliceFlag{}
+
+	// Annotation key(s) to remove on shutdown instead of every currently
+	// active key (--nodeid-annotation-key plus
+	// --additional-nodeid-annotation-key). Left empty (isSet false) means
+	// shutdown cleans up every active key. See
+	// deregisterAnnotationKeysEffective.
+	deregisterAnnotationKeys = &stringSliceFlag{}
+)
+
+func init() {
+	flag.Var(supportedVersions, "supported-version", "Plugin registration API version to advertise to kubelet. May be repeated to advertise multiple versions. Defaults to 1.0.0.")
+	flag.Var(enableNodeIdAnnotation, "enable-nodeid-annotation", "Whether to maintain the legacy node-id annotation. Defaults to true when --kubelet-registration-path is unset, and false when it is set (the annotation and the plugin watcher registration socket used to be mutually exclusive); pass explicitly to run both at once, e.g. for a cluster whose scheduler logic still reads the annotation.")
+	flag.Var(csiAddress, "csi-address", "Address of the CSI driver socket. Accepts a \"unix://\" or \"tcp://\" address, or a bare path (treated as unix, for backward compatibility). May be repeated to register multiple CSI drivers out of a single registrar process, each getting its own connection, node-id annotation handling, and (if --kubelet-registration-path is also repeated) registration socket. Defaults to a single driver at /run/csi/socket, or to the CSI_ADDRESS environment variable if that is set and this flag is not.")
+	flag.Var(kubeletRegistrationPath, "kubelet-registration-path", `Enables Kubelet Plugin Registration service, and returns the specified path as "endpoint" in "PluginInfo" response.
+If this option is set, the driver-registrar exposes a unix domain socket to handle Kubelet Plugin Registration,
 this socket MUST be surfaced on the host in the kubelet plugin registration directory (in addition to the CSI driver socket).
 If plugin registration is enabled on kubelet (kubelet flag KubeletPluginsWatcher is set), then this option should be set
-and the value should be the path of the CSI driver socket on the host machine.`)
-	showVersion = flag.Bool("version", false, "Show version.")
-	version     = "unknown"
+and the value should be the path of the CSI driver socket on the host machine.
+When registering more than one driver (--csi-address repeated), repeat this flag the same number of times, pairing
+entries positionally; pass an empty string for a driver that should run in annotation-only mode alongside others that
+serve a registration socket.
+If this flag is left unset and the KUBELET_REGISTRATION_PATH environment variable is set, its value is used instead, for a single driver.`)
+	flag.Var(driverEndpoint, "driver-endpoint", `Path returned as "endpoint" in the "PluginInfo" response, if it differs from --kubelet-registration-path (e.g. a split-socket setup where the CSI driver's host socket path is not the same path used to reach the registration socket). Must be an absolute path. Defaults to the corresponding --kubelet-registration-path entry. When registering more than one driver, repeat this flag the same number of times as --csi-address, pairing entries positionally; pass an empty string for a driver that should use its --kubelet-registration-path default.`)
+	flag.Var(additionalNodeIdAnnotationKeys, "additional-nodeid-annotation-key", "Additional annotation key to write this driver's node ID to, alongside --nodeid-annotation-key. May be repeated. Intended for migrating the node-id annotation to a new key without downtime: run with both the old key (--nodeid-annotation-key) and the new key (--additional-nodeid-annotation-key) set during the transition, switch consumers over to the new key, then drop the old one. See also --deregister-annotation-keys.")
+	flag.Var(deregisterAnnotationKeys, "deregister-annotation-keys", "Annotation key(s) to remove this driver's node ID from on shutdown (see --deregister-on-shutdown), instead of every key it is currently writing to (--nodeid-annotation-key plus any --additional-nodeid-annotation-key). May be repeated. Useful partway through a key migration, to stop cleaning up the old key once it is no longer being written so a separate process can drop it on its own schedule.")
+}
 
-	// List of supported versions
-	supportedVersions = []string{"1.0.0"}
-)
+// stringSliceFlag is a flag.Value that collects repeated occurrences of a
+// string flag into a slice, replacing its default value on first use.
+type stringSliceFlag struct {
+	values []string
+	isSet  bool
+}
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(s.values, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	if !s.isSet {
+		s.values = nil
+	}
+	s.isSet = true
+	s.values = append(s.values, value)
+	return nil
+}
+
+// optionalBoolFlag is a flag.Value wrapping a bool whose sensible default
+// depends on another flag not yet parsed when flags are registered; isSet
+// lets callers tell "explicitly set to false" apart from "left at its
+// context-dependent default".
+type optionalBoolFlag struct {
+	value bool
+	isSet bool
+}
+
+func (f *optionalBoolFlag) String() string {
+	return strconv.FormatBool(f.value)
+}
+
+func (f *optionalBoolFlag) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	f.value = v
+	f.isSet = true
+	return nil
+}
+
+// IsBoolFlag lets this be used as a bare "-flag" (without "=value"), like a
+// normal flag.Bool, per the flag package's boolFlag interface.
+func (f *optionalBoolFlag) IsBoolFlag() bool { return true }
 
 // registrationServer is a sample plugin to work with plugin watcher
 type registrationServer struct {
 	driverName string
 	endpoint   string
 	version    []string
+	nodeName   string
+	csiAddress string
+	recorder   *eventRecorder
+
+	// mu guards lastGetInfo, which the registration watchdog polls from a
+	// separate goroutine, consecutiveFailures, which NotifyRegistrationStatus
+	// updates on every call, and socketReadyTime/firstGetInfo, which together
+	// measure how long kubelet took to discover the registration socket.
+	mu                  sync.Mutex
+	lastGetInfo         time.Time
+	consecutiveFailures int
+	socketReadyTime     time.Time
+	firstGetInfo        time.Time
+
+	// firstRegistrationSpan times from the registration socket becoming
+	// available to kubelet's first GetInfo call against it; see
+	// recordSocketReady and GetInfo.
+	firstRegistrationSpan *startupSpan
+
+	// startupDone is called the first time NotifyRegistrationStatus reports a
+	// successful registration, to satisfy this driver's --startup-timeout
+	// watchdog (see startStartupWatchdog). A no-op if --startup-timeout is
+	// unset; safe to call more than once.
+	startupDone func()
 }
 
-var _ registerapi.RegistrationServer = registrationServer{}
+var _ registerapi.RegistrationServer = &registrationServer{}
 
 // NewregistrationServer returns an initialized registrationServer instance
-func newRegistrationServer(driverName string, endpoint string, versions []string) registerapi.RegistrationServer {
+func newRegistrationServer(driverName string, endpoint string, versions []string, nodeName string, recorder *eventRecorder, startupDone func()) *registrationServer {
+	if startupDone == nil {
+		startupDone = func() {}
+	}
 	return &registrationServer{
-		driverName: driverName,
-		endpoint:   endpoint,
-		version:    versions,
+		driverName:  driverName,
+		endpoint:    endpoint,
+		version:     versions,
+		nodeName:    nodeName,
+		recorder:    recorder,
+		lastGetInfo: time.Now(),
+		startupDone: startupDone,
 	}
 }
 
-// GetInfo is the RPC invoked by plugin watcher
-func (e registrationServer) GetInfo(ctx context.Context, req *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
-	glog.Infof("Received GetInfo call: %+v", req)
-	return &registerapi.PluginInfo{
+// recordSocketReady records the time the registration socket became
+// available to be discovered (i.e. right after net.Listen succeeds), and
+// remembers csiAddress so GetInfo can key its status update to the right
+// driver. Called once, from runRegistrationServer.
+func (e *registrationServer) recordSocketReady(csiAddress string) {
+	e.mu.Lock()
+	e.socketReadyTime = time.Now()
+	e.csiAddress = csiAddress
+	e.firstRegistrationSpan = startSpan("first-registration")
+	e.mu.Unlock()
+	updateDriverStatus(csiAddress, func(s *driverStatus) {
+		s.RegistrationSocketReadyTime = e.socketReadyTime
+	})
+}
+
+// startRegistrationWatchdog polls, once per timeout, whether kubelet's
+// plugin watcher has called GetInfo since the last check (or since the
+// server was created). If not, it logs a warning and, if exitOnTimeout is
+// set, exits the process so the usual DaemonSet RestartPolicy can recreate
+// the socket and try again. It runs until the process exits.
+func (e *registrationServer) startRegistrationWatchdog(timeout time.Duration, exitOnTimeout bool) {
+	for range time.Tick(timeout) {
+		e.mu.Lock()
+		since := time.Since(e.lastGetInfo)
+		e.mu.Unlock()
+		if since < timeout {
+			continue
+		}
+		glog.Warningf("kubelet has not called GetInfo on driver %q's registration socket in %s; the socket may not have been discovered", e.driverName, since)
+		if exitOnTimeout {
+			glog.Errorf("Exiting due to --registration-watchdog-exit so the registration socket is recreated.")
+			os.Exit(exitRegistrationSocketFailure)
+		}
+	}
+}
+
+// GetInfo is the RPC invoked by plugin watcher. It returns ctx.Err() promptly
+// if kubelet has already cancelled the call, rather than doing any work on a
+// result nobody is waiting for; this matters more once GetInfo gains a
+// downstream CSI call of its own.
+func (e *registrationServer) GetInfo(ctx context.Context, req *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if registrationCallLoggingEnabled(2) {
+		logEvent("info", e.driverName, e.nodeName, "Received GetInfo call: %+v", req)
+	}
+	e.mu.Lock()
+	e.lastGetInfo = time.Now()
+	isFirstGetInfo := e.firstGetInfo.IsZero()
+	if isFirstGetInfo {
+		e.firstGetInfo = e.lastGetInfo
+	}
+	firstGetInfo, socketReadyTime, csiAddress, firstRegistrationSpan := e.firstGetInfo, e.socketReadyTime, e.csiAddress, e.firstRegistrationSpan
+	e.mu.Unlock()
+	if isFirstGetInfo {
+		glog.Infof("kubelet discovered socket after %s", firstGetInfo.Sub(socketReadyTime))
+		firstRegistrationSpan.End(e.driverName, e.nodeName, nil)
+		updateDriverStatus(csiAddress, func(s *driverStatus) {
+			s.FirstGetInfoTime = firstGetInfo
+		})
+	}
+	rsp := &registerapi.PluginInfo{
 		Type:              registerapi.CSIPlugin,
 		Name:              e.driverName,
 		Endpoint:          e.endpoint,
 		SupportedVersions: e.version,
-	}, nil
+	}
+	if *dryRun && registrationCallLoggingEnabled(4) {
+		logEvent("info", e.driverName, e.nodeName, "dry-run: would return GetInfo response: %+v", rsp)
+	}
+	return rsp, nil
 }
 
-func (e registrationServer) NotifyRegistrationStatus(ctx context.Context, status *registerapi.RegistrationStatus) (*registerapi.RegistrationStatusResponse, error) {
-	glog.Infof("Received NotifyRegistrationStatus call: %+v", status)
+func (e *registrationServer) NotifyRegistrationStatus(ctx context.Context, status *registerapi.RegistrationStatus) (*registerapi.RegistrationStatusResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if status.PluginRegistered && registrationCallLoggingEnabled(1) {
+		logEvent("info", e.driverName, e.nodeName, "Received NotifyRegistrationStatus call: %+v", status)
+	}
 	if !status.PluginRegistered {
-		glog.Errorf("Registration process failed with error: %+v, restarting registration container.", status.Error)
-		os.Exit(1)
+		logEvent("error", e.driverName, e.nodeName, "Registration process failed with error: %+v", status.Error)
+		e.recorder.Warningf("FailedRegistration", "CSI driver %q failed to register: %s", e.driverName, status.Error)
+
+		e.mu.Lock()
+		e.consecutiveFailures++
+		failures := e.consecutiveFailures
+		e.mu.Unlock()
+
+		if failures < *registrationFailureThreshold {
+			glog.Warningf("Registration failure %d/%d for driver %q; tolerating and waiting for kubelet to retry.", failures, *registrationFailureThreshold, e.driverName)
+			return &registerapi.RegistrationStatusResponse{}, nil
+		}
+		if !*exitOnRegistrationFailure {
+			glog.Errorf("%d consecutive registration failures for driver %q (--registration-failure-threshold=%d); not exiting because --exit-on-registration-failure=false, continuing to serve the registration socket for kubelet to retry against.", failures, e.driverName, *registrationFailureThreshold)
+			return &registerapi.RegistrationStatusResponse{}, nil
+		}
+		glog.Errorf("Restarting registration container after %d consecutive registration failures (--registration-failure-threshold=%d).", failures, *registrationFailureThreshold)
+		os.Exit(exitRegistrationSocketFailure)
+	}
+
+	e.mu.Lock()
+	e.consecutiveFailures = 0
+	e.mu.Unlock()
+	e.startupDone()
+
+	if *oneShot {
+		logEvent("info", e.driverName, e.nodeName, "Registration succeeded for driver %q, exiting because --one-shot is set.", e.driverName)
+		os.Exit(0)
 	}
 
 	return &registerapi.RegistrationStatusResponse{}, nil
 }
 
+// registrationCallLoggingEnabled reports whether a GetInfo/NotifyRegistrationStatus
+// payload log gated at verbosity v should be emitted: either glog's -v covers
+// it, or --log-registration-calls forces it on regardless of -v. Callers
+// check this before formatting the payload, so a busy kubelet re-probing the
+// registration socket does not pay for work nobody reads.
+func registrationCallLoggingEnabled(v glog.Level) bool {
+	return *logRegistrationCalls || bool(glog.V(v))
+}
+
+// logEvent logs an operator-facing event (registration and GetInfo calls)
+// through glog's text format, or as a single JSON line, depending on
+// --log-format. driverName and/or nodeName may be empty if not yet known.
+func logEvent(level, driverName, nodeName, messageFmt string, args ...interface{}) {
+	msg := fmt.Sprintf(messageFmt, args...)
+	if *logFormat != "json" {
+		switch level {
+		case "error":
+			glog.Error(msg)
+		case "warning":
+			glog.Warning(msg)
+		default:
+			glog.Info(msg)
+		}
+		return
+	}
+
+	entry := struct {
+		Timestamp string `json:"timestamp"`
+		Level     string `json:"level"`
+		Message   string `json:"msg"`
+		Driver    string `json:"driver,omitempty"`
+		Node      string `json:"node,omitempty"`
+	}{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Level:     level,
+		Message:   msg,
+		Driver:    driverName,
+		Node:      nodeName,
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		glog.Errorf("Failed to marshal JSON log entry: %v", err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, string(line))
+}
+
+// Options collects the flag values run needs, so run itself takes no
+// dependency on the package-level flag vars and can be exercised directly
+// from tests with values that never touch the command line.
+type Options struct {
+	CSIAddresses                 []string
+	KubeletRegistrationPaths     *stringSliceFlag
+	DriverEndpoints              *stringSliceFlag
+	NodeIDAnnotationKey          string
+	PluginRegistrationAPIVersion string
+	RegistrationDir              string
+	CSIKeepaliveTime             time.Duration
+	CSIKeepaliveTimeout          time.Duration
+	CSITLSCA                     string
+	CSITLSCert                   string
+	CSITLSKey                    string
+	Kubeconfig                   string
+	KubeContext                  string
+	KubeAPIQPS                   float64
+	KubeAPIBurst                 int
+	DebugAddress                 string
+	StatusAddress                string
+	FieldManager                 string
+	ExpectedDriverName           string
+}
+
+// optionsFromFlags builds an Options from the parsed command-line flags.
+// Call it only after flag.Parse() and applyEnvVarDefaults(), since it copies
+// csiAddress's values as those two leave them.
+func optionsFromFlags() Options {
+	return Options{
+		CSIAddresses:                 csiAddress.values,
+		KubeletRegistrationPaths:     kubeletRegistrationPath,
+		DriverEndpoints:              driverEndpoint,
+		NodeIDAnnotationKey:          *nodeIdAnnotation,
+		PluginRegistrationAPIVersion: *pluginRegistrationAPIVersion,
+		RegistrationDir:              *registrationDirFlag,
+		CSIKeepaliveTime:             *csiKeepaliveTime,
+		CSIKeepaliveTimeout:          *csiKeepaliveTimeout,
+		CSITLSCA:                     *csiTLSCA,
+		CSITLSCert:                   *csiTLSCert,
+		CSITLSKey:                    *csiTLSKey,
+		Kubeconfig:                   *kubeconfig,
+		KubeContext:                  *kubeContext,
+		KubeAPIQPS:                   *kubeAPIQPS,
+		KubeAPIBurst:                 *kubeAPIBurst,
+		DebugAddress:                 *debugAddress,
+		StatusAddress:                *statusAddress,
+		FieldManager:                 *fieldManager,
+		ExpectedDriverName:           *expectedDriverName,
+	}
+}
+
+// run validates opts, wires up the shared CSI client config, and spawns one
+// driver goroutine per opts.CSIAddresses entry, returning one of the named
+// exit* constants instead of calling os.Exit directly so it can be exercised
+// from tests. It returns 0 on success.
+//
+// Per-driver goroutines (runDriver and everything it calls) are out of scope
+// for this: they are documented to run forever or call os.Exit directly on
+// an unrecoverable error, by design, so that any one driver's fatal failure
+// tears down the whole multi-driver process. ctx is passed on to each
+// runDriver, which uses it only as the parent of its --startup-timeout
+// watchdog (see startStartupWatchdog).
+func run(ctx context.Context, opts Options) int {
+	if opts.DebugAddress != "" {
+		startDebugServer(opts.DebugAddress)
+	}
+
+	if opts.StatusAddress != "" {
+		startStatusServer(opts.StatusAddress)
+	}
+
+	if errs := validation.IsQualifiedName(opts.NodeIDAnnotationKey); len(errs) != 0 {
+		glog.Errorf("invalid --nodeid-annotation-key %q: %s", opts.NodeIDAnnotationKey, strings.Join(errs, "; "))
+		return exitGeneralError
+	}
+
+	if err := validatePluginRegistrationAPIVersion(opts.PluginRegistrationAPIVersion); err != nil {
+		glog.Errorf("%v", err)
+		return exitGeneralError
+	}
+
+	if err := validateRegistrationSocketType(*registrationSocketType); err != nil {
+		glog.Errorf("%v", err)
+		return exitGeneralError
+	}
+
+	if err := validateVolumeLimitsMode(*volumeLimitsMode); err != nil {
+		glog.Errorf("%v", err)
+		return exitGeneralError
+	}
+
+	if err := validateRegistrationDir(opts.RegistrationDir, *createRegistrationDir); err != nil {
+		glog.Errorf("%v", err)
+		return exitGeneralError
+	}
+
+	registrationDir = opts.RegistrationDir
+
+	// Once https://github.com/container-storage-interface/spec/issues/159 is
+	// resolved, if plugin does not support PUBLISH_UNPUBLISH_VOLUME, then we
+	// can skip adding mapping to "csi.volume.kubernetes.io/nodeid" annotation.
+
+	connection.KeepaliveTime = opts.CSIKeepaliveTime
+	connection.KeepaliveTimeout = opts.CSIKeepaliveTimeout
+	tlsConfig, err := buildTLSConfig(opts.CSITLSCA, opts.CSITLSCert, opts.CSITLSKey)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return exitGeneralError
+	}
+	connection.TLSConfig = tlsConfig
+
+	registrationPaths, err := pairRegistrationPaths(opts.CSIAddresses, opts.KubeletRegistrationPaths)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return exitGeneralError
+	}
+
+	driverEndpoints, err := resolveDriverEndpoints(registrationPaths, opts.DriverEndpoints)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return exitGeneralError
+	}
+
+	// Create the client config. Use kubeconfig if given, otherwise assume
+	// in-cluster. Shared by every driver this process registers.
+	glog.V(1).Infof("Loading kubeconfig.")
+	config, err := buildConfig(opts.Kubeconfig, opts.KubeContext, float32(opts.KubeAPIQPS), opts.KubeAPIBurst, opts.FieldManager)
+	if err != nil {
+		glog.Error(err.Error())
+		return exitKubeConfigFailure
+	}
+
+	// Run forever. Each driver gets its own connection, node-id annotation
+	// handling, and (if it has a non-empty registration path) registration
+	// socket; a single --csi-address is just the one-driver case of this.
+	var wg sync.WaitGroup
+	for i, addr := range opts.CSIAddresses {
+		wg.Add(1)
+		go func(csiAddress, kubeletRegistrationPath, driverEndpoint string) {
+			defer wg.Done()
+			runDriver(ctx, config, csiAddress, kubeletRegistrationPath, driverEndpoint, opts.ExpectedDriverName)
+		}(addr, registrationPaths[i], driverEndpoints[i])
+	}
+	wg.Wait()
+	return 0
+}
+
+// versionInfo is the --output=json shape for --version; its field names are
+// part of that tooling-facing contract, so keep them stable.
+type versionInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// printVersion writes --version's output to w, as a single human-readable
+// line for the default "text" format, or a JSON object for "json". version,
+// gitCommit, and buildDate come from package-level vars set via -ldflags at
+// build time; this does not depend on the Makefile having run them through
+// any particular invocation, so "go build ./cmd/node-driver-registrar"
+// without -ldflags still produces valid (if "unknown"-valued) output in
+// either format.
+func printVersion(w io.Writer, format string) error {
+	info := versionInfo{
+		Version:   version,
+		GitCommit: gitCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	switch format {
+	case "text":
+		fmt.Fprintf(w, "%s %s\n", os.Args[0], info.Version)
+		return nil
+	case "json":
+		enc := json.NewEncoder(w)
+		return enc.Encode(info)
+	default:
+		return fmt.Errorf("unsupported --output %q for --version: must be \"text\" or \"json\"", format)
+	}
+}
+
 func main() {
+	// TODO(synth-514): migrate from glog to klog once klog is vendored in
+	// this tree. glog already registers the structured "-v"/"-vmodule"
+	// verbosity flags used throughout this file; until the dependency is
+	// vendored, honor them through glog instead of introducing an
+	// unvendored import.
 	flag.Set("logtostderr", "true")
 	flag.Parse()
+	applyEnvVarDefaults()
+	warnIfOTLPExportUnavailable()
+
+	setupGRPCLogging(*grpcVerbosity)
 
 	if *showVersion {
-		fmt.Println(os.Args[0], version)
+		if err := printVersion(os.Stdout, *versionOutput); err != nil {
+			glog.Error(err.Error())
+			os.Exit(exitGeneralError)
+		}
 		return
 	}
 	glog.Infof("Version: %s", version)
 
-	// Once https://github.com/container-storage-interface/spec/issues/159 is
-	// resolved, if plugin does not support PUBLISH_UNPUBLISH_VOLUME, then we
-	// can skip adding mapping to "csi.volume.kubernetes.io/nodeid" annotation.
+	opts := optionsFromFlags()
+	if *printConfig {
+		os.Exit(runPrintConfig(opts))
+	}
+	if *probe {
+		os.Exit(runProbe(context.Background(), opts))
+	}
+	if *selfTest {
+		os.Exit(runSelfTest(context.Background(), opts))
+	}
+
+	os.Exit(run(context.Background(), opts))
+}
+
+// csiAddressSource and kubeletRegistrationPathSource record which of flag,
+// environment variable, or built-in default actually supplied csiAddress's
+// and kubeletRegistrationPath's values, for --print-config to report
+// alongside the resolved value itself: the two ordinary sources look
+// identical once applyEnvVarDefaults has folded the environment variable
+// into the flag.Value, so the distinction has to be captured here, at the
+// moment it is still known.
+var (
+	csiAddressSource              = "default"
+	kubeletRegistrationPathSource = "default"
+)
+
+// applyEnvVarDefaults fills in --csi-address/--kubelet-registration-path
+// from the CSI_ADDRESS/KUBELET_REGISTRATION_PATH environment variables when
+// the flag was left at its built-in default, i.e. explicit flag > env var >
+// built-in default. This mirrors the existing KUBE_NODE_NAME convention
+// (see getNodeName) and eases templated DaemonSet manifests that prefer
+// setting a container's env over building up its command-line args. Only
+// the single-driver case is covered: a driver-registrar running more than
+// one driver already has to repeat --csi-address on the command line, so
+// there is no single env var that could stand in for it unambiguously.
+// Call this only after flag.Parse().
+func applyEnvVarDefaults() {
+	if csiAddress.isSet {
+		csiAddressSource = "flag"
+	} else if v := os.Getenv("CSI_ADDRESS"); v != "" {
+		csiAddress.Set(v)
+		csiAddressSource = "env:CSI_ADDRESS"
+	} else {
+		csiAddressSource = "default"
+	}
+	if kubeletRegistrationPath.isSet {
+		kubeletRegistrationPathSource = "flag"
+	} else if v := os.Getenv("KUBELET_REGISTRATION_PATH"); v != "" {
+		kubeletRegistrationPath.Set(v)
+		kubeletRegistrationPathSource = "env:KUBELET_REGISTRATION_PATH"
+	} else {
+		kubeletRegistrationPathSource = "default"
+	}
+}
+
+// pairRegistrationPaths matches each entry in csiAddresses with its
+// registration path, positionally, so --csi-address and
+// --kubelet-registration-path can be repeated together to register multiple
+// drivers out of one process. registrationPath not having been set at all
+// means none of the drivers serve a registration socket; it is an error for
+// it to be set a different number of times than --csi-address, since there
+// would be no unambiguous way to tell which path belongs to which driver.
+func pairRegistrationPaths(csiAddresses []string, registrationPath *stringSliceFlag) ([]string, error) {
+	if !registrationPath.isSet {
+		return make([]string, len(csiAddresses)), nil
+	}
+	if len(registrationPath.values) != len(csiAddresses) {
+		return nil, fmt.Errorf("--kubelet-registration-path was given %d time(s) but --csi-address was given %d time(s); when registering more than one driver, pass exactly one --kubelet-registration-path per --csi-address (an empty string runs that driver in annotation-only mode)", len(registrationPath.values), len(csiAddresses))
+	}
+	return registrationPath.values, nil
+}
+
+// resolveDriverEndpoints matches each entry in registrationPaths (already
+// paired with --csi-address by pairRegistrationPaths) with its
+// --driver-endpoint override, positionally, the same way
+// pairRegistrationPaths pairs --kubelet-registration-path. An unset
+// driverEndpoint, or an empty string at a given index, means that driver
+// advertises its registrationPaths entry unchanged, preserving this
+// program's historical behavior of treating the two as the same path. Every
+// resulting non-empty endpoint must be an absolute path, since it is handed
+// to kubelet as the socket to dial.
+func resolveDriverEndpoints(registrationPaths []string, driverEndpoint *stringSliceFlag) ([]string, error) {
+	endpoints := registrationPaths
+	if driverEndpoint.isSet {
+		if len(driverEndpoint.values) != len(registrationPaths) {
+			return nil, fmt.Errorf("--driver-endpoint was given %d time(s) but --csi-address was given %d time(s); when registering more than one driver, pass exactly one --driver-endpoint per --csi-address (an empty string defaults that driver to its --kubelet-registration-path)", len(driverEndpoint.values), len(registrationPaths))
+		}
+		endpoints = make([]string, len(registrationPaths))
+		for i, e := range driverEndpoint.values {
+			if e == "" {
+				e = registrationPaths[i]
+			}
+			endpoints[i] = e
+		}
+	}
+
+	for _, e := range endpoints {
+		if e != "" && !filepath.IsAbs(e) {
+			return nil, fmt.Errorf("driver endpoint %q is not an absolute path", e)
+		}
+	}
+	return endpoints, nil
+}
+
+// allNodeIdAnnotationKeys returns every annotation key the node-id annotation
+// loop should write this process's node ID to: --nodeid-annotation-key plus
+// any --additional-nodeid-annotation-key, in that order, with duplicates
+// removed (keeping the first occurrence) so a key accidentally passed to
+// both flags is only written once.
+func allNodeIdAnnotationKeys() []string {
+	keys := append([]string{*nodeIdAnnotation}, additionalNodeIdAnnotationKeys.values...)
+	deduped := make([]string, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		deduped = append(deduped, k)
+	}
+	return deduped
+}
+
+// deregisterAnnotationKeysEffective returns the annotation key(s) that
+// --deregister-on-shutdown should remove this driver's node ID from:
+// --deregister-annotation-keys if it was given explicitly, so a partial
+// migration can stop cleaning up a key that something else now owns, or
+// otherwise every key allNodeIdAnnotationKeys is currently writing to.
+func deregisterAnnotationKeysEffective() []string {
+	if deregisterAnnotationKeys.isSet {
+		return deregisterAnnotationKeys.values
+	}
+	return allNodeIdAnnotationKeys()
+}
+
+// csiSocketWatchdogCheckInterval is how often startCSISocketWatchdog stats
+// the CSI socket. It is independent of --csi-socket-missing-grace so the
+// grace period can be configured without also affecting the resolution with
+// which disappearances are bounded; a fixed interval well under any
+// reasonable grace period is precise enough in practice.
+const csiSocketWatchdogCheckInterval = 5 * time.Second
+
+// csiSocketWatchdogTick performs one check of startCSISocketWatchdog's loop
+// body: given the missingSince this watchdog was already tracking, it
+// returns the updated missingSince and whether the socket has now been
+// missing for at least grace. Split out from startCSISocketWatchdog so the
+// decision logic can be unit tested without an infinite loop or a real
+// os.Exit.
+func csiSocketWatchdogTick(csiAddress string, missingSince time.Time, grace time.Duration) (newMissingSince time.Time, shouldExit bool) {
+	fi, err := os.Stat(csiAddress)
+	if err == nil && (fi.Mode()&os.ModeSocket) != 0 {
+		return time.Time{}, false
+	}
+	if missingSince.IsZero() {
+		return time.Now(), false
+	}
+	return missingSince, time.Since(missingSince) >= grace
+}
+
+// nodeDeletedTick performs one check of runAnnotationLoop's
+// --exit-on-node-deleted bookkeeping, mirroring csiSocketWatchdogTick's
+// shape: given the missingSince this process was already tracking and
+// whether the Node object was observed missing (getVerifyAndAddNodeId
+// returned errNodeNotFound) on this iteration, it returns the updated
+// missingSince and whether the node has now been missing for at least
+// grace. Split out so the decision logic can be unit tested without
+// driving a real annotation loop iteration or os.Exit.
+func nodeDeletedTick(nodeMissing bool, missingSince time.Time, grace time.Duration) (newMissingSince time.Time, shouldExit bool) {
+	if !nodeMissing {
+		return time.Time{}, false
+	}
+	if missingSince.IsZero() {
+		return time.Now(), false
+	}
+	return missingSince, time.Since(missingSince) >= grace
+}
+
+// startCSISocketWatchdog polls, every csiSocketWatchdogCheckInterval,
+// whether the CSI driver socket at csiAddress still exists on disk. If it is
+// continuously missing for at least grace, it logs an error and exits the
+// process, so the usual DaemonSet RestartPolicy can recreate it once the CSI
+// driver's socket reappears. A disappearance shorter than grace (e.g. the
+// driver recreating its own socket across a quick restart) does not trigger
+// an exit, since missingSince is reset as soon as the socket is seen again.
+// It runs until the process exits; the caller should only start it for a
+// unix socket csiAddress.
+func startCSISocketWatchdog(csiAddress string, grace time.Duration) {
+	var missingSince time.Time
+	for range time.Tick(csiSocketWatchdogCheckInterval) {
+		var shouldExit bool
+		missingSince, shouldExit = csiSocketWatchdogTick(csiAddress, missingSince, grace)
+		if shouldExit {
+			glog.Errorf("CSI driver socket %q has been missing for at least %s (>= --csi-socket-missing-grace=%s); exiting so the driver-registrar is restarted once it reappears.", csiAddress, time.Since(missingSince), grace)
+			os.Exit(exitCSIConnectionFailure)
+		}
+	}
+}
 
-	// Connect to CSI.
-	glog.V(1).Infof("Attempting to open a gRPC connection with: %q", *csiAddress)
-	csiConn, err := connection.NewConnection(*csiAddress, *connectionTimeout)
+// startStartupWatchdog enforces --startup-timeout: if markDone is not called
+// within timeout of this call, it logs an error and exits the process with
+// exitStartupTimeout. Its deadline is derived from ctx, but is independent
+// of any individual CSI call's own timeout, deliberately not derived from
+// any other timeout already bounding the startup sequence's own RPCs, so the
+// two mechanisms cannot race to exit with different codes for the same
+// underlying hang. If ctx is cancelled first, the watchdog stops without
+// exiting. timeout <= 0 disables the watchdog entirely, returning a no-op
+// markDone.
+func startStartupWatchdog(ctx context.Context, csiAddress string, timeout time.Duration) (markDone context.CancelFunc) {
+	if timeout <= 0 {
+		return func() {}
+	}
+	watchCtx, cancel := context.WithTimeout(ctx, timeout)
+	go func() {
+		<-watchCtx.Done()
+		if watchCtx.Err() == context.DeadlineExceeded {
+			glog.Errorf("Driver %q has not reached its first successful registration or node-id annotation within --startup-timeout=%s; exiting so the driver-registrar is restarted.", csiAddress, timeout)
+			os.Exit(exitStartupTimeout)
+		}
+	}()
+	return cancel
+}
+
+// runDriver connects to a single CSI driver socket and registers it with
+// kubelet, by node-id annotation, registration socket, or both depending on
+// kubeletRegistrationPath and --enable-nodeid-annotation. It does not
+// return; like nodeRegister, it either runs until the process is signalled
+// to shut down or exits the process directly on an unrecoverable error.
+//
+// ctx is the parent used only for --startup-timeout (see
+// startStartupWatchdog); it is not threaded into the individual CSI call
+// contexts below, each of which keeps its own timeout derived independently
+// from context.Background().
+func runDriver(ctx context.Context, config *rest.Config, csiAddress, kubeletRegistrationPath, driverEndpoint, expectedDriverName string) {
+	markStartupDone := startStartupWatchdog(ctx, csiAddress, *startupTimeout)
+	// Connect to CSI, waiting on the socket file and then the driver
+	// answering a Probe call, so a slow startup logs clearly which of the
+	// two it is still waiting on.
+	glog.V(1).Infof("Waiting for CSI driver socket: %q", csiAddress)
+	socketWaitSpan := startSpan("csi-socket-wait")
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), *connectionTimeout)
+	defer waitCancel()
+	csiConn, err := connection.WaitForServer(waitCtx, csiAddress)
 	if err != nil {
-		glog.Error(err.Error())
-		os.Exit(1)
+		socketWaitSpan.End("", "", err)
+		switch err.(type) {
+		case *connection.SocketNotFoundError:
+			glog.Errorf("Timed out waiting for CSI driver socket %q to be created: %v", csiAddress, err)
+		case *connection.ProbeError:
+			glog.Errorf("Found CSI driver socket %q, but the driver did not respond to Probe in time: %v", csiAddress, err)
+		default:
+			glog.Error(err.Error())
+		}
+		os.Exit(exitCSIConnectionFailure)
+	}
+	defer csiConn.Close()
+
+	// The driver may accept connections and answer the initial Probe call in
+	// WaitForServer before it has actually finished initializing, so wait
+	// for it to report ready before querying anything that depends on its
+	// state being fully set up.
+	readyCtx, readyCancel := context.WithTimeout(context.Background(), *connectionTimeout)
+	defer readyCancel()
+	if err := connection.WaitForReady(readyCtx, csiConn, csiAddress); err != nil {
+		socketWaitSpan.End("", "", err)
+		glog.Errorf("CSI driver %q did not report ready in time: %v", csiAddress, err)
+		os.Exit(exitCSIConnectionFailure)
+	}
+	socketWaitSpan.End("", "", nil)
+
+	if *csiSocketWatchdog {
+		if network, target, err := connection.ParseAddress(csiAddress); err == nil && network == "unix" {
+			go startCSISocketWatchdog(target, *csiSocketMissingGrace)
+		}
 	}
 
 	// Get CSI driver name.
-	glog.V(1).Infof("Calling CSI driver to discover driver name.")
-	ctx, cancel := context.WithTimeout(context.Background(), csiTimeout)
+	driverNameSpan := startSpan("discover-driver-name")
+	ctx, cancel := context.WithTimeout(context.Background(), *csiGetDriverNameTimeout)
 	defer cancel()
+	csiDriverName, vendorVersion, err := discoverDriverName(ctx, csiConn, csiAddress, *csiGetDriverNameTimeout)
+	driverNameSpan.End(csiDriverName, "", err)
+	if err != nil {
+		glog.Errorf("%v", err)
+		os.Exit(exitCSIDriverNameFailure)
+	}
+
+	if err := validateExpectedDriverName(expectedDriverName, csiDriverName); err != nil {
+		glog.Errorf("%v", err)
+		os.Exit(exitCSIDriverNameFailure)
+	}
+
+	nodeRegister(config, csiConn, csiDriverName, vendorVersion, csiAddress, kubeletRegistrationPath, driverEndpoint, markStartupDone)
+}
+
+// wrapCSICallError adds the CSI call name, socket address, and configured
+// timeout to err, so a hung driver produces an actionable message instead of
+// a bare "context deadline exceeded". Callers can match on the "CSI call ...
+// timed out" prefix to distinguish a timeout from other failures. flagName
+// is the flag that controls timeout, named in the error so raising it is
+// obvious.
+func wrapCSICallError(call, csiAddress, flagName string, timeout time.Duration, err error) error {
+	if status.Code(err) == codes.DeadlineExceeded {
+		return fmt.Errorf("CSI call %q to %q timed out after %s (see --%s): %v", call, csiAddress, timeout, flagName, err)
+	}
+	return fmt.Errorf("CSI call %q to %q failed: %v", call, csiAddress, err)
+}
+
+// startDebugServer serves net/http/pprof's handlers on address in the
+// background, for capturing goroutine dumps from a registrar that has
+// deadlocked (e.g. in GetInfo or the annotation resync loop). It runs for
+// the lifetime of the process; there's nothing to shut down separately, it
+// goes away when the process exits like every other goroutine.
+func startDebugServer(address string) {
+	glog.Infof("Starting pprof debug server on %s", address)
+	go func() {
+		if err := http.ListenAndServe(address, nil); err != nil {
+			glog.Errorf("pprof debug server on %s stopped: %v", address, err)
+		}
+	}()
+}
+
+// checkEndpointExists stats path, the CSI driver socket advertised as the
+// "endpoint" in GetInfo, and warns if it is missing or not a socket. A
+// common misconfiguration is mounting the wrong hostPath, after which
+// registration silently fails once kubelet tries to dial it. The check is
+// not fatal by default, since the CSI driver container may create the
+// socket slightly after this one starts; --require-endpoint-exists makes it
+// fatal for deployments that can guarantee startup ordering.
+func checkEndpointExists(path string) {
+	fi, err := os.Stat(path)
+	if err == nil && (fi.Mode()&os.ModeSocket) != 0 {
+		return
+	}
+
+	msg := fmt.Sprintf("driver endpoint %q does not point at an existing socket (err=%v); kubelet's later registration attempt will fail until it does", path, err)
+	if *requireEndpointExists {
+		glog.Errorf("%s", msg)
+		os.Exit(exitRegistrationSocketFailure)
+	}
+	glog.Warningf("%s", msg)
+}
+
+// endpointWatchdogCheckInterval is how often startEndpointWatchdog stats the
+// driver endpoint. Independent of --endpoint-missing-grace for the same
+// reason as csiSocketWatchdogCheckInterval: a fixed interval well under any
+// reasonable grace period is precise enough in practice.
+const endpointWatchdogCheckInterval = 5 * time.Second
+
+// endpointWatchdogTick performs one check of startEndpointWatchdog's loop
+// body: given the missingSince this watchdog was already tracking, it
+// returns the updated missingSince and whether the endpoint has now been
+// missing for at least grace. Split out from startEndpointWatchdog so the
+// decision logic can be unit tested without an infinite loop or a real
+// os.Exit.
+func endpointWatchdogTick(endpoint string, missingSince time.Time, grace time.Duration) (newMissingSince time.Time, shouldFlag bool) {
+	fi, err := os.Stat(endpoint)
+	if err == nil && (fi.Mode()&os.ModeSocket) != 0 {
+		return time.Time{}, false
+	}
+	if missingSince.IsZero() {
+		return time.Now(), false
+	}
+	return missingSince, time.Since(missingSince) >= grace
+}
+
+// startEndpointWatchdog polls, every endpointWatchdogCheckInterval, whether
+// the driver endpoint still exists on disk. Once it has been continuously
+// missing for at least grace, it logs an error and, if exitOnMissing is set,
+// exits the process so the usual DaemonSet RestartPolicy tears down the now
+// stale registration. A disappearance shorter than grace (e.g. the driver
+// recreating its own socket across a quick restart) does not trigger
+// anything, since missingSince is reset as soon as the endpoint is seen
+// again. It runs until the process exits.
+func startEndpointWatchdog(endpoint string, grace time.Duration, exitOnMissing bool) {
+	var missingSince time.Time
+	flagged := false
+	for range time.Tick(endpointWatchdogCheckInterval) {
+		var shouldFlag bool
+		missingSince, shouldFlag = endpointWatchdogTick(endpoint, missingSince, grace)
+		if !shouldFlag {
+			flagged = false
+			continue
+		}
+		if flagged {
+			continue
+		}
+		flagged = true
+		glog.Errorf("driver endpoint %q has been missing for at least %s (>= --endpoint-missing-grace=%s); the registration socket is now advertising a dead endpoint to kubelet.", endpoint, time.Since(missingSince), grace)
+		if exitOnMissing {
+			os.Exit(exitRegistrationSocketFailure)
+		}
+	}
+}
+
+// maxDriverNameLength is the longest CSI driver name kubelet will accept; it
+// keeps the "<name>-reg.sock" registration socket filename well under the
+// usual 108 byte unix socket path limit.
+const maxDriverNameLength = 63
+
+// discoverDriverName calls GetDriverName and GetPluginVendorVersion on
+// csiConn, validates the driver name, and logs (without failing on) an
+// unrecognized vendor version, returning the driver name and (if the driver
+// reported one) its vendor version for callers to act on. Extracted from
+// main() so the startup discovery sequence can be exercised against a fake
+// connection.CSIConnection instead of a real CSI driver socket. csiAddress
+// and getDriverNameTimeout are only used to annotate a GetDriverName error
+// message.
+func discoverDriverName(ctx context.Context, csiConn connection.CSIConnection, csiAddress string, getDriverNameTimeout time.Duration) (driverName string, vendorVersion string, err error) {
+	glog.V(1).Infof("Calling CSI driver to discover driver name.")
 	csiDriverName, err := csiConn.GetDriverName(ctx)
 	if err != nil {
-		glog.Error(err.Error())
-		os.Exit(1)
+		return "", "", wrapCSICallError("GetDriverName", csiAddress, "csi-getdrivername-timeout", getDriverNameTimeout, err)
 	}
 	glog.V(2).Infof("CSI driver name: %q", csiDriverName)
 
-	// Create the client config. Use kubeconfig if given, otherwise assume
-	// in-cluster.
-	glog.V(1).Infof("Loading kubeconfig.")
-	config, err := buildConfig(*kubeconfig)
+	if err := validateDriverName(csiDriverName); err != nil {
+		return "", "", fmt.Errorf("invalid CSI driver name %q: %v", csiDriverName, err)
+	}
+
+	vendorVersion, err = csiConn.GetPluginVendorVersion(ctx)
 	if err != nil {
-		glog.Error(err.Error())
-		os.Exit(1)
+		glog.Warningf("Unable to determine CSI driver vendor version: %v", err)
+		vendorVersion = ""
+	} else if err := verifyDriverVersionSupported(vendorVersion, supportedVersions.values); err != nil {
+		glog.Warningf("CSI driver %q reports vendor version %q, which this registrar does not recognize: %v", csiDriverName, vendorVersion, err)
 	}
 
-	// Run forever
-	nodeRegister(config, csiConn, csiDriverName)
+	return csiDriverName, vendorVersion, nil
 }
 
-func buildConfig(kubeconfig string) (*rest.Config, error) {
+// validateExpectedDriverName checks actualDriverName against expectedDriverName
+// when the latter is set via --expected-driver-name, returning a clear error
+// on mismatch so a misconfigured hostPath or socket mount that points this
+// process at the wrong driver fails loudly instead of silently
+// annotating/registering the node under the wrong driver's name. A blank
+// expectedDriverName (the default) disables the check.
+func validateExpectedDriverName(expectedDriverName, actualDriverName string) error {
+	if expectedDriverName == "" || expectedDriverName == actualDriverName {
+		return nil
+	}
+	return fmt.Errorf("CSI driver reported name %q, but --expected-driver-name is %q; check that the correct driver's socket is mounted", actualDriverName, expectedDriverName)
+}
+
+// validateDriverName checks that name is a valid RFC 1123 subdomain (the
+// same rule kubelet applies) and short enough to use in the registration
+// socket filename.
+func validateDriverName(name string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("driver name is empty")
+	}
+	if len(name) > maxDriverNameLength {
+		return fmt.Errorf("driver name %q is %d characters long, exceeds %d", name, len(name), maxDriverNameLength)
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) != 0 {
+		return fmt.Errorf(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// validatePluginRegistrationAPIVersion rejects any --plugin-registration-api-version
+// other than "v1alpha1".
+//
+// TODO(msau42/node-driver-registrar#synth-556): kubelet's pluginregistration
+// API has a stable "v1" successor to the "v1alpha1" this registrar serves
+// today, and newer kubelets prefer it, but only v1alpha1 is vendored in this
+// tree (vendor/k8s.io/kubernetes/pkg/kubelet/apis/pluginregistration has no
+// v1 directory). Once v1 is vendored, registrationServer should grow a v1
+// sibling implementing the v1 RegistrationServer interface (the two APIs
+// are structurally identical, so this is expected to be a thin wrapper),
+// runRegistrationServer should register whichever version this flag
+// selects, and "auto" should probe for v1 support and fall back to
+// v1alpha1. Until then this flag exists so config already targeting it for
+// a future rollout is rejected clearly instead of silently ignored.
+func validatePluginRegistrationAPIVersion(apiVersion string) error {
+	if apiVersion != "v1alpha1" {
+		return fmt.Errorf("unsupported --plugin-registration-api-version %q: only \"v1alpha1\" is vendored in this build", apiVersion)
+	}
+	return nil
+}
+
+// validateRegistrationSocketType rejects any --registration-socket-type
+// other than "unix" or "abstract", and rejects "abstract" outright on any
+// OS other than Linux, where abstract-namespace unix sockets do not exist.
+func validateRegistrationSocketType(socketType string) error {
+	switch socketType {
+	case registrationSocketTypeUnix:
+		return nil
+	case registrationSocketTypeAbstract:
+		if !abstractSocketsSupported {
+			return fmt.Errorf("--registration-socket-type=abstract is only supported on Linux")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported --registration-socket-type %q: must be %q or %q", socketType, registrationSocketTypeUnix, registrationSocketTypeAbstract)
+	}
+}
+
+// validateVolumeLimitsMode rejects any --volume-limits-mode other than
+// "annotation" or "status".
+func validateVolumeLimitsMode(mode string) error {
+	switch mode {
+	case volumeLimitsModeAnnotation, volumeLimitsModeStatus:
+		return nil
+	default:
+		return fmt.Errorf("unsupported --volume-limits-mode %q: must be %q or %q", mode, volumeLimitsModeAnnotation, volumeLimitsModeStatus)
+	}
+}
+
+// validateRegistrationDir rejects a non-absolute --registration-dir outright
+// (a relative path would be resolved against whatever directory the process
+// happens to be started from, which is never what a hostPath mount means),
+// then ensures dir exists: if it is already a directory, this is a no-op; if
+// it is missing, create is consulted, creating it (and any missing parents)
+// with os.MkdirAll when set, or returning an actionable error when unset,
+// rather than only discovering the problem later as an opaque "no such file
+// or directory" from net.Listen.
+func validateRegistrationDir(dir string, create bool) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("--registration-dir %q must be an absolute path", dir)
+	}
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("--registration-dir %q exists but is not a directory", dir)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to stat --registration-dir %q: %v", dir, err)
+	}
+	if !create {
+		return fmt.Errorf("--registration-dir %q does not exist; create it (it is normally a kubelet plugin registration hostPath mount) or set --create-registration-dir to have this process create it", dir)
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("failed to create --registration-dir %q: %v", dir, err)
+	}
+	return nil
+}
+
+// verifyDriverVersionSupported returns an error if vendorVersion is
+// non-empty and does not appear in supportedVersions. An empty
+// vendorVersion is accepted, since the CSI spec does not require drivers to
+// report one.
+func verifyDriverVersionSupported(vendorVersion string, supportedVersions []string) error {
+	if vendorVersion == "" {
+		return nil
+	}
+	for _, v := range supportedVersions {
+		if v == vendorVersion {
+			return nil
+		}
+	}
+	return fmt.Errorf("version %q is not in the supported list %v", vendorVersion, supportedVersions)
+}
+
+func buildConfig(kubeconfig, kubeContext string, qps float32, burst int, fieldManager string) (*rest.Config, error) {
+	var config *rest.Config
+	var err error
 	if kubeconfig != "" {
-		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if kubeContext == "" {
+			config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		} else {
+			loadingRules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig}
+			overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+			config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+		}
+	} else {
+		// Use the service account kubernetes gives to pods. It's intended
+		// for clients that are running inside a pod running on kubernetes.
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config.QPS = qps
+	config.Burst = burst
+	if fieldManager != "" {
+		config.UserAgent = fieldManager
 	}
+	return config, nil
+}
 
-	// Return config object which uses the service account kubernetes gives to
-	// pods. It's intended for clients that are running inside a pod running on
-	// kubernetes.
-	return rest.InClusterConfig()
+// buildTLSConfig constructs the TLS client configuration for a TCP
+// --csi-address from --csi-tls-ca/--csi-tls-cert/--csi-tls-key, returning a
+// nil *tls.Config (not an error) when none of the three are set, which
+// connection.TLSConfig treats as "dial insecurely", the historical default.
+// caFile verifies the driver's server certificate, falling back to the
+// system root CAs when unset; certFile/keyFile present a client certificate
+// for mTLS and must be set together.
+func buildTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("--csi-tls-cert and --csi-tls-key must be set together")
+	}
+
+	config := &tls.Config{}
+	if caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read --csi-tls-ca %q: %v", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in --csi-tls-ca %q", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load --csi-tls-cert/--csi-tls-key: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
 }
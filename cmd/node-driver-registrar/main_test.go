@@ -0,0 +1,1509 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	registerapi "k8s.io/kubernetes/pkg/kubelet/apis/pluginregistration/v1alpha1"
+
+	"github.com/kubernetes-csi/node-driver-registrar/pkg/connection"
+	"github.com/kubernetes-csi/node-driver-registrar/pkg/connection/fake"
+)
+
+// selfSignedCertPEM generates a fresh in-memory self-signed certificate for
+// TestBuildTLSConfig's --csi-tls-ca fixture, which only needs well-formed
+// PEM input, not a certificate that actually chains to anything.
+func selfSignedCertPEM(t *testing.T) []byte {
+	t.Helper()
+	der, _ := generateSelfSignedDER(t)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func generateSelfSignedDER(t *testing.T) ([]byte, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "node-driver-registrar-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	return der, key
+}
+
+func TestStringSliceFlag(t *testing.T) {
+	f := &stringSliceFlag{values: []string{"1.0.0"}}
+
+	if err := f.Set("1.1.0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := f.values, []string{"1.1.0"}; len(got) != len(want) || got[0] != want[0] {
+		t.Fatalf("first Set should replace the default value, got %v", got)
+	}
+
+	if err := f.Set("1.2.0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := f.values, []string{"1.1.0", "1.2.0"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("subsequent Set calls should append, got %v", got)
+	}
+}
+
+func TestPairRegistrationPaths(t *testing.T) {
+	t.Run("unset registration path defaults every driver to annotation-only", func(t *testing.T) {
+		got, err := pairRegistrationPaths([]string{"/run/csi/a.sock", "/run/csi/b.sock"}, &stringSliceFlag{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := []string{"", ""}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("matching counts pair positionally", func(t *testing.T) {
+		registrationPath := &stringSliceFlag{}
+		registrationPath.Set("/registration/a-reg.sock")
+		registrationPath.Set("")
+		registrationPath.Set("/registration/c-reg.sock")
+
+		got, err := pairRegistrationPaths([]string{"/run/csi/a.sock", "/run/csi/b.sock", "/run/csi/c.sock"}, registrationPath)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := []string{"/registration/a-reg.sock", "", "/registration/c-reg.sock"}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("index %d: got %q, want %q", i, got[i], want[i])
+			}
+		}
+	})
+
+	t.Run("mismatched counts are an error", func(t *testing.T) {
+		registrationPath := &stringSliceFlag{}
+		registrationPath.Set("/registration/a-reg.sock")
+
+		if _, err := pairRegistrationPaths([]string{"/run/csi/a.sock", "/run/csi/b.sock"}, registrationPath); err == nil {
+			t.Error("expected an error when --kubelet-registration-path is given a different number of times than --csi-address")
+		}
+	})
+}
+
+func TestResolveDriverEndpoints(t *testing.T) {
+	t.Run("unset driver endpoint defaults every driver to its registration path", func(t *testing.T) {
+		got, err := resolveDriverEndpoints([]string{"/registration/a-reg.sock", "/registration/b-reg.sock"}, &stringSliceFlag{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := []string{"/registration/a-reg.sock", "/registration/b-reg.sock"}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("index %d: got %q, want %q", i, got[i], want[i])
+			}
+		}
+	})
+
+	t.Run("set entries override, empty entries default", func(t *testing.T) {
+		driverEndpoint := &stringSliceFlag{}
+		driverEndpoint.Set("/var/lib/kubelet/plugins/a/csi.sock")
+		driverEndpoint.Set("")
+
+		got, err := resolveDriverEndpoints([]string{"/registration/a-reg.sock", "/registration/b-reg.sock"}, driverEndpoint)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := []string{"/var/lib/kubelet/plugins/a/csi.sock", "/registration/b-reg.sock"}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("index %d: got %q, want %q", i, got[i], want[i])
+			}
+		}
+	})
+
+	t.Run("mismatched counts are an error", func(t *testing.T) {
+		driverEndpoint := &stringSliceFlag{}
+		driverEndpoint.Set("/var/lib/kubelet/plugins/a/csi.sock")
+
+		if _, err := resolveDriverEndpoints([]string{"/registration/a-reg.sock", "/registration/b-reg.sock"}, driverEndpoint); err == nil {
+			t.Error("expected an error when --driver-endpoint is given a different number of times than --csi-address")
+		}
+	})
+
+	t.Run("relative path is rejected", func(t *testing.T) {
+		driverEndpoint := &stringSliceFlag{}
+		driverEndpoint.Set("relative/path.sock")
+
+		if _, err := resolveDriverEndpoints([]string{"/registration/a-reg.sock"}, driverEndpoint); err == nil {
+			t.Error("expected an error for a relative --driver-endpoint")
+		}
+	})
+}
+
+// withNodeIdAnnotationFlags sets *nodeIdAnnotation,
+// additionalNodeIdAnnotationKeys, and deregisterAnnotationKeys for the
+// duration of a test, restoring their previous values afterwards, since all
+// three are package-level flag variables shared across the whole test
+// binary.
+func withNodeIdAnnotationFlags(t *testing.T, primary string, additional, deregister []string) {
+	t.Helper()
+	prevPrimary := *nodeIdAnnotation
+	prevAdditional := *additionalNodeIdAnnotationKeys
+	prevDeregister := *deregisterAnnotationKeys
+	t.Cleanup(func() {
+		*nodeIdAnnotation = prevPrimary
+		*additionalNodeIdAnnotationKeys = prevAdditional
+		*deregisterAnnotationKeys = prevDeregister
+	})
+
+	*nodeIdAnnotation = primary
+	*additionalNodeIdAnnotationKeys = stringSliceFlag{}
+	for _, k := range additional {
+		additionalNodeIdAnnotationKeys.Set(k)
+	}
+	*deregisterAnnotationKeys = stringSliceFlag{}
+	for _, k := range deregister {
+		deregisterAnnotationKeys.Set(k)
+	}
+}
+
+func TestAllNodeIdAnnotationKeys(t *testing.T) {
+	t.Run("no additional keys returns just the primary key", func(t *testing.T) {
+		withNodeIdAnnotationFlags(t, defaultAnnotationKey, nil, nil)
+
+		got := allNodeIdAnnotationKeys()
+		want := []string{defaultAnnotationKey}
+		if len(got) != len(want) || got[0] != want[0] {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("additional keys are appended after the primary key", func(t *testing.T) {
+		withNodeIdAnnotationFlags(t, defaultAnnotationKey, []string{"csi.volume.kubernetes.io/nodeid-v2"}, nil)
+
+		got := allNodeIdAnnotationKeys()
+		want := []string{defaultAnnotationKey, "csi.volume.kubernetes.io/nodeid-v2"}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("index %d: got %q, want %q", i, got[i], want[i])
+			}
+		}
+	})
+
+	t.Run("a key repeated in both flags is only returned once", func(t *testing.T) {
+		withNodeIdAnnotationFlags(t, defaultAnnotationKey, []string{defaultAnnotationKey, "csi.volume.kubernetes.io/nodeid-v2"}, nil)
+
+		got := allNodeIdAnnotationKeys()
+		want := []string{defaultAnnotationKey, "csi.volume.kubernetes.io/nodeid-v2"}
+		if len(got) != len(want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("index %d: got %q, want %q", i, got[i], want[i])
+			}
+		}
+	})
+}
+
+func TestDeregisterAnnotationKeysEffective(t *testing.T) {
+	t.Run("unset falls back to every active key", func(t *testing.T) {
+		withNodeIdAnnotationFlags(t, defaultAnnotationKey, []string{"csi.volume.kubernetes.io/nodeid-v2"}, nil)
+
+		got := deregisterAnnotationKeysEffective()
+		want := []string{defaultAnnotationKey, "csi.volume.kubernetes.io/nodeid-v2"}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("index %d: got %q, want %q", i, got[i], want[i])
+			}
+		}
+	})
+
+	t.Run("explicit value overrides the active key list", func(t *testing.T) {
+		withNodeIdAnnotationFlags(t, defaultAnnotationKey, []string{"csi.volume.kubernetes.io/nodeid-v2"}, []string{defaultAnnotationKey})
+
+		got := deregisterAnnotationKeysEffective()
+		want := []string{defaultAnnotationKey}
+		if len(got) != len(want) || got[0] != want[0] {
+			t.Errorf("got %v, want %v; explicit --deregister-annotation-keys should not fall back to the additional key", got, want)
+		}
+	})
+}
+
+func TestVerifyDriverVersionSupported(t *testing.T) {
+	tests := []struct {
+		name          string
+		vendorVersion string
+		supported     []string
+		expectError   bool
+	}{
+		{
+			name:          "empty vendor version is always accepted",
+			vendorVersion: "",
+			supported:     []string{"1.0.0"},
+		},
+		{
+			name:          "supported version",
+			vendorVersion: "1.0.0",
+			supported:     []string{"1.0.0"},
+		},
+		{
+			name:          "unsupported version",
+			vendorVersion: "2.0.0",
+			supported:     []string{"1.0.0"},
+			expectError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		err := verifyDriverVersionSupported(test.vendorVersion, test.supported)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: unexpected error: %v", test.name, err)
+		}
+	}
+}
+
+func TestWrapCSICallError(t *testing.T) {
+	timeoutErr := status.Error(codes.DeadlineExceeded, "context deadline exceeded")
+	err := wrapCSICallError("GetDriverName", "/run/csi/socket", "csi-getdrivername-timeout", 5*time.Second, timeoutErr)
+	if !strings.Contains(err.Error(), "GetDriverName") ||
+		!strings.Contains(err.Error(), "/run/csi/socket") ||
+		!strings.Contains(err.Error(), "5s") ||
+		!strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected wrapped timeout message to mention the call, address, and timeout, got: %v", err)
+	}
+
+	otherErr := status.Error(codes.Unavailable, "connection refused")
+	err = wrapCSICallError("GetDriverName", "/run/csi/socket", "csi-getdrivername-timeout", 5*time.Second, otherErr)
+	if strings.Contains(err.Error(), "timed out") {
+		t.Errorf("non-timeout error should not be reported as a timeout, got: %v", err)
+	}
+}
+
+// TestGetDriverNameTimeoutIsActionable verifies that a driver which hangs on
+// GetPluginInfo produces a wrapped error naming the call, the address, and
+// the configured timeout, rather than a bare context error.
+func TestGetDriverNameTimeoutIsActionable(t *testing.T) {
+	drv := fake.NewCSIDriver()
+	defer drv.Stop()
+	drv.GetPluginInfoBlock = make(chan struct{})
+	defer close(drv.GetPluginInfoBlock)
+
+	csiConn, err := drv.Connect()
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer csiConn.Close()
+
+	timeout := 50 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, callErr := csiConn.GetDriverName(ctx)
+	if callErr == nil {
+		t.Fatal("expected a timeout error, got none")
+	}
+
+	wrapped := wrapCSICallError("GetDriverName", "/run/csi/socket", "csi-getdrivername-timeout", timeout, callErr)
+	if !strings.Contains(wrapped.Error(), "timed out") {
+		t.Errorf("expected wrapped error to report a timeout, got: %v", wrapped)
+	}
+	if !strings.Contains(wrapped.Error(), "GetDriverName") || !strings.Contains(wrapped.Error(), "/run/csi/socket") {
+		t.Errorf("expected wrapped error to name the call and address, got: %v", wrapped)
+	}
+}
+
+// TestDiscoverDriverName exercises the discoverDriverName startup sequence
+// against a fake connection.CSIConnection, without a real CSI driver socket.
+func TestDiscoverDriverName(t *testing.T) {
+	oldSupportedVersions := supportedVersions.values
+	defer func() { supportedVersions.values = oldSupportedVersions }()
+	supportedVersions.values = []string{"1.0.0"}
+
+	tests := []struct {
+		name          string
+		driverName    string
+		vendorVersion string
+		wantErr       bool
+	}{
+		{
+			name:          "valid driver name and supported version",
+			driverName:    "csi.example.com",
+			vendorVersion: "1.0.0",
+		},
+		{
+			name:          "unsupported vendor version only warns",
+			driverName:    "csi.example.com",
+			vendorVersion: "9.9.9",
+		},
+		{
+			name:       "invalid driver name fails",
+			driverName: "Not Valid!",
+			wantErr:    true,
+		},
+	}
+
+	for _, test := range tests {
+		drv := fake.NewCSIDriver()
+		drv.DriverName = test.driverName
+		drv.VendorVersion = test.vendorVersion
+		func() {
+			defer drv.Stop()
+			csiConn, err := drv.Connect()
+			if err != nil {
+				t.Fatalf("test %q: failed to connect: %v", test.name, err)
+			}
+			defer csiConn.Close()
+
+			got, gotVersion, err := discoverDriverName(context.Background(), csiConn, "/run/csi/socket", time.Second)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("test %q: expected an error, got none", test.name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("test %q: unexpected error: %v", test.name, err)
+			}
+			if got != test.driverName {
+				t.Errorf("test %q: got driver name %q, want %q", test.name, got, test.driverName)
+			}
+			if gotVersion != test.vendorVersion {
+				t.Errorf("test %q: got vendor version %q, want %q", test.name, gotVersion, test.vendorVersion)
+			}
+		}()
+	}
+}
+
+func TestRegistrationServerTracksLastGetInfo(t *testing.T) {
+	srv := newRegistrationServer("csi.example.com", "/run/csi/socket", []string{"1.0.0"}, "test-node", nil, nil)
+
+	srv.mu.Lock()
+	created := srv.lastGetInfo
+	srv.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+	if _, err := srv.GetInfo(context.Background(), &registerapi.InfoRequest{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	srv.mu.Lock()
+	afterGetInfo := srv.lastGetInfo
+	srv.mu.Unlock()
+
+	if !afterGetInfo.After(created) {
+		t.Errorf("expected GetInfo to advance lastGetInfo, got created=%v, afterGetInfo=%v", created, afterGetInfo)
+	}
+}
+
+func TestRegistrationServerRespectsCancelledContext(t *testing.T) {
+	srv := newRegistrationServer("csi.example.com", "/run/csi/socket", []string{"1.0.0"}, "test-node", nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := srv.GetInfo(ctx, &registerapi.InfoRequest{}); err != ctx.Err() {
+		t.Errorf("GetInfo: got error %v, want %v", err, ctx.Err())
+	}
+	if _, err := srv.NotifyRegistrationStatus(ctx, &registerapi.RegistrationStatus{PluginRegistered: true}); err != ctx.Err() {
+		t.Errorf("NotifyRegistrationStatus: got error %v, want %v", err, ctx.Err())
+	}
+}
+
+func TestRegistrationServerRecordsSocketDiscoveryLatency(t *testing.T) {
+	srv := newRegistrationServer("csi.example.com", "/run/csi/socket", []string{"1.0.0"}, "test-node", nil, nil)
+	srv.recordSocketReady("/csi/socket")
+
+	time.Sleep(time.Millisecond)
+	if _, err := srv.GetInfo(context.Background(), &registerapi.InfoRequest{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	srv.mu.Lock()
+	socketReadyTime, firstGetInfo := srv.socketReadyTime, srv.firstGetInfo
+	srv.mu.Unlock()
+	if !firstGetInfo.After(socketReadyTime) {
+		t.Errorf("expected firstGetInfo to be after socketReadyTime, got socketReadyTime=%v, firstGetInfo=%v", socketReadyTime, firstGetInfo)
+	}
+
+	statuses := statusSnapshot()
+	var found *driverStatus
+	for i := range statuses {
+		if statuses[i].CSIAddress == "/csi/socket" {
+			found = &statuses[i]
+		}
+	}
+	if found == nil {
+		t.Fatal("expected a status entry for /csi/socket")
+	}
+	if found.RegistrationSocketReadyTime.IsZero() || found.FirstGetInfoTime.IsZero() {
+		t.Errorf("expected RegistrationSocketReadyTime and FirstGetInfoTime to be set, got %+v", found)
+	}
+
+	// A second GetInfo call must not overwrite firstGetInfo.
+	time.Sleep(time.Millisecond)
+	if _, err := srv.GetInfo(context.Background(), &registerapi.InfoRequest{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	srv.mu.Lock()
+	secondFirstGetInfo := srv.firstGetInfo
+	srv.mu.Unlock()
+	if !secondFirstGetInfo.Equal(firstGetInfo) {
+		t.Errorf("expected firstGetInfo to stay fixed after the first call, got %v then %v", firstGetInfo, secondFirstGetInfo)
+	}
+}
+
+// TestNotifyRegistrationStatusTolerance only covers the non-fatal path,
+// where consecutive failures stay below --registration-failure-threshold:
+// the failing-past-the-threshold path cannot be unit tested since it calls
+// os.Exit.
+func TestNotifyRegistrationStatusTolerance(t *testing.T) {
+	oldThreshold := *registrationFailureThreshold
+	defer func() { *registrationFailureThreshold = oldThreshold }()
+	*registrationFailureThreshold = 3
+
+	srv := newRegistrationServer("csi.example.com", "/run/csi/socket", []string{"1.0.0"}, "test-node", nil, nil)
+
+	for i := 0; i < 2; i++ {
+		if _, err := srv.NotifyRegistrationStatus(context.Background(), &registerapi.RegistrationStatus{
+			PluginRegistered: false,
+			Error:            "connection refused",
+		}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	srv.mu.Lock()
+	got := srv.consecutiveFailures
+	srv.mu.Unlock()
+	if got != 2 {
+		t.Fatalf("got %d consecutive failures, want 2", got)
+	}
+
+	if _, err := srv.NotifyRegistrationStatus(context.Background(), &registerapi.RegistrationStatus{
+		PluginRegistered: true,
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	srv.mu.Lock()
+	got = srv.consecutiveFailures
+	srv.mu.Unlock()
+	if got != 0 {
+		t.Errorf("expected a successful registration to reset the failure counter, got %d", got)
+	}
+}
+
+// TestNotifyRegistrationStatusExitOnRegistrationFailureDisabled covers the
+// past-threshold path with --exit-on-registration-failure=false, which is
+// the one case where exceeding --registration-failure-threshold must not
+// call os.Exit and so is safe to exercise directly; the default
+// (--exit-on-registration-failure=true) past-threshold path cannot be unit
+// tested for the same reason as TestNotifyRegistrationStatusTolerance.
+func TestNotifyRegistrationStatusExitOnRegistrationFailureDisabled(t *testing.T) {
+	oldThreshold, oldExitOnFailure := *registrationFailureThreshold, *exitOnRegistrationFailure
+	defer func() {
+		*registrationFailureThreshold = oldThreshold
+		*exitOnRegistrationFailure = oldExitOnFailure
+	}()
+	*registrationFailureThreshold = 1
+	*exitOnRegistrationFailure = false
+
+	srv := newRegistrationServer("csi.example.com", "/run/csi/socket", []string{"1.0.0"}, "test-node", nil, nil)
+
+	for i := 0; i < 3; i++ {
+		if _, err := srv.NotifyRegistrationStatus(context.Background(), &registerapi.RegistrationStatus{
+			PluginRegistered: false,
+			Error:            "connection refused",
+		}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	srv.mu.Lock()
+	got := srv.consecutiveFailures
+	srv.mu.Unlock()
+	if got != 3 {
+		t.Errorf("got %d consecutive failures, want 3 (process should not have exited)", got)
+	}
+}
+
+func TestPrintVersion(t *testing.T) {
+	oldVersion, oldGitCommit, oldBuildDate := version, gitCommit, buildDate
+	defer func() { version, gitCommit, buildDate = oldVersion, oldGitCommit, oldBuildDate }()
+	version, gitCommit, buildDate = "v1.2.3", "deadbeef", "2026-01-02T03:04:05Z"
+
+	var textOut strings.Builder
+	if err := printVersion(&textOut, "text"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := textOut.String(); !strings.Contains(got, "v1.2.3") {
+		t.Errorf("got text output %q, want it to contain the version", got)
+	}
+
+	var jsonOut strings.Builder
+	if err := printVersion(&jsonOut, "json"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var info versionInfo
+	if err := json.Unmarshal([]byte(jsonOut.String()), &info); err != nil {
+		t.Fatalf("--output=json produced invalid JSON %q: %v", jsonOut.String(), err)
+	}
+	if info.Version != "v1.2.3" {
+		t.Errorf("got JSON version %q, want %q", info.Version, "v1.2.3")
+	}
+	if info.GitCommit != "deadbeef" {
+		t.Errorf("got JSON gitCommit %q, want %q", info.GitCommit, "deadbeef")
+	}
+	if info.BuildDate != "2026-01-02T03:04:05Z" {
+		t.Errorf("got JSON buildDate %q, want %q", info.BuildDate, "2026-01-02T03:04:05Z")
+	}
+	if info.GoVersion == "" {
+		t.Error("got empty JSON goVersion")
+	}
+
+	if err := printVersion(&jsonOut, "xml"); err == nil {
+		t.Error("expected an error for an unsupported --output value, got none")
+	}
+}
+
+// TestCheckEndpointExists only covers the non-fatal (default) path: with
+// --require-endpoint-exists unset, a missing socket must log a warning, not
+// exit the process. The fatal path cannot be unit tested since it calls
+// os.Exit.
+func TestCheckEndpointExists(t *testing.T) {
+	if *requireEndpointExists {
+		t.Fatal("expected --require-endpoint-exists to default to false")
+	}
+	// Must not exit the process.
+	checkEndpointExists("/does/not/exist")
+}
+
+func TestLogEventJSON(t *testing.T) {
+	old := *logFormat
+	*logFormat = "json"
+	defer func() { *logFormat = old }()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	oldStderr := os.Stderr
+	os.Stderr = w
+	logEvent("info", "csi.example.com", "test-node", "Received GetInfo call: %+v", "req")
+	w.Close()
+	os.Stderr = oldStderr
+
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read captured output: %v", err)
+	}
+
+	var entry struct {
+		Timestamp string `json:"timestamp"`
+		Level     string `json:"level"`
+		Message   string `json:"msg"`
+		Driver    string `json:"driver"`
+		Node      string `json:"node"`
+	}
+	if err := json.Unmarshal(out, &entry); err != nil {
+		t.Fatalf("expected a single JSON line, got %q: %v", out, err)
+	}
+	if entry.Level != "info" || entry.Driver != "csi.example.com" || entry.Node != "test-node" {
+		t.Errorf("unexpected log entry: %+v", entry)
+	}
+	if entry.Timestamp == "" {
+		t.Error("expected a non-empty timestamp")
+	}
+}
+
+func TestDebugServerServesPprof(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a port: %v", err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	startDebugServer(addr)
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = http.Get(fmt.Sprintf("http://%s/debug/pprof/", addr))
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("failed to reach debug server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 from /debug/pprof/, got %d", resp.StatusCode)
+	}
+}
+
+func TestOptionalBoolFlag(t *testing.T) {
+	f := &optionalBoolFlag{}
+	if f.isSet {
+		t.Fatal("expected a fresh optionalBoolFlag to be unset")
+	}
+	if !f.IsBoolFlag() {
+		t.Fatal("expected IsBoolFlag to report true so -flag works without a value")
+	}
+	if err := f.Set("true"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !f.isSet || !f.value {
+		t.Errorf("expected Set(\"true\") to record value=true, isSet=true, got %+v", f)
+	}
+}
+
+func TestApplyEnvVarDefaults(t *testing.T) {
+	saveCSIAddress, saveRegistrationPath := csiAddress, kubeletRegistrationPath
+	defer func() { csiAddress, kubeletRegistrationPath = saveCSIAddress, saveRegistrationPath }()
+	for _, envVar := range []string{"CSI_ADDRESS", "KUBELET_REGISTRATION_PATH"} {
+		oldVal, had := os.LookupEnv(envVar)
+		defer func(envVar string, oldVal string, had bool) {
+			if had {
+				os.Setenv(envVar, oldVal)
+			} else {
+				os.Unsetenv(envVar)
+			}
+		}(envVar, oldVal, had)
+	}
+
+	saveCSIAddressSource, saveRegistrationPathSource := csiAddressSource, kubeletRegistrationPathSource
+	defer func() {
+		csiAddressSource, kubeletRegistrationPathSource = saveCSIAddressSource, saveRegistrationPathSource
+	}()
+
+	t.Run("env var fills in an unset flag", func(t *testing.T) {
+		csiAddress = &stringSliceFlag{values: []string{"/run/csi/socket"}}
+		kubeletRegistrationPath = &stringSliceFlag{}
+		os.Setenv("CSI_ADDRESS", "/var/lib/env/csi.sock")
+		os.Setenv("KUBELET_REGISTRATION_PATH", "/var/lib/env/reg.sock")
+
+		applyEnvVarDefaults()
+
+		if got := csiAddress.values; len(got) != 1 || got[0] != "/var/lib/env/csi.sock" {
+			t.Errorf("expected CSI_ADDRESS to populate csiAddress, got %v", got)
+		}
+		if got := kubeletRegistrationPath.values; len(got) != 1 || got[0] != "/var/lib/env/reg.sock" {
+			t.Errorf("expected KUBELET_REGISTRATION_PATH to populate kubeletRegistrationPath, got %v", got)
+		}
+		if csiAddressSource != "env:CSI_ADDRESS" {
+			t.Errorf("got csiAddressSource %q, want %q", csiAddressSource, "env:CSI_ADDRESS")
+		}
+		if kubeletRegistrationPathSource != "env:KUBELET_REGISTRATION_PATH" {
+			t.Errorf("got kubeletRegistrationPathSource %q, want %q", kubeletRegistrationPathSource, "env:KUBELET_REGISTRATION_PATH")
+		}
+	})
+
+	t.Run("explicit flag takes precedence over env var", func(t *testing.T) {
+		csiAddress = &stringSliceFlag{}
+		csiAddress.Set("/flag/csi.sock")
+		os.Setenv("CSI_ADDRESS", "/var/lib/env/csi.sock")
+
+		applyEnvVarDefaults()
+
+		if got := csiAddress.values; len(got) != 1 || got[0] != "/flag/csi.sock" {
+			t.Errorf("expected the explicit flag value to survive, got %v", got)
+		}
+		if csiAddressSource != "flag" {
+			t.Errorf("got csiAddressSource %q, want %q", csiAddressSource, "flag")
+		}
+	})
+
+	t.Run("built-in default is kept when neither flag nor env var is set", func(t *testing.T) {
+		csiAddress = &stringSliceFlag{values: []string{"/run/csi/socket"}}
+		os.Unsetenv("CSI_ADDRESS")
+
+		applyEnvVarDefaults()
+
+		if got := csiAddress.values; len(got) != 1 || got[0] != "/run/csi/socket" {
+			t.Errorf("expected the built-in default to survive, got %v", got)
+		}
+		if csiAddressSource != "default" {
+			t.Errorf("got csiAddressSource %q, want %q", csiAddressSource, "default")
+		}
+	})
+}
+
+func TestEnableNodeIdAnnotationEffective(t *testing.T) {
+	oldFlag := *enableNodeIdAnnotation
+	defer func() { *enableNodeIdAnnotation = oldFlag }()
+
+	tests := []struct {
+		name                    string
+		kubeletRegistrationPath string
+		flagSet                 bool
+		flagValue               bool
+		want                    bool
+	}{
+		{
+			name: "defaults to enabled when registration path unset",
+			want: true,
+		},
+		{
+			name:                    "defaults to disabled when registration path set",
+			kubeletRegistrationPath: "/var/lib/kubelet/plugins/csi.sock",
+			want:                    false,
+		},
+		{
+			name:                    "explicit true wins even with a registration path",
+			kubeletRegistrationPath: "/var/lib/kubelet/plugins/csi.sock",
+			flagSet:                 true,
+			flagValue:               true,
+			want:                    true,
+		},
+		{
+			name:      "explicit false wins even without a registration path",
+			flagSet:   true,
+			flagValue: false,
+			want:      false,
+		},
+	}
+
+	for _, test := range tests {
+		*enableNodeIdAnnotation = optionalBoolFlag{isSet: test.flagSet, value: test.flagValue}
+
+		if got := enableNodeIdAnnotationEffective(test.kubeletRegistrationPath); got != test.want {
+			t.Errorf("test %q: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+const twoContextKubeconfig = `
+apiVersion: v1
+kind: Config
+clusters:
+- name: cluster-a
+  cluster:
+    server: https://cluster-a.example.com
+- name: cluster-b
+  cluster:
+    server: https://cluster-b.example.com
+contexts:
+- name: context-a
+  context:
+    cluster: cluster-a
+    user: user-a
+- name: context-b
+  context:
+    cluster: cluster-b
+    user: user-b
+current-context: context-a
+users:
+- name: user-a
+  user: {}
+- name: user-b
+  user: {}
+`
+
+func TestBuildConfigContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node-driver-registrar-kubeconfig")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kubeconfigPath := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(kubeconfigPath, []byte(twoContextKubeconfig), 0644); err != nil {
+		t.Fatalf("failed to write kubeconfig fixture: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		context    string
+		wantServer string
+	}{
+		{
+			name:       "no context uses current-context",
+			wantServer: "https://cluster-a.example.com",
+		},
+		{
+			name:       "explicit context overrides current-context",
+			context:    "context-b",
+			wantServer: "https://cluster-b.example.com",
+		},
+	}
+
+	for _, test := range tests {
+		config, err := buildConfig(kubeconfigPath, test.context, 5, 10, "")
+		if err != nil {
+			t.Fatalf("test %q: unexpected error: %v", test.name, err)
+		}
+		if config.Host != test.wantServer {
+			t.Errorf("test %q: got server %q, want %q", test.name, config.Host, test.wantServer)
+		}
+	}
+}
+
+func TestBuildConfigAppliesQPSAndBurst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node-driver-registrar-kubeconfig")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kubeconfigPath := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(kubeconfigPath, []byte(twoContextKubeconfig), 0644); err != nil {
+		t.Fatalf("failed to write kubeconfig fixture: %v", err)
+	}
+
+	config, err := buildConfig(kubeconfigPath, "", 17, 34, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.QPS != 17 {
+		t.Errorf("got QPS %v, want 17", config.QPS)
+	}
+	if config.Burst != 34 {
+		t.Errorf("got Burst %v, want 34", config.Burst)
+	}
+}
+
+func TestBuildConfigSetsFieldManagerUserAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node-driver-registrar-kubeconfig")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kubeconfigPath := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(kubeconfigPath, []byte(twoContextKubeconfig), 0644); err != nil {
+		t.Fatalf("failed to write kubeconfig fixture: %v", err)
+	}
+
+	config, err := buildConfig(kubeconfigPath, "", 5, 10, "csi-node-driver-registrar")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.UserAgent != "csi-node-driver-registrar" {
+		t.Errorf("got UserAgent %q, want %q", config.UserAgent, "csi-node-driver-registrar")
+	}
+
+	config, err = buildConfig(kubeconfigPath, "", 5, 10, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.UserAgent != "" {
+		t.Errorf("expected an empty --field-manager to leave UserAgent unset, got %q", config.UserAgent)
+	}
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node-driver-registrar-tls")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caPath := filepath.Join(dir, "ca.pem")
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(caPath, selfSignedCertPEM(t), 0644); err != nil {
+		t.Fatalf("failed to write ca fixture: %v", err)
+	}
+	der, key := generateSelfSignedDER(t)
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("failed to write cert fixture: %v", err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0644); err != nil {
+		t.Fatalf("failed to write key fixture: %v", err)
+	}
+	badPath := filepath.Join(dir, "missing.pem")
+
+	tests := []struct {
+		name          string
+		ca, cert, key string
+		wantNil       bool
+		wantErr       bool
+	}{
+		{
+			name:    "none set returns nil config, no error",
+			wantNil: true,
+		},
+		{
+			name: "ca only",
+			ca:   caPath,
+		},
+		{
+			name: "cert and key",
+			cert: certPath,
+			key:  keyPath,
+		},
+		{
+			name:    "cert without key is an error",
+			cert:    certPath,
+			wantErr: true,
+		},
+		{
+			name:    "key without cert is an error",
+			key:     keyPath,
+			wantErr: true,
+		},
+		{
+			name:    "unreadable ca is an error",
+			ca:      badPath,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := buildTLSConfig(test.ca, test.cert, test.key)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("test %q: expected an error, got nil", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %q: unexpected error: %v", test.name, err)
+			continue
+		}
+		if test.wantNil && got != nil {
+			t.Errorf("test %q: expected a nil config, got %+v", test.name, got)
+		}
+		if !test.wantNil && got == nil {
+			t.Errorf("test %q: expected a non-nil config, got nil", test.name)
+		}
+	}
+}
+
+func TestExitCodesAreDistinct(t *testing.T) {
+	codes := map[string]int{
+		"exitGeneralError":              exitGeneralError,
+		"exitCSIConnectionFailure":      exitCSIConnectionFailure,
+		"exitCSIDriverNameFailure":      exitCSIDriverNameFailure,
+		"exitCSINodeIDFailure":          exitCSINodeIDFailure,
+		"exitRegistrationSocketFailure": exitRegistrationSocketFailure,
+		"exitKubeConfigFailure":         exitKubeConfigFailure,
+		"exitRBACCheckFailure":          exitRBACCheckFailure,
+	}
+
+	seen := map[int]string{}
+	for name, code := range codes {
+		if other, ok := seen[code]; ok {
+			t.Errorf("%s and %s both use exit code %d", name, other, code)
+		}
+		seen[code] = name
+	}
+}
+
+func TestValidateDriverName(t *testing.T) {
+	tests := []struct {
+		name        string
+		driverName  string
+		expectError bool
+	}{
+		{
+			name:       "valid",
+			driverName: "csi.example.com",
+		},
+		{
+			name:        "empty",
+			driverName:  "",
+			expectError: true,
+		},
+		{
+			name:        "too long",
+			driverName:  strings.Repeat("a", maxDriverNameLength+1),
+			expectError: true,
+		},
+		{
+			name:        "uppercase",
+			driverName:  "CSI.example.com",
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		err := validateDriverName(test.driverName)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: unexpected error: %v", test.name, err)
+		}
+	}
+}
+
+func TestValidateExpectedDriverName(t *testing.T) {
+	tests := []struct {
+		name               string
+		expectedDriverName string
+		actualDriverName   string
+		expectError        bool
+	}{
+		{
+			name:             "no expectation set",
+			actualDriverName: "csi.example.com",
+		},
+		{
+			name:               "match",
+			expectedDriverName: "csi.example.com",
+			actualDriverName:   "csi.example.com",
+		},
+		{
+			name:               "mismatch",
+			expectedDriverName: "csi.example.com",
+			actualDriverName:   "other.example.com",
+			expectError:        true,
+		},
+	}
+
+	for _, test := range tests {
+		err := validateExpectedDriverName(test.expectedDriverName, test.actualDriverName)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: unexpected error: %v", test.name, err)
+		}
+	}
+}
+
+func TestValidatePluginRegistrationAPIVersion(t *testing.T) {
+	if err := validatePluginRegistrationAPIVersion("v1alpha1"); err != nil {
+		t.Errorf("expected v1alpha1 to be accepted, got: %v", err)
+	}
+
+	for _, apiVersion := range []string{"v1", "auto", ""} {
+		if err := validatePluginRegistrationAPIVersion(apiVersion); err == nil {
+			t.Errorf("expected --plugin-registration-api-version %q to be rejected, since only v1alpha1 is vendored", apiVersion)
+		}
+	}
+}
+
+func TestValidateRegistrationSocketType(t *testing.T) {
+	if err := validateRegistrationSocketType("unix"); err != nil {
+		t.Errorf("expected \"unix\" to be accepted, got: %v", err)
+	}
+
+	err := validateRegistrationSocketType("abstract")
+	if abstractSocketsSupported {
+		if err != nil {
+			t.Errorf("expected \"abstract\" to be accepted on this platform, got: %v", err)
+		}
+	} else if err == nil {
+		t.Error("expected \"abstract\" to be rejected on a platform without abstract-namespace sockets")
+	}
+
+	if err := validateRegistrationSocketType("tcp"); err == nil {
+		t.Error("expected an unrecognized --registration-socket-type to be rejected")
+	}
+}
+
+func TestValidateVolumeLimitsMode(t *testing.T) {
+	if err := validateVolumeLimitsMode("annotation"); err != nil {
+		t.Errorf("expected \"annotation\" to be accepted, got: %v", err)
+	}
+	if err := validateVolumeLimitsMode("status"); err != nil {
+		t.Errorf("expected \"status\" to be accepted, got: %v", err)
+	}
+	if err := validateVolumeLimitsMode("configmap"); err == nil {
+		t.Error("expected an unrecognized --volume-limits-mode to be rejected")
+	}
+}
+
+// TestValidateRegistrationDir covers validateRegistrationDir's three
+// outcomes: a relative path is always rejected, a missing directory is
+// rejected unless create is set (in which case it is created), and an
+// existing directory is accepted either way.
+func TestValidateRegistrationDir(t *testing.T) {
+	if err := validateRegistrationDir("relative/path", false); err == nil {
+		t.Error("expected a relative --registration-dir to be rejected")
+	}
+
+	base := t.TempDir()
+	missing := filepath.Join(base, "missing")
+
+	if err := validateRegistrationDir(missing, false); err == nil {
+		t.Error("expected a missing --registration-dir to be rejected when create is false")
+	}
+	if _, err := os.Stat(missing); err == nil {
+		t.Error("expected validateRegistrationDir not to create the directory when create is false")
+	}
+
+	if err := validateRegistrationDir(missing, true); err != nil {
+		t.Errorf("expected a missing --registration-dir to be created when create is true, got: %v", err)
+	}
+	if info, err := os.Stat(missing); err != nil || !info.IsDir() {
+		t.Errorf("expected %q to have been created as a directory: %v", missing, err)
+	}
+
+	if err := validateRegistrationDir(missing, false); err != nil {
+		t.Errorf("expected an already-existing --registration-dir to be accepted, got: %v", err)
+	}
+
+	notADir := filepath.Join(base, "file")
+	if err := ioutil.WriteFile(notADir, []byte("x"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	if err := validateRegistrationDir(notADir, false); err == nil {
+		t.Error("expected a --registration-dir that is a regular file to be rejected")
+	}
+}
+
+// validRunOptions returns an Options that passes every validation run
+// performs, including a kubeconfig pointing at an address nothing is
+// listening on (so buildConfig succeeds without a real apiserver).
+func validRunOptions(t *testing.T) Options {
+	t.Helper()
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	const contents = `apiVersion: v1
+kind: Config
+clusters:
+- cluster:
+    server: http://127.0.0.1:1
+  name: test
+contexts:
+- context:
+    cluster: test
+    user: test
+  name: test
+current-context: test
+users:
+- name: test
+  user: {}
+`
+	if err := ioutil.WriteFile(kubeconfig, []byte(contents), 0600); err != nil {
+		t.Fatalf("failed to write test kubeconfig: %v", err)
+	}
+
+	return Options{
+		CSIAddresses:                 nil,
+		KubeletRegistrationPaths:     &stringSliceFlag{},
+		DriverEndpoints:              &stringSliceFlag{},
+		NodeIDAnnotationKey:          defaultAnnotationKey,
+		PluginRegistrationAPIVersion: "v1alpha1",
+		RegistrationDir:              t.TempDir(),
+		Kubeconfig:                   kubeconfig,
+		KubeAPIQPS:                   3,
+		KubeAPIBurst:                 4,
+	}
+}
+
+// TestRunValidatesOptionsBeforeSpawningDrivers exercises the synchronous
+// setup/validation run performs before it starts any per-driver goroutine,
+// checking that each failure mode is reported through its documented exit
+// code instead of a call to os.Exit. CSIAddresses is left empty in every
+// case, so a passing test never actually spawns a driver goroutine.
+func TestRunValidatesOptionsBeforeSpawningDrivers(t *testing.T) {
+	tests := []struct {
+		name     string
+		mutate   func(opts *Options)
+		wantExit int
+	}{
+		{
+			name:     "valid options spawn nothing and return success",
+			mutate:   func(opts *Options) {},
+			wantExit: 0,
+		},
+		{
+			name: "invalid nodeid annotation key",
+			mutate: func(opts *Options) {
+				opts.NodeIDAnnotationKey = "not a qualified name!"
+			},
+			wantExit: exitGeneralError,
+		},
+		{
+			name: "unsupported plugin registration api version",
+			mutate: func(opts *Options) {
+				opts.PluginRegistrationAPIVersion = "v1"
+			},
+			wantExit: exitGeneralError,
+		},
+		{
+			name: "TLS cert without key",
+			mutate: func(opts *Options) {
+				opts.CSITLSCert = "/nonexistent/cert.pem"
+			},
+			wantExit: exitGeneralError,
+		},
+		{
+			name: "mismatched registration paths",
+			mutate: func(opts *Options) {
+				opts.CSIAddresses = []string{"/run/csi/socket-a", "/run/csi/socket-b"}
+				opts.KubeletRegistrationPaths = &stringSliceFlag{isSet: true, values: []string{"/var/lib/kubelet/plugins/a/csi.sock"}}
+			},
+			wantExit: exitGeneralError,
+		},
+		{
+			name: "kubeconfig file does not exist",
+			mutate: func(opts *Options) {
+				opts.Kubeconfig = "/nonexistent/kubeconfig"
+			},
+			wantExit: exitKubeConfigFailure,
+		},
+	}
+
+	oldKeepaliveTime, oldKeepaliveTimeout, oldTLSConfig := connection.KeepaliveTime, connection.KeepaliveTimeout, connection.TLSConfig
+	oldRegistrationDir := registrationDir
+	defer func() {
+		connection.KeepaliveTime, connection.KeepaliveTimeout, connection.TLSConfig = oldKeepaliveTime, oldKeepaliveTimeout, oldTLSConfig
+		registrationDir = oldRegistrationDir
+	}()
+
+	for _, test := range tests {
+		opts := validRunOptions(t)
+		test.mutate(&opts)
+		if got := run(context.Background(), opts); got != test.wantExit {
+			t.Errorf("test %q: run() returned exit code %d, want %d", test.name, got, test.wantExit)
+		}
+	}
+}
+
+func TestRegistrationCallLoggingEnabled(t *testing.T) {
+	oldLogRegistrationCalls := *logRegistrationCalls
+	defer func() { *logRegistrationCalls = oldLogRegistrationCalls }()
+
+	*logRegistrationCalls = false
+	if registrationCallLoggingEnabled(2) {
+		t.Errorf("expected V(2) logging to be disabled by default at -v=0")
+	}
+
+	*logRegistrationCalls = true
+	if !registrationCallLoggingEnabled(2) {
+		t.Errorf("expected --log-registration-calls to force V(2) logging on regardless of -v")
+	}
+}
+
+func TestCSISocketWatchdogTick(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "csi.sock")
+	grace := 100 * time.Millisecond
+
+	// Socket present: never missing, regardless of prior state.
+	lis, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen on socket: %v", err)
+	}
+	missingSince, shouldExit := csiSocketWatchdogTick(socketPath, time.Now().Add(-time.Hour), grace)
+	if !missingSince.IsZero() || shouldExit {
+		t.Errorf("expected an existing socket to reset missingSince and not exit, got missingSince=%v shouldExit=%v", missingSince, shouldExit)
+	}
+	lis.Close()
+	os.Remove(socketPath)
+
+	// Socket freshly missing: starts tracking, does not exit yet.
+	missingSince, shouldExit = csiSocketWatchdogTick(socketPath, time.Time{}, grace)
+	if missingSince.IsZero() || shouldExit {
+		t.Errorf("expected a freshly missing socket to start tracking without exiting, got missingSince=%v shouldExit=%v", missingSince, shouldExit)
+	}
+
+	// Socket missing for less than grace: still does not exit.
+	_, shouldExit = csiSocketWatchdogTick(socketPath, time.Now().Add(-grace/2), grace)
+	if shouldExit {
+		t.Error("expected a socket missing for less than grace to not exit")
+	}
+
+	// Socket missing for at least grace: exits.
+	_, shouldExit = csiSocketWatchdogTick(socketPath, time.Now().Add(-2*grace), grace)
+	if !shouldExit {
+		t.Error("expected a socket missing for at least grace to exit")
+	}
+
+	// A regular file (not a socket) at the path counts as missing too.
+	if err := ioutil.WriteFile(socketPath, []byte("not a socket"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	missingSince, _ = csiSocketWatchdogTick(socketPath, time.Time{}, grace)
+	if missingSince.IsZero() {
+		t.Error("expected a non-socket file at the path to be treated as missing")
+	}
+}
+
+func TestNodeDeletedTick(t *testing.T) {
+	grace := 100 * time.Millisecond
+
+	missingSince, shouldExit := nodeDeletedTick(false, time.Now().Add(-time.Hour), grace)
+	if !missingSince.IsZero() || shouldExit {
+		t.Errorf("expected a present node to reset missingSince and not exit, got missingSince=%v shouldExit=%v", missingSince, shouldExit)
+	}
+
+	missingSince, shouldExit = nodeDeletedTick(true, time.Time{}, grace)
+	if missingSince.IsZero() || shouldExit {
+		t.Errorf("expected a freshly missing node to start tracking without exiting, got missingSince=%v shouldExit=%v", missingSince, shouldExit)
+	}
+
+	_, shouldExit = nodeDeletedTick(true, time.Now().Add(-grace/2), grace)
+	if shouldExit {
+		t.Error("expected a node missing for less than grace to not exit")
+	}
+
+	_, shouldExit = nodeDeletedTick(true, time.Now().Add(-2*grace), grace)
+	if !shouldExit {
+		t.Error("expected a node missing for at least grace to exit")
+	}
+}
+
+// TestStartStartupWatchdogDisabled covers timeout <= 0: markDone must be a
+// safely callable no-op, and must not exit the process (there would be
+// nothing to catch an os.Exit in a test, so this only verifies the disabled
+// case cannot call it at all).
+func TestStartStartupWatchdogDisabled(t *testing.T) {
+	markDone := startStartupWatchdog(context.Background(), "/run/csi/socket", 0)
+	markDone()
+	markDone()
+}
+
+// TestStartStartupWatchdogMarkedDoneBeforeTimeout covers the non-exit path:
+// calling markDone before --startup-timeout elapses must not trigger
+// os.Exit. The actual exit-on-timeout path is not exercised here, matching
+// this project's existing convention for watchdogs that call os.Exit (e.g.
+// startCSISocketWatchdog has no direct test of its os.Exit call either).
+func TestStartStartupWatchdogMarkedDoneBeforeTimeout(t *testing.T) {
+	markDone := startStartupWatchdog(context.Background(), "/run/csi/socket", time.Hour)
+	markDone()
+	// Give the watchdog goroutine a chance to observe the cancellation and
+	// confirm it takes the non-exit path; if it (incorrectly) treated this as
+	// a timeout, os.Exit would have already terminated the test binary.
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestEndpointWatchdogTick(t *testing.T) {
+	dir := t.TempDir()
+	endpoint := filepath.Join(dir, "csi.sock")
+	grace := 100 * time.Millisecond
+
+	// Endpoint present: never missing, regardless of prior state.
+	lis, err := net.Listen("unix", endpoint)
+	if err != nil {
+		t.Fatalf("failed to listen on socket: %v", err)
+	}
+	missingSince, shouldFlag := endpointWatchdogTick(endpoint, time.Now().Add(-time.Hour), grace)
+	if !missingSince.IsZero() || shouldFlag {
+		t.Errorf("expected an existing endpoint to reset missingSince and not flag, got missingSince=%v shouldFlag=%v", missingSince, shouldFlag)
+	}
+	lis.Close()
+	os.Remove(endpoint)
+
+	// Endpoint freshly missing: starts tracking, does not flag yet.
+	missingSince, shouldFlag = endpointWatchdogTick(endpoint, time.Time{}, grace)
+	if missingSince.IsZero() || shouldFlag {
+		t.Errorf("expected a freshly missing endpoint to start tracking without flagging, got missingSince=%v shouldFlag=%v", missingSince, shouldFlag)
+	}
+
+	// Endpoint missing for less than grace: still does not flag.
+	_, shouldFlag = endpointWatchdogTick(endpoint, time.Now().Add(-grace/2), grace)
+	if shouldFlag {
+		t.Error("expected an endpoint missing for less than grace to not flag")
+	}
+
+	// Endpoint missing for at least grace: flags.
+	_, shouldFlag = endpointWatchdogTick(endpoint, time.Now().Add(-2*grace), grace)
+	if !shouldFlag {
+		t.Error("expected an endpoint missing for at least grace to flag")
+	}
+
+	// A regular file (not a socket) at the path counts as missing too.
+	if err := ioutil.WriteFile(endpoint, []byte("not a socket"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	missingSince, _ = endpointWatchdogTick(endpoint, time.Time{}, grace)
+	if missingSince.IsZero() {
+		t.Error("expected a non-socket file at the path to be treated as missing")
+	}
+}
+
+func TestBuildEffectiveConfig(t *testing.T) {
+	oldSocketType := *registrationSocketType
+	defer func() { *registrationSocketType = oldSocketType }()
+
+	opts := Options{
+		CSIAddresses:                 []string{"/run/csi/socket-a", "/run/csi/socket-b"},
+		KubeletRegistrationPaths:     &stringSliceFlag{isSet: true, values: []string{"/var/lib/kubelet/plugins/a/csi.sock", ""}},
+		DriverEndpoints:              &stringSliceFlag{},
+		NodeIDAnnotationKey:          defaultAnnotationKey,
+		PluginRegistrationAPIVersion: "v1alpha1",
+		RegistrationDir:              "/registration",
+		CSITLSCert:                   "/etc/csi-tls/tls.crt",
+		CSITLSKey:                    "/etc/csi-tls/tls.key",
+	}
+
+	cfg, err := buildEffectiveConfig(opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(cfg.Drivers) != 2 {
+		t.Fatalf("got %d drivers, want 2", len(cfg.Drivers))
+	}
+	if got, want := cfg.Drivers[0].RegistrationSocketPathPattern, "/registration/{driver-name}-reg.sock"; got != want {
+		t.Errorf("driver 0: got registration socket pattern %q, want %q", got, want)
+	}
+	if cfg.Drivers[0].AnnotationOnly {
+		t.Error("driver 0: expected AnnotationOnly to be false, it has a registration path")
+	}
+	if !cfg.Drivers[1].AnnotationOnly {
+		t.Error("driver 1: expected AnnotationOnly to be true, it has no registration path")
+	}
+	if cfg.Drivers[1].RegistrationSocketPathPattern != "" {
+		t.Errorf("driver 1: expected no registration socket pattern in annotation-only mode, got %q", cfg.Drivers[1].RegistrationSocketPathPattern)
+	}
+
+	// TLS material is surfaced as the configured paths, never read.
+	if got, want := cfg.CSI.TLSCertFile, "/etc/csi-tls/tls.crt"; got != want {
+		t.Errorf("got TLSCertFile %q, want %q", got, want)
+	}
+	if got, want := cfg.CSI.TLSKeyFile, "/etc/csi-tls/tls.key"; got != want {
+		t.Errorf("got TLSKeyFile %q, want %q", got, want)
+	}
+}
+
+func TestBuildEffectiveConfigReportsPairingErrors(t *testing.T) {
+	opts := Options{
+		CSIAddresses:             []string{"/run/csi/socket-a", "/run/csi/socket-b"},
+		KubeletRegistrationPaths: &stringSliceFlag{isSet: true, values: []string{"/var/lib/kubelet/plugins/a/csi.sock"}},
+	}
+	if _, err := buildEffectiveConfig(opts); err == nil {
+		t.Error("expected an error for a --kubelet-registration-path count mismatch, got none")
+	}
+}
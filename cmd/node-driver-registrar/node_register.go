@@ -18,19 +18,43 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
 
 	"github.com/golang/glog"
 	"golang.org/x/sys/unix"
+	"golang.org/x/time/rate"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	authorizationv1client "k8s.io/client-go/kubernetes/typed/authorization/v1"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/util/retry"
@@ -39,130 +63,1895 @@ import (
 	"github.com/kubernetes-csi/node-driver-registrar/pkg/connection"
 )
 
+// shutdownSignals are the OS signals nodeRegister traps to drive
+// deregistration and the registration server's graceful drain before this
+// process exits. Kubernetes sends SIGTERM, not SIGINT, to stop a container;
+// os.Interrupt is kept alongside it for a developer running this binary
+// directly from an interactive shell.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
 func nodeRegister(
 	config *rest.Config,
 	csiConn connection.CSIConnection,
 	csiDriverName string,
+	vendorVersion string,
+	csiAddress string,
+	kubeletRegistrationPath string,
+	driverEndpoint string,
+	markStartupDone func(),
+) {
+	k8sNodeName, err := getNodeName()
+	if err != nil {
+		glog.Error(err.Error())
+		os.Exit(exitGeneralError)
+	}
+
+	// Get CSI Driver Node ID
+	glog.V(1).Infof("Calling CSI driver to discover node ID.")
+	nodeIdSpan := startSpan("discover-node-id")
+	ctx, cancel := context.WithTimeout(context.Background(), *csiCallTimeout)
+	defer cancel()
+	csiDriverNodeId, maxVolumesPerNode, topologySegments, err := getNodeInfo(ctx, csiConn)
+	nodeIdSpan.End(csiDriverName, k8sNodeName, err)
+	if err != nil {
+		glog.Error(err.Error())
+		os.Exit(exitCSINodeIDFailure)
+	}
+	if validateDiscoveredNodeID(csiDriverName, csiDriverNodeId, *allowEmptyNodeID) {
+		os.Exit(exitCSINodeIDFailure)
+	}
+	glog.V(2).Infof("CSI driver node ID: %q", csiDriverNodeId)
+
+	updateDriverStatus(csiAddress, func(s *driverStatus) {
+		s.DriverName = csiDriverName
+		s.NodeID = csiDriverNodeId
+		s.SupportedVersions = supportedVersions.values
+		s.RegistrationSocketPath = kubeletRegistrationPath
+	})
+
+	logStartupSummary(k8sNodeName, csiDriverName, csiDriverNodeId, supportedVersions.values, kubeletRegistrationPath, driverEndpoint)
+
+	// annotationCtx is cancelled on SIGINT/SIGTERM, stopping the annotation
+	// resync loop below (if running) so deregistration can run before the
+	// process exits. It is shared by both the registration server and the
+	// annotation loop so a signal tears down whichever of them are active,
+	// including draining runRegistrationServer's in-flight calls within
+	// --shutdown-grace-period via gracefulStopWithDeadline. SIGTERM must be
+	// included alongside SIGINT: it is the signal kubelet actually sends to
+	// stop a container, and this binary runs as PID 1 with no shell to
+	// translate one into the other, so SIGINT alone would leave this path
+	// dead code in every real DaemonSet pod termination.
+	annotationCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, shutdownSignals...)
+	go func() {
+		<-c
+		csiConn.Close()
+		cancel()
+	}()
+
+	// SIGHUP is kept on its own channel and handled by handleResyncSignal,
+	// separately from the SIGINT handling above: it must never cancel
+	// annotationCtx or close csiConn, only nudge the annotation loop (via
+	// resync) into re-checking the node-id annotation immediately, for an
+	// operator who wants to confirm a manual annotation edit is corrected
+	// without waiting for the next resync or restarting the pod.
+	resync := make(chan struct{}, 1)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go handleResyncSignal(hup, csiDriverName, resync)
+
+	var wg sync.WaitGroup
+
+	// When kubeletRegistrationPath is specified, the driver-registrar acts
+	// as a gRPC server which replies to registration requests initiated by
+	// kubelet's pluginswatcher infrastructure.
+	if kubeletRegistrationPath != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runRegistrationServer(annotationCtx, config, csiDriverName, csiAddress, k8sNodeName, kubeletRegistrationPath, driverEndpoint, markStartupDone)
+		}()
+	}
+
+	// The legacy node-id annotation loop runs whenever
+	// --enable-nodeid-annotation says so; by default that mirrors the old
+	// behavior of only running it when the registration socket is not in
+	// use, but operators relying on the plugin watcher for registration can
+	// opt back into it with --enable-nodeid-annotation=true.
+	if enableNodeIdAnnotationEffective(kubeletRegistrationPath) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runAnnotationLoopWithLeaderElection(annotationCtx, config, k8sNodeName, csiConn, csiDriverName, vendorVersion, csiAddress, csiDriverNodeId, maxVolumesPerNode, topologySegments, kubeletRegistrationPath != "", resync, markStartupDone)
+		}()
+	}
+
+	if kubeletRegistrationPath == "" && !enableNodeIdAnnotationEffective(kubeletRegistrationPath) {
+		glog.Error("Neither --kubelet-registration-path nor --enable-nodeid-annotation is set; there is nothing for this driver-registrar to do.")
+		os.Exit(exitGeneralError)
+	}
+
+	wg.Wait()
+}
+
+// getNodeName returns the node this process is running on, preferring the
+// KUBE_NODE_NAME environment variable and falling back to --node-name-file
+// (e.g. a downward-API volume file) only when that variable is unset.
+func getNodeName() (string, error) {
+	if name := os.Getenv("KUBE_NODE_NAME"); name != "" {
+		return name, nil
+	}
+	if *nodeNameFile == "" {
+		return "", fmt.Errorf("node name not found: the environment variable KUBE_NODE_NAME is empty and --node-name-file is not set")
+	}
+	data, err := ioutil.ReadFile(*nodeNameFile)
+	if err != nil {
+		return "", fmt.Errorf("node name not found: KUBE_NODE_NAME is empty and --node-name-file %q could not be read: %v", *nodeNameFile, err)
+	}
+	name := strings.TrimSpace(string(data))
+	if name == "" {
+		return "", fmt.Errorf("node name not found: KUBE_NODE_NAME is empty and --node-name-file %q is empty", *nodeNameFile)
+	}
+	return name, nil
+}
+
+// handleResyncSignal reacts to each signal delivered on c (expected to be
+// notified only for syscall.SIGHUP) by dropping csiDriverName's entries
+// (under every annotation key it writes, see
+// --additional-nodeid-annotation-key) from nodeIdAnnotationCache and
+// sending on resync, so runAnnotationLoop's next iteration runs immediately
+// and pays for a real Get instead of trusting a cached value that may now
+// be stale. It returns when c is closed.
+//
+// This is split out from nodeRegister specifically so it can be driven by a
+// test with a channel the test controls directly, rather than needing to
+// deliver a real OS signal to exercise the logic.
+func handleResyncSignal(c <-chan os.Signal, csiDriverName string, resync chan<- struct{}) {
+	for range c {
+		glog.Infof("Received SIGHUP, forcing an immediate node-id annotation resync for driver %q", csiDriverName)
+		invalidateNodeIdAnnotationCache(csiDriverName)
+		select {
+		case resync <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// enableNodeIdAnnotationEffective resolves --enable-nodeid-annotation for a
+// driver whose registration path is kubeletRegistrationPath, defaulting to
+// running the annotation loop only when that driver has no registration
+// socket, to match this program's behavior before the two could run side by
+// side.
+func enableNodeIdAnnotationEffective(kubeletRegistrationPath string) bool {
+	if enableNodeIdAnnotation.isSet {
+		return enableNodeIdAnnotation.value
+	}
+	return kubeletRegistrationPath == ""
+}
+
+// startupSummaryModes returns the operating mode(s) this driver runs in for
+// a given kubeletRegistrationPath: "registration", "annotation", or both, in
+// that order. Split out from logStartupSummary so the mode logic (which
+// mirrors the conditions nodeRegister itself branches on) can be unit
+// tested independently of glog output.
+func startupSummaryModes(kubeletRegistrationPath string) []string {
+	var modes []string
+	if kubeletRegistrationPath != "" {
+		modes = append(modes, "registration")
+	}
+	if enableNodeIdAnnotationEffective(kubeletRegistrationPath) {
+		modes = append(modes, "annotation")
+	}
+	return modes
+}
+
+// logStartupSummary emits a single Info-level line summarizing this driver's
+// discovered identity and configured mode, once CSI driver name and node ID
+// have both been discovered. It is meant to be the one line an operator
+// pastes into a bug report, instead of having to correlate the individual
+// V(1)/V(2) discovery lines logged above it.
+func logStartupSummary(k8sNodeName, csiDriverName, csiDriverNodeId string, versions []string, kubeletRegistrationPath, driverEndpoint string) {
+	modes := startupSummaryModes(kubeletRegistrationPath)
+	registrationSocketPath := ""
+	if kubeletRegistrationPath != "" {
+		registrationSocketPath = fmt.Sprintf("%s/%s-reg.sock", registrationDir, csiDriverName)
+	}
+
+	glog.Infof("Startup summary: node=%q driver=%q nodeID=%q versions=%v mode=%v registrationSocket=%q driverEndpoint=%q",
+		k8sNodeName, csiDriverName, csiDriverNodeId, versions, modes, registrationSocketPath, driverEndpoint)
+}
+
+// registrationDir is the directory kubelet's plugin watcher scans for
+// "<driver>-reg.sock" registration sockets. It is a var, rather than a
+// hardcoded constant, only so integration tests can point it at a temp
+// directory instead of the real /registration hostPath mount.
+var registrationDir = "/registration"
+
+// unixSocketPathMaxLen is the length of sockaddr_un's sun_path field on
+// Linux, including the NUL terminator the kernel appends. validateDriverName
+// already bounds the driver name component on its own, but a long enough
+// --registration-dir can still push the assembled "<dir>/<driver>-reg.sock"
+// path at or past this limit, which otherwise surfaces as an opaque
+// "bind: invalid argument" far from here.
+const unixSocketPathMaxLen = 108
+
+// nodeUpdateBackoff builds the wait.Backoff used by retry.RetryOnConflict in
+// getVerifyAndAddNodeId and getVerifyAndDeleteNodeId, from
+// --node-update-retry-steps, --node-update-retry-base-delay, and
+// --node-update-retry-factor. It defaults to retry.DefaultRetry's own
+// values, but large clusters with heavier Node update contention may need
+// more attempts or a gentler backoff than that fixed default allows.
+func nodeUpdateBackoff() wait.Backoff {
+	return wait.Backoff{
+		Steps:    *nodeUpdateRetrySteps,
+		Duration: *nodeUpdateRetryBaseDelay,
+		Factor:   *nodeUpdateRetryFactor,
+		Jitter:   retry.DefaultRetry.Jitter,
+	}
+}
+
+// validateSocketPathLength returns an error naming unixSocketPathMaxLen if
+// path is too long to bind or dial as a unix socket address, so callers can
+// fail with a clear message instead of the kernel's own opaque one.
+func validateSocketPathLength(path string) error {
+	if len(path) >= unixSocketPathMaxLen {
+		return fmt.Errorf("registration socket path %q is %d bytes long, at or beyond the %d byte unix socket path limit (sun_path, including its NUL terminator); shorten --registration-dir or the CSI driver's name", path, len(path), unixSocketPathMaxLen)
+	}
+	return nil
+}
+
+// runRegistrationServer serves the kubelet plugin watcher registration
+// socket until ctx is cancelled (e.g. by SIGINT/SIGTERM, see
+// shutdownSignals) or serving fails, then exits the process (there is
+// nothing useful left for this goroutine to do,
+// and if it is the only one running, the process should not sit idle). On
+// cancellation, in-flight calls are given up to --shutdown-grace-period to
+// complete via gracefulStopWithDeadline before the server is forced down.
+// markStartupDone is forwarded to the registrationServer it creates, which
+// calls it on the first successful NotifyRegistrationStatus (see
+// --startup-timeout).
+func runRegistrationServer(ctx context.Context, config *rest.Config, csiDriverName, csiAddress, k8sNodeName, kubeletRegistrationPath, driverEndpoint string, markStartupDone func()) {
+	checkEndpointExists(driverEndpoint)
+	if *endpointWatchdog {
+		go startEndpointWatchdog(driverEndpoint, *endpointMissingGrace, *exitOnEndpointMissing)
+	}
+
+	registrar := newRegistrationServer(csiDriverName, driverEndpoint, supportedVersions.values, k8sNodeName, buildEventRecorder(config, k8sNodeName, csiDriverName), markStartupDone)
+	if *registrationWatchdog {
+		go registrar.startRegistrationWatchdog(*registrationWatchdogTimeout, *registrationWatchdogExit)
+	}
+	socketPath := fmt.Sprintf("%s/%s-reg.sock", registrationDir, csiDriverName)
+	if err := validateSocketPathLength(socketPath); err != nil {
+		glog.Errorf("%v", err)
+		os.Exit(exitRegistrationSocketFailure)
+	}
+	if *registrationSocketType == registrationSocketTypeUnix {
+		// An abstract socket has no filesystem entry, so there is nothing
+		// here to stat, and nothing stale to remove: a name collision with
+		// another live registrar simply surfaces as a net.Listen error below.
+		if err := prepareRegistrationSocketPath(socketPath, csiDriverName, *forceSocketCleanup); err != nil {
+			glog.Errorf("%v", err)
+			os.Exit(exitRegistrationSocketFailure)
+		}
+	}
+	glog.Infof("Starting Registration Server at: %s\n", socketPath)
+	lis, err := createRegistrationSocket(socketPath, *registrationSocketType)
+	if err != nil {
+		glog.Errorf("%v", err)
+		os.Exit(exitRegistrationSocketFailure)
+	}
+	registrar.recordSocketReady(csiAddress)
+	if *registrationSocketType == registrationSocketTypeUnix {
+		if err := applyRegistrationSocketOwnership(socketPath); err != nil {
+			glog.Errorf("%v", err)
+			os.Exit(exitRegistrationSocketFailure)
+		}
+	} else if *registrationSocketMode != "" || *registrationSocketGroup != "" {
+		glog.Warningf("--registration-socket-mode/--registration-socket-group have no effect with --registration-socket-type=abstract, since abstract sockets have no filesystem entry to chmod/chown")
+	}
+	glog.Infof("Registration Server started at: %s\n", socketPath)
+	grpcServer := grpc.NewServer(
+		grpc.MaxRecvMsgSize(*grpcMaxRecvMsgSize),
+		grpc.MaxSendMsgSize(*grpcMaxSendMsgSize),
+		grpc.MaxConcurrentStreams(uint32(*registrationMaxConcurrent)),
+		grpc.UnaryInterceptor(chainUnaryInterceptors(
+			registrationLoggingInterceptor(registrationMetrics),
+			registrationRateLimitInterceptor(rate.NewLimiter(rate.Limit(*registrationMaxConcurrent), *registrationMaxConcurrent)),
+		)),
+	)
+	// Registers kubelet plugin watcher api.
+	registerapi.RegisterRegistrationServer(grpcServer, registrar)
+
+	// Starts service
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- grpcServer.Serve(lis)
+	}()
+
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			glog.Errorf("Registration Server stopped serving: %v", err)
+			os.Exit(exitRegistrationSocketFailure)
+		}
+	case <-ctx.Done():
+		glog.Infof("Shutting down Registration Server, draining in-flight calls for up to %s", *shutdownGracePeriod)
+		gracefulStopWithDeadline(grpcServer, *shutdownGracePeriod)
+		<-serveErr
+	}
+	// If gRPC server is gracefully shutdown, exit
+	os.Exit(0)
+}
+
+// chainUnaryInterceptors composes interceptors into a single
+// grpc.UnaryServerInterceptor that runs them in order, each wrapping the
+// next, with the final one wrapping handler itself. The vendored grpc-go
+// here predates grpc.ChainUnaryInterceptor, and grpc.NewServer only accepts
+// one grpc.UnaryInterceptor, so callers needing more than one interceptor
+// (e.g. runRegistrationServer's logging and rate-limiting interceptors) must
+// compose them explicitly.
+func chainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor := interceptors[i]
+			next := chained
+			chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return chained(ctx, req)
+	}
+}
+
+// registrationMethodMetrics is a lightweight in-process counter of
+// registration RPCs by method and result code, keyed as "<method>:<code>".
+// This repository does not vendor a metrics exporter (e.g. Prometheus), so
+// this just tracks counts in memory; registrationLoggingInterceptor feeds it
+// alongside its log line, and tests can read it back via snapshot to assert
+// an RPC was recorded without scraping logs.
+type registrationMethodMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newRegistrationMethodMetrics() *registrationMethodMetrics {
+	return &registrationMethodMetrics{counts: map[string]int64{}}
+}
+
+func (m *registrationMethodMetrics) record(method string, code codes.Code) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[fmt.Sprintf("%s:%s", method, code)]++
+}
+
+// snapshot returns the count recorded for method having finished with code.
+func (m *registrationMethodMetrics) snapshot(method string, code codes.Code) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[fmt.Sprintf("%s:%s", method, code)]
+}
+
+// registrationMetrics is the process-wide registrationMethodMetrics fed by
+// registrationLoggingInterceptor in runRegistrationServer.
+var registrationMetrics = newRegistrationMethodMetrics()
+
+// registrationLoggingInterceptor returns a unary server interceptor that
+// logs the method, duration, and resulting status code of every
+// registration RPC and records the same in metrics, so handlers themselves
+// don't each need their own logging boilerplate.
+func registrationLoggingInterceptor(metrics *registrationMethodMetrics) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		duration := time.Since(start)
+		code := status.Code(err)
+		metrics.record(info.FullMethod, code)
+		glog.Infof("Registration server handled %s in %s with code %s", info.FullMethod, duration, code)
+		return resp, err
+	}
+}
+
+// registrationRateLimitInterceptor returns a unary server interceptor that
+// rejects calls over limiter's rate (and burst) with codes.ResourceExhausted,
+// rather than letting kubelet (or a buggy/malicious local client) drive
+// unbounded concurrency or call rate against the registration socket.
+// Implemented as an interceptor, rather than inline in runRegistrationServer,
+// so it can be exercised directly against a fake kubelet client in tests.
+func registrationRateLimitInterceptor(limiter *rate.Limiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !limiter.Allow() {
+			return nil, status.Errorf(codes.ResourceExhausted, "registration server is over its --registration-max-concurrent rate limit, rejecting %s", info.FullMethod)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// registrationSocketOwnerOnlyMode is the permission net.Listen leaves a unix
+// socket file at under a 0077 umask (sockets are otherwise created 0777),
+// i.e. read/write/execute for the owner only. createRegistrationSocket
+// applies this explicitly via os.Chmod when --manage-socket-umask is false,
+// so the resulting socket's permissions are the same either way.
+const registrationSocketOwnerOnlyMode = 0700
+
+// createRegistrationSocket listens on socketPath, as an abstract-namespace
+// socket (see abstractSocketAddress) if socketType is
+// registrationSocketTypeAbstract, and otherwise ensures the resulting socket
+// file ends up owner-only (registrationSocketOwnerOnlyMode). By default
+// (--manage-socket-umask) that is done by swapping the process umask to
+// 0077 around net.Listen and restoring it afterwards; since that swap
+// applies process-wide, it is not safe if another goroutine creates files
+// concurrently, and it can conflict with permissions some host setups
+// manage externally. Setting --manage-socket-umask=false instead leaves the
+// umask untouched and applies the same mode via an explicit os.Chmod once
+// the socket file exists. Neither applies to an abstract socket, which has
+// no filesystem entry to chmod in the first place.
+func createRegistrationSocket(socketPath, socketType string) (net.Listener, error) {
+	listenAddress := socketPath
+	if socketType == registrationSocketTypeAbstract {
+		listenAddress = abstractSocketAddress(socketPath)
+	}
+
+	var oldmask int
+	manageUmask := *manageSocketUmask && socketType != registrationSocketTypeAbstract
+	if manageUmask {
+		oldmask = unix.Umask(0077)
+		defer unix.Umask(oldmask)
+	}
+
+	lis, err := net.Listen("unix", listenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on socket: %s with error: %+v", listenAddress, err)
+	}
+
+	if socketType != registrationSocketTypeAbstract && !manageUmask {
+		if err := os.Chmod(socketPath, registrationSocketOwnerOnlyMode); err != nil {
+			lis.Close()
+			return nil, fmt.Errorf("failed to chmod socket %s to %o with error: %+v", socketPath, registrationSocketOwnerOnlyMode, err)
+		}
+	}
+	return lis, nil
+}
+
+// gracefulStopWithDeadline calls grpcServer.GracefulStop() to drain in-flight
+// calls, falling back to the hard grpcServer.Stop() (cutting off whatever is
+// still running) if draining has not finished within gracePeriod.
+func gracefulStopWithDeadline(grpcServer *grpc.Server, gracePeriod time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(gracePeriod):
+		glog.Warningf("Registration server did not drain in-flight calls within %s; forcing shutdown", gracePeriod)
+		grpcServer.Stop()
+		<-stopped
+	}
+}
+
+// socketLiveDialTimeout bounds how long isSocketLive waits for a connection
+// attempt against an existing registration socket file, so detecting a dead
+// socket does not stall startup.
+const socketLiveDialTimeout = 1 * time.Second
+
+// isSocketLive reports whether a unix domain socket at path is actively
+// being served, by attempting to dial it. A successful connection means
+// another process (most likely a second registrar for the same driver
+// stuck on the same node during a botched rollout) is still listening on
+// it; any dial error (connection refused, no such file) means the socket
+// is stale and safe to remove.
+func isSocketLive(path string) bool {
+	conn, err := net.DialTimeout("unix", path, socketLiveDialTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// prepareRegistrationSocketPath stats socketPath and clears the way for
+// net.Listen to create a fresh socket there: a stale socket (one nothing
+// answers to, per isSocketLive) is always removed, a live one is a fatal
+// error (most likely another registrar for csiDriverName still running on
+// this node), and a non-socket file (e.g. a leftover regular file from a
+// botched host setup) is only removed when forceCleanup is set, since
+// net.Listen's own "address already in use" error for that case gives no
+// hint that anything needs manual cleanup at all.
+func prepareRegistrationSocketPath(socketPath, csiDriverName string, forceCleanup bool) error {
+	fi, err := os.Stat(socketPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to stat the socket %s with error: %+v", socketPath, err)
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		if !forceCleanup {
+			return fmt.Errorf("%s already exists and is not a socket (mode %s); refusing to remove it automatically. Remove it yourself, or pass --force-socket-cleanup to have the driver-registrar remove it on startup", socketPath, fi.Mode())
+		}
+		glog.Warningf("%s already exists and is not a socket (mode %s); removing it because --force-socket-cleanup is set", socketPath, fi.Mode())
+		if err := os.Remove(socketPath); err != nil {
+			return fmt.Errorf("failed to remove %s with error: %+v", socketPath, err)
+		}
+		return nil
+	}
+
+	if isSocketLive(socketPath) {
+		return fmt.Errorf("registration socket %s is already being served, likely by another registrar for driver %q on this node; refusing to remove it", socketPath, csiDriverName)
+	}
+	// The socket exists but nothing answers it: stale, safe to remove.
+	if err := os.Remove(socketPath); err != nil {
+		return fmt.Errorf("failed to remove stale socket %s with error: %+v", socketPath, err)
+	}
+	return nil
+}
+
+// applyRegistrationSocketOwnership applies --registration-socket-mode and
+// --registration-socket-group to the registration socket after it is
+// created, so a kubelet/plugin watcher running under a different uid/gid
+// than this sidecar can still connect to it. Leaving both flags unset keeps
+// the owner-only default applied above, either via umask or an explicit
+// chmod depending on --manage-socket-umask.
+func applyRegistrationSocketOwnership(socketPath string) error {
+	if *registrationSocketMode != "" {
+		mode, err := strconv.ParseUint(*registrationSocketMode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid --registration-socket-mode %q: %v", *registrationSocketMode, err)
+		}
+		if err := os.Chmod(socketPath, os.FileMode(mode)); err != nil {
+			return fmt.Errorf("failed to chmod registration socket %q to %o: %v", socketPath, mode, err)
+		}
+	}
+
+	if *registrationSocketGroup != "" {
+		gid, err := resolveGroupID(*registrationSocketGroup)
+		if err != nil {
+			return fmt.Errorf("invalid --registration-socket-group %q: %v", *registrationSocketGroup, err)
+		}
+		if err := os.Chown(socketPath, -1, gid); err != nil {
+			return fmt.Errorf("failed to chown registration socket %q to group %q: %v", socketPath, *registrationSocketGroup, err)
+		}
+	}
+
+	return nil
+}
+
+// resolveGroupID resolves group, which may either be a group name or a
+// numeric GID, to a GID.
+func resolveGroupID(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// refreshIdentity re-discovers csiConn's driver name and node ID, for
+// runAnnotationLoop's opt-in --refresh-identity-period polling, via
+// connection.DiscoverIdentity (--csi-getdrivername-timeout and
+// --csi-nodegetid-timeout bound its two calls respectively). The CSI
+// driver's own name is assumed immutable; a change is logged as a warning,
+// since it is almost always a misconfiguration, and is not otherwise acted
+// on. The node ID is returned so the caller can update its cached value and
+// the node-id annotation if it changed.
+func refreshIdentity(ctx context.Context, csiConn connection.CSIConnection, csiDriverName, csiDriverNodeId, csiAddress string) (string, error) {
+	identity, err := connection.DiscoverIdentity(ctx, csiConn, *csiGetDriverNameTimeout, *csiNodeGetIdTimeout)
+	if err != nil {
+		return csiDriverNodeId, fmt.Errorf("failed to refresh CSI driver identity: %v", err)
+	}
+	if identity.DriverName != csiDriverName {
+		glog.Warningf("CSI driver at %q now reports name %q, but was registered as %q; this is almost always a misconfiguration and is not applied", csiAddress, identity.DriverName, csiDriverName)
+	}
+	if identity.NodeID != csiDriverNodeId {
+		glog.Infof("CSI driver %q node ID changed from %q to %q", csiDriverName, csiDriverNodeId, identity.NodeID)
+	}
+	return identity.NodeID, nil
+}
+
+// nodeRBACVerbs are the verbs checkNodeRBAC requires on the nodes resource:
+// "get" to read the current annotations before patching, and "patch" for
+// the strategic merge patch patchNodeAnnotation sends.
+var nodeRBACVerbs = []string{"get", "patch"}
+
+// checkNodeRBAC issues a SelfSubjectAccessReview for each of nodeRBACVerbs
+// against the cluster-scoped nodes resource, so a ServiceAccount missing the
+// permissions the annotation loop needs is reported clearly at startup
+// instead of surfacing as an opaque Forbidden error on the first Patch call,
+// up to two minutes into the first loop iteration. A SelfSubjectAccessReview
+// call failing outright (e.g. the API server itself rejects it) is reported
+// the same way as a missing permission, since either way the loop cannot be
+// trusted to work. It takes only the narrow SelfSubjectAccessReviewInterface
+// it actually calls, rather than the full kubernetes.Interface, so tests can
+// supply a minimal fake instead of a generated clientset.
+func checkNodeRBAC(reviews authorizationv1client.SelfSubjectAccessReviewInterface) error {
+	var missing []string
+	for _, verb := range nodeRBACVerbs {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Verb:     verb,
+					Resource: "nodes",
+				},
+			},
+		}
+		result, err := reviews.Create(review)
+		if err != nil {
+			return fmt.Errorf("failed to check RBAC permissions for verb %q on the nodes resource: %v", verb, err)
+		}
+		if !result.Status.Allowed {
+			missing = append(missing, verb)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("ServiceAccount is missing RBAC permission(s) %v on the nodes resource; the node-id annotation cannot be maintained until a ClusterRole grants them (see deploy/kubernetes/rbac.yaml)", missing)
+	}
+	return nil
+}
+
+// leaderElectionLockName derives the name of the lock --enable-leader-election
+// instances of this driver contend for on a given node, so that two
+// registrar pods running the same CSI driver on the same node (e.g. during a
+// DaemonSet surge upgrade) race for one lock instead of both unconditionally
+// running the annotation loop and relying solely on RetryOnConflict.
+func leaderElectionLockName(k8sNodeName, csiDriverName string) string {
+	return fmt.Sprintf("node-driver-registrar-%s-%s", k8sNodeName, csiDriverName)
+}
+
+// leaderElectionLeaseDuration is how long a held lock remains valid without
+// renewal before another instance may claim it; leaderElectionRetryPeriod is
+// how often a holder renews it and a non-holder retries acquiring it. Both
+// are fixed, matching this program's other fixed-interval watchdog timings
+// (e.g. csiSocketWatchdogCheckInterval), rather than exposed as flags on top
+// of --enable-leader-election.
+const (
+	leaderElectionLeaseDuration = 15 * time.Second
+	leaderElectionRetryPeriod   = 2 * time.Second
+)
+
+// leaderElectionRecordAnnotationKey holds a JSON-encoded leaderElectionRecord
+// on the lock ConfigMap.
+const leaderElectionRecordAnnotationKey = "node-driver-registrar.csi.k8s.io/leader"
+
+// leaderElectionRecord is this file's hand-rolled equivalent of
+// k8s.io/client-go/tools/leaderelection/resourcelock.LeaderElectionRecord.
+// The real client-go leaderelection package is not usable here: its
+// resourcelock package unconditionally imports tools/record, which in turn
+// requires github.com/golang/groupcache/lru - a transitive dependency
+// missing from this project's vendored tree. This minimal record, combined
+// with retry.RetryOnConflict (the same optimistic-concurrency pattern this
+// file already uses for the node-id annotation), is enough to guarantee only
+// one holder at a time.
+type leaderElectionRecord struct {
+	HolderIdentity string    `json:"holderIdentity"`
+	RenewTime      time.Time `json:"renewTime"`
+}
+
+// tryAcquireOrRenewLock attempts to become, or remain, the holder of the
+// ConfigMap lock named lockName, as identity. The lock is free to claim if it
+// has never been held, is already held by identity, or its last renewal is
+// older than leaseDuration. It returns whether identity holds the lock after
+// the call.
+func tryAcquireOrRenewLock(cmClient corev1.ConfigMapInterface, lockName, identity string, leaseDuration time.Duration) (bool, error) {
+	held := false
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		held = false
+		cm, err := cmClient.Get(lockName, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			data, err := json.Marshal(leaderElectionRecord{HolderIdentity: identity, RenewTime: time.Now()})
+			if err != nil {
+				return err
+			}
+			if _, err := cmClient.Create(&v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        lockName,
+					Annotations: map[string]string{leaderElectionRecordAnnotationKey: string(data)},
+				},
+			}); err != nil {
+				return err
+			}
+			held = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var record leaderElectionRecord
+		if raw, ok := cm.Annotations[leaderElectionRecordAnnotationKey]; ok {
+			// A corrupt record is treated the same as no record: free to claim.
+			json.Unmarshal([]byte(raw), &record)
+		}
+		if record.HolderIdentity != "" && record.HolderIdentity != identity && time.Since(record.RenewTime) < leaseDuration {
+			return nil
+		}
+
+		data, err := json.Marshal(leaderElectionRecord{HolderIdentity: identity, RenewTime: time.Now()})
+		if err != nil {
+			return err
+		}
+		updated := cm.DeepCopy()
+		if updated.Annotations == nil {
+			updated.Annotations = map[string]string{}
+		}
+		updated.Annotations[leaderElectionRecordAnnotationKey] = string(data)
+		if _, err := cmClient.Update(updated); err != nil {
+			return err
+		}
+		held = true
+		return nil
+	})
+	return held, retryErr
+}
+
+// runAnnotationLoopWithLeaderElection gates runAnnotationLoop behind
+// --enable-leader-election: when unset (the default), it calls
+// runAnnotationLoop directly, preserving this program's historical behavior.
+// When set, it blocks, retrying every leaderElectionRetryPeriod, until it
+// wins leaderElectionLockName or annotationCtx is cancelled, then keeps
+// renewing the lock in the background for as long as the process runs while
+// running the annotation loop in the foreground; a failed renewal means the
+// lock was lost to another instance (e.g. this one stalled past
+// leaderElectionLeaseDuration), and is treated like this program's other
+// watchdog failures - it exits so the usual DaemonSet RestartPolicy restarts
+// it, rather than risking two instances both believing they hold the lock.
+// This only affects the annotation loop; the registration socket, if any, is
+// still served by every instance, since kubelet only ever dials the one
+// running on its own node.
+//
+// registrationActive reports whether this driver also serves a registration
+// socket; if so, a kube client build failure here only disables annotation
+// mode (logged as a warning) instead of being fatal, since registration can
+// still proceed without it. See runAnnotationLoop's own registrationActive
+// parameter for the equivalent downgrade in the no-leader-election path.
+//
+// markStartupDone is forwarded to runAnnotationLoop, which calls it on the
+// first successful node-id annotation update (see --startup-timeout).
+func runAnnotationLoopWithLeaderElection(
+	annotationCtx context.Context,
+	config *rest.Config,
+	k8sNodeName string,
+	csiConn connection.CSIConnection,
+	csiDriverName string,
+	vendorVersion string,
+	csiAddress string,
+	csiDriverNodeId string,
+	maxVolumesPerNode int64,
+	topologySegments map[string]string,
+	registrationActive bool,
+	resync <-chan struct{},
+	markStartupDone func(),
+) {
+	if !*enableLeaderElection {
+		runAnnotationLoop(annotationCtx, config, k8sNodeName, csiConn, csiDriverName, vendorVersion, csiAddress, csiDriverNodeId, maxVolumesPerNode, topologySegments, registrationActive, resync, markStartupDone)
+		return
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		if registrationActive {
+			glog.Warningf("Failed to build kube client for leader election, disabling annotation mode for driver %q; the registration socket is unaffected and will keep serving: %v", csiDriverName, err)
+			return
+		}
+		glog.Error(err.Error())
+		os.Exit(exitKubeConfigFailure)
+	}
+	cmClient := clientset.CoreV1().ConfigMaps(*leaderElectionNamespace)
+	lockName := leaderElectionLockName(k8sNodeName, csiDriverName)
+	identity := fmt.Sprintf("%s_%d", k8sNodeName, os.Getpid())
+
+	glog.Infof("Leader election enabled for driver %q on node %q; waiting to acquire lock %q in namespace %q as %q.", csiDriverName, k8sNodeName, lockName, *leaderElectionNamespace, identity)
+	for {
+		held, err := tryAcquireOrRenewLock(cmClient, lockName, identity, leaderElectionLeaseDuration)
+		if err != nil {
+			glog.Warningf("Leader election: failed to acquire lock %q in namespace %q: %v", lockName, *leaderElectionNamespace, err)
+		}
+		if held {
+			break
+		}
+		select {
+		case <-annotationCtx.Done():
+			return
+		case <-time.After(leaderElectionRetryPeriod):
+		}
+	}
+	glog.Infof("Leader election: acquired lock %q in namespace %q as %q; starting the node-id annotation loop.", lockName, *leaderElectionNamespace, identity)
+
+	go func() {
+		for {
+			select {
+			case <-annotationCtx.Done():
+				return
+			case <-time.After(leaderElectionRetryPeriod):
+			}
+			held, err := tryAcquireOrRenewLock(cmClient, lockName, identity, leaderElectionLeaseDuration)
+			if err != nil {
+				glog.Warningf("Leader election: failed to renew lock %q in namespace %q: %v", lockName, *leaderElectionNamespace, err)
+				continue
+			}
+			if !held {
+				glog.Errorf("Leader election: lost lock %q in namespace %q to another holder; exiting so the usual DaemonSet RestartPolicy restarts this container.", lockName, *leaderElectionNamespace)
+				os.Exit(exitGeneralError)
+			}
+		}
+	}()
+
+	runAnnotationLoop(annotationCtx, config, k8sNodeName, csiConn, csiDriverName, vendorVersion, csiAddress, csiDriverNodeId, maxVolumesPerNode, topologySegments, registrationActive, resync, markStartupDone)
+}
+
+// runAnnotationLoop maintains the legacy node-id (and, if applicable,
+// topology and max-volumes) Node annotations until annotationCtx is
+// cancelled, then exits the process.
+//
+// This program is intended to run as a side-car container inside a
+// Kubernetes DaemonSet. Kubernetes DaemonSet only have one RestartPolicy,
+// always, meaning as soon as this container terminates, it will be started
+// again. Therefore, this loop runs indefinitely and periodically updates the
+// node annotation. The CSI driver's own name and node ID are assumed
+// immutable, but the connection itself is not: if the CSI driver container
+// is restarted independently of this sidecar, csiConn is reconnected and the
+// cached node ID/topology/max-volumes are refreshed from the new connection.
+// Setting --refresh-identity-period additionally re-derives the node ID
+// (without waiting for a reconnect) for the rare driver that changes it
+// while staying connected.
+//
+// If building the kube client fails before the loop starts, the default
+// behavior is still to exit, since annotation mode is this process's only
+// job. But if registrationActive is true (this driver also serves a
+// registration socket), the failure instead only disables annotation mode:
+// it is logged as a warning and this function returns, leaving the
+// registration socket goroutine to keep running unaffected.
+func runAnnotationLoop(
+	annotationCtx context.Context,
+	config *rest.Config,
+	k8sNodeName string,
+	csiConn connection.CSIConnection,
+	csiDriverName string,
+	vendorVersion string,
+	csiAddress string,
+	csiDriverNodeId string,
+	maxVolumesPerNode int64,
+	topologySegments map[string]string,
+	registrationActive bool,
+	resync <-chan struct{},
+	markStartupDone func(),
 ) {
-	// Fetch node name from environment variable
-	k8sNodeName := os.Getenv("KUBE_NODE_NAME")
-	if k8sNodeName == "" {
-		glog.Error("Node name not found. The environment variable KUBE_NODE_NAME is empty.")
-		os.Exit(1)
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		if registrationActive {
+			glog.Warningf("Failed to build kube client, disabling annotation mode for driver %q; the registration socket is unaffected and will keep serving: %v", csiDriverName, err)
+			return
+		}
+		glog.Error(err.Error())
+		os.Exit(exitKubeConfigFailure)
+	}
+
+	if err := checkNodeRBAC(clientset.AuthorizationV1().SelfSubjectAccessReviews()); err != nil {
+		if *requireRBACCheck {
+			glog.Errorf("%v", err)
+			os.Exit(exitRBACCheckFailure)
+		}
+		glog.Warningf("%v", err)
+	}
+
+	glog.V(1).Infof("Attempt to update node annotation if needed")
+	k8sNodesClient := clientset.CoreV1().Nodes()
+	nodeChanged := watchNodeForChanges(annotationCtx, k8sNodesClient, k8sNodeName)
+
+	if *reconcileStaleOnStartup {
+		if err := reconcileStaleNodeId(k8sNodeName, k8sNodesClient, csiDriverName, csiDriverNodeId, *nodeIdAnnotation); err != nil {
+			glog.Warningf("Failed to reconcile stale node-id annotation entries on startup for driver %q: %v", csiDriverName, err)
+		}
+	}
+
+	consecutiveFailures := 0
+	readyFileWritten := false
+	firstAnnotationSpan := startSpan("first-annotation")
+	lastIdentityRefresh := time.Now()
+	var nodeNotFoundSince time.Time
+	for {
+		failed := false
+		nodeNotFound := false
+
+		if *refreshIdentityPeriod > 0 && time.Since(lastIdentityRefresh) >= *refreshIdentityPeriod {
+			newNodeId, err := refreshIdentity(annotationCtx, csiConn, csiDriverName, csiDriverNodeId, csiAddress)
+			if err != nil {
+				glog.Warningf("Failed to refresh CSI driver identity: %v", err)
+				failed = true
+			} else {
+				csiDriverNodeId = newNodeId
+				updateDriverStatus(csiAddress, func(s *driverStatus) { s.NodeID = csiDriverNodeId })
+			}
+			lastIdentityRefresh = time.Now()
+		}
+
+		if state := csiConn.GetState(); state != connectivity.Ready && state != connectivity.Idle {
+			glog.Warningf("CSI driver connection for %q is %s, attempting to reconnect", csiDriverName, state)
+			newConn, err := reconnectCSI(annotationCtx, csiAddress, csiConn)
+			if err != nil {
+				glog.Warningf("Failed to reconnect to CSI driver %q: %v", csiDriverName, err)
+				failed = true
+			} else {
+				csiConn = newConn
+				newNodeID, newMaxVolumesPerNode, newTopologySegments, err := getNodeInfo(annotationCtx, csiConn)
+				if err != nil {
+					glog.Warningf("Reconnected to CSI driver %q but failed to refresh node info: %v", csiDriverName, err)
+					failed = true
+				} else {
+					if newNodeID != csiDriverNodeId {
+						glog.Infof("CSI driver %q node ID changed from %q to %q after reconnect", csiDriverName, csiDriverNodeId, newNodeID)
+						csiDriverNodeId = newNodeID
+						updateDriverStatus(csiAddress, func(s *driverStatus) { s.NodeID = csiDriverNodeId })
+					}
+					if newMaxVolumesPerNode != maxVolumesPerNode {
+						glog.Infof("CSI driver %q max volumes per node changed from %d to %d after reconnect", csiDriverName, maxVolumesPerNode, newMaxVolumesPerNode)
+						maxVolumesPerNode = newMaxVolumesPerNode
+					}
+					topologySegments = newTopologySegments
+					glog.Infof("Reconnected to CSI driver %q", csiDriverName)
+				}
+			}
+		}
+
+		var err error
+		if csiDriverNodeId == "" {
+			glog.Warningf("Skipping node-id annotation update for driver %q: CSI driver node ID is empty.", csiDriverName)
+		} else {
+			for _, annotationKey := range allNodeIdAnnotationKeys() {
+				if annotationErr := getVerifyAndAddNodeId(
+					k8sNodeName,
+					k8sNodesClient,
+					csiDriverName,
+					csiDriverNodeId,
+					annotationKey); annotationErr != nil {
+					if stderrors.Is(annotationErr, errNodeNotFound) {
+						nodeNotFound = true
+						continue
+					}
+					glog.Warning(annotationErr)
+					failed = true
+					err = annotationErr
+				}
+			}
+			if err == nil {
+				updateDriverStatus(csiAddress, func(s *driverStatus) { s.LastAnnotationSuccess = time.Now() })
+				firstAnnotationSpan.End(csiDriverName, k8sNodeName, nil)
+				firstAnnotationSpan = nil
+				markStartupDone()
+			}
+			if *alsoWriteNodeIdLabel {
+				if err := getVerifyAndSetNodeIdLabel(k8sNodeName, k8sNodesClient, csiDriverName, csiDriverNodeId); err != nil {
+					glog.Warning(err)
+					failed = true
+				}
+			}
+		}
+		if *annotateCSIVersion {
+			if vendorVersion == "" {
+				glog.V(2).Infof("Skipping CSI version annotation update for driver %q: driver did not report a vendor version.", csiDriverName)
+			} else if err := getVerifyAndSetCSIVersionAnnotation(k8sNodeName, k8sNodesClient, csiDriverName, vendorVersion); err != nil {
+				glog.Warning(err)
+				failed = true
+			}
+		}
+		if err == nil && *readyFile != "" && !readyFileWritten {
+			if err := touchReadyFile(*readyFile); err != nil {
+				glog.Warningf("Failed to create --ready-file %q: %v", *readyFile, err)
+			} else {
+				glog.V(2).Infof("Created --ready-file %q after the first successful node-id annotation update", *readyFile)
+				readyFileWritten = true
+			}
+		}
+		if len(topologySegments) > 0 {
+			if err := applyTopologyLabels(k8sNodeName, k8sNodesClient, csiDriverName, topologySegments); err != nil {
+				glog.Warning(err)
+				failed = true
+			}
+		}
+		if maxVolumesPerNode > 0 {
+			var err error
+			if *volumeLimitsMode == volumeLimitsModeStatus {
+				err = getVerifyAndSetMaxVolumesNodeStatus(k8sNodeName, k8sNodesClient, csiDriverName, maxVolumesPerNode)
+			} else {
+				err = getVerifyAndSetMaxVolumesPerNode(k8sNodeName, k8sNodesClient, csiDriverName, maxVolumesPerNode)
+			}
+			if err != nil {
+				glog.Warning(err)
+				failed = true
+			}
+		}
+		if failed {
+			consecutiveFailures++
+		} else {
+			consecutiveFailures = 0
+		}
+
+		if *exitOnNodeDeleted > 0 {
+			var shouldExit bool
+			nodeNotFoundSince, shouldExit = nodeDeletedTick(nodeNotFound, nodeNotFoundSince, *exitOnNodeDeleted)
+			if shouldExit {
+				glog.Errorf("Node %q has been missing from the apiserver for at least %s (>= --exit-on-node-deleted=%s); exiting since there is nothing left to annotate.", k8sNodeName, time.Since(nodeNotFoundSince), *exitOnNodeDeleted)
+				os.Exit(exitNodeDeleted)
+			}
+		}
+
+		select {
+		case <-annotationCtx.Done():
+			exitCode := exitGeneralError
+			if *deregisterOnShutdown {
+				for _, annotationKey := range deregisterAnnotationKeysEffective() {
+					if err := deregisterNodeIdWithRetry(
+						k8sNodeName,
+						k8sNodesClient,
+						csiDriverName,
+						csiDriverNodeId,
+						*forceDeregister,
+						annotationKey,
+						*deregisterRetryAttempts,
+						*deregisterRetryInterval); err != nil {
+						glog.Errorf("Failed to remove node-id annotation entry for driver %q under key %q on node %q after %d attempt(s); the stale entry will remain until a later restart, its own --deregister-on-shutdown cleanup, or an operator corrects it manually: %v", csiDriverName, annotationKey, k8sNodeName, *deregisterRetryAttempts, err)
+						exitCode = exitDeregistrationFailure
+					}
+				}
+				if *annotateCSIVersion {
+					if err := getVerifyAndDeleteCSIVersionAnnotation(k8sNodeName, k8sNodesClient, csiDriverName); err != nil {
+						glog.Warningf("Failed to remove CSI version annotation for driver %q on node %q; the stale entry will remain until a later restart or an operator corrects it manually: %v", csiDriverName, k8sNodeName, err)
+					}
+				}
+			} else {
+				glog.Infof("Skipping node-id annotation cleanup for driver %q because --deregister-on-shutdown=false", csiDriverName)
+			}
+			if *readyFile != "" {
+				if err := os.Remove(*readyFile); err != nil && !os.IsNotExist(err) {
+					glog.Warningf("Failed to remove --ready-file %q: %v", *readyFile, err)
+				}
+			}
+			os.Exit(exitCode)
+		case <-nodeChanged:
+			glog.V(2).Infof("Node %q changed, re-checking the node-id annotation immediately instead of waiting for the next resync", k8sNodeName)
+			// The Node object may have been edited or deleted out from under
+			// nodeIdAnnotationCache (e.g. another actor stripping the node-id
+			// annotation, or the Node itself being removed from the cluster);
+			// invalidate the cache so the check below actually re-reads the
+			// apiserver instead of trusting what may now be a stale cache hit.
+			invalidateNodeIdAnnotationCache(csiDriverName)
+		case <-resync:
+			glog.V(1).Infof("Resync requested via SIGHUP, re-checking the node-id annotation for driver %q immediately", csiDriverName)
+		case <-time.After(jitteredAnnotationLoopBackoff(consecutiveFailures)):
+		}
+	}
+}
+
+// watchNodeForChanges watches k8sNodeName and sends on its returned channel
+// whenever the Node object is modified or deleted, so runAnnotationLoop can
+// react immediately to an external edit - most importantly another actor
+// stripping the node-id annotation out from under it - instead of waiting
+// for its next periodic resync. The periodic resync in runAnnotationLoop's
+// own select is left in place as a safety net: if the watch itself silently
+// stops delivering events (e.g. a dropped connection this loop fails to
+// notice), the next timer tick still re-applies the annotation.
+//
+// This tree does not build k8s.io/client-go/informers or its fake clientset
+// (both pull in vendor packages - github.com/davecgh/go-spew and
+// github.com/hashicorp/golang-lru - that aren't present in this vendor
+// snapshot), so this watches NodeInterface directly instead of using a
+// SharedInformerFactory. The returned channel is closed once annotationCtx
+// is done; it is never closed for any other reason, since a watch that ends
+// on its own (the API server closes it periodically) is silently restarted.
+func watchNodeForChanges(ctx context.Context, k8sNodesClient corev1.NodeInterface, k8sNodeName string) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	go func() {
+		defer close(changed)
+		fieldSelector := fields.OneTermEqualSelector("metadata.name", k8sNodeName).String()
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+			w, err := k8sNodesClient.Watch(metav1.ListOptions{FieldSelector: fieldSelector})
+			if err != nil {
+				glog.Warningf("Failed to watch Node %q for annotation changes, falling back to polling alone until the next retry: %v", k8sNodeName, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(sleepDuration):
+					continue
+				}
+			}
+			watchNodeForChangesDrain(ctx, w, changed)
+			w.Stop()
+		}
+	}()
+	return changed
+}
+
+// watchNodeForChangesDrain forwards ADDED/MODIFIED/DELETED events from w to
+// changed (a non-blocking send, since runAnnotationLoop only needs to know
+// that *something* changed, not how many times) until ctx is done or w's
+// result channel closes, at which point watchNodeForChanges starts a fresh
+// watch. It is split out from watchNodeForChanges so it can be unit tested
+// directly against a watch.FakeWatcher.
+func watchNodeForChangesDrain(ctx context.Context, w watch.Interface, changed chan<- struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return
+			}
+			switch event.Type {
+			case watch.Added, watch.Modified, watch.Deleted:
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// annotationLoopBackoff returns the delay before the next runAnnotationLoop
+// iteration: sleepDuration in steady state, or, after consecutiveFailures in
+// a row, that duration doubled once per failure and capped at
+// maxAnnotationBackoff. This keeps the normal update cadence unchanged while
+// backing off noisily repeated apiserver errors during an outage.
+func annotationLoopBackoff(consecutiveFailures int) time.Duration {
+	backoff := sleepDuration
+	for i := 0; i < consecutiveFailures; i++ {
+		backoff *= 2
+		if backoff >= maxAnnotationBackoff {
+			return maxAnnotationBackoff
+		}
+	}
+	return backoff
+}
+
+// jitteredAnnotationLoopBackoff adds up to --resync-jitter-factor of random
+// jitter on top of annotationLoopBackoff, via wait.Jitter, so that nodes
+// whose registrar pods started at the same time (e.g. after a DaemonSet
+// rollout) don't converge on synchronized apiserver bursts every
+// sleepDuration. wait.Jitter treats a maxFactor <= 0 as "use its own
+// default", so a *resyncJitterFactor of exactly 0 is special-cased here to
+// mean no jitter at all, matching its documented behavior.
+func jitteredAnnotationLoopBackoff(consecutiveFailures int) time.Duration {
+	backoff := annotationLoopBackoff(consecutiveFailures)
+	if *resyncJitterFactor <= 0 {
+		return backoff
+	}
+	return wait.Jitter(backoff, *resyncJitterFactor)
+}
+
+// eventRecorder records Events against the local Node object.
+type eventRecorder struct {
+	events     corev1.EventInterface
+	nodeName   string
+	driverName string
+}
+
+// buildEventRecorder returns an eventRecorder backed by the given kube
+// client config, or nil if no working config is available. This lets the
+// registration-socket-only mode run without API server access.
+func buildEventRecorder(config *rest.Config, nodeName, csiDriverName string) *eventRecorder {
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		glog.Warningf("Could not build a Kubernetes client, registration failures will only be logged: %v", err)
+		return nil
+	}
+
+	return &eventRecorder{
+		events:     clientset.CoreV1().Events(""),
+		nodeName:   nodeName,
+		driverName: csiDriverName,
+	}
+}
+
+// Warningf records a Warning Event against the Node object, best-effort.
+func (r *eventRecorder) Warningf(reason, messageFmt string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	now := metav1.Now()
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: r.driverName + "-",
+			Namespace:    metav1.NamespaceDefault,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind: "Node",
+			Name: r.nodeName,
+		},
+		Reason:         reason,
+		Message:        fmt.Sprintf(messageFmt, args...),
+		Type:           v1.EventTypeWarning,
+		Source:         v1.EventSource{Component: r.driverName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := r.events.Create(event); err != nil {
+		glog.Warningf("Failed to record registration failure Event: %v", err)
+	}
+}
+
+// touchReadyFile creates path if it does not already exist, so a readiness
+// probe checking for it sees a stable mtime from the first successful
+// update rather than one that churns every loop iteration.
+func touchReadyFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// reconnectCSI closes the old (dead) CSI connection and establishes a new
+// one, reusing WaitForServer's socket-then-Probe ordering so a driver that
+// is mid-restart (socket removed and not yet recreated) is handled the same
+// way as at startup.
+func reconnectCSI(ctx context.Context, csiAddress string, oldConn connection.CSIConnection) (connection.CSIConnection, error) {
+	oldConn.Close()
+	dialCtx, cancel := context.WithTimeout(ctx, *connectionTimeout)
+	defer cancel()
+	return connection.WaitForServer(dialCtx, csiAddress)
+}
+
+// validateDiscoveredNodeID logs an error if a CSI driver's just-discovered
+// nodeID is empty, and reports whether that should be treated as fatal.
+// Writing an empty node-id annotation entry would otherwise silently
+// confuse the scheduler, so this is fatal by default; allowEmptyNodeID
+// instead tolerates it, leaving the node-id annotation untouched for this
+// driver until it reports a non-empty value (runAnnotationLoop skips its
+// annotation update whenever the current node ID is empty).
+func validateDiscoveredNodeID(csiDriverName, nodeID string, allowEmptyNodeID bool) (fatal bool) {
+	if nodeID != "" {
+		return false
+	}
+	if allowEmptyNodeID {
+		glog.Errorf("CSI driver %q returned an empty node ID; --allow-empty-nodeid is set, so the node-id annotation will not be updated for this driver until it reports a non-empty value.", csiDriverName)
+		return false
+	}
+	glog.Errorf("CSI driver %q returned an empty node ID; refusing to write an empty node-id annotation entry. Set --allow-empty-nodeid to tolerate this and skip the annotation instead of exiting.", csiDriverName)
+	return true
+}
+
+// getNodeInfo returns the CSI driver's node ID and, when --enable-topology
+// is set, its accessible topology segments. Drivers that only implement
+// NodeGetId (i.e. NodeGetInfo returns Unimplemented) fall back transparently
+// and report no topology.
+func getNodeInfo(ctx context.Context, csiConn connection.CSIConnection) (string, int64, map[string]string, error) {
+	nodeID, maxVolumesPerNode, topology, err := csiConn.NodeGetInfo(ctx)
+	var unimplemented *connection.UnimplementedError
+	if stderrors.As(err, &unimplemented) {
+		glog.Warningf("CSI driver does not implement NodeGetInfo, falling back to NodeGetId: %v", err)
+		nodeIds, err := csiConn.NodeGetIds(ctx)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		return strings.Join(nodeIds, ","), 0, nil, nil
+	}
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if !*enableTopology {
+		topology = nil
+	}
+	return nodeID, maxVolumesPerNode, topology.GetSegments(), nil
+}
+
+// applyTopologyLabels labels the Node object with the CSI driver's
+// accessible topology segments, namespaced under the driver name (e.g.
+// "topology.<driver>/zone").
+func applyTopologyLabels(
+	k8sNodeName string,
+	k8sNodesClient corev1.NodeInterface,
+	csiDriverName string,
+	segments map[string]string) error {
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result, getErr := k8sNodesClient.Get(k8sNodeName, metav1.GetOptions{})
+		if getErr != nil {
+			glog.Errorf("Failed to get latest version of Node: %v", getErr)
+			return getErr // do not wrap error
+		}
+
+		labels := result.ObjectMeta.Labels
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		changed := false
+		for key, value := range segments {
+			labelKey := fmt.Sprintf("topology.%s/%s", csiDriverName, key)
+			if labels[labelKey] != value {
+				labels[labelKey] = value
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+
+		result.ObjectMeta.Labels = labels
+		updated, updateErr := k8sNodesClient.Update(result)
+		if updateErr != nil {
+			return updateErr // do not wrap error
+		}
+		for key, value := range segments {
+			labelKey := fmt.Sprintf("topology.%s/%s", csiDriverName, key)
+			if err := verifyMetadataFieldApplied(k8sNodeName, "label", labelKey, value, updated.ObjectMeta.Labels[labelKey]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if retryErr != nil {
+		return fmt.Errorf("Node topology label update failed: %v", retryErr)
+	}
+	return nil
+}
+
+// verifyMetadataFieldApplied reports an error if got (an entry of the
+// Annotations or Labels map on the Node object a k8sNodesClient
+// Update/Patch call just returned) does not equal want, identifying
+// fieldKind ("annotation" or "label") and key in both the log and the
+// returned error. Update/Patch succeeding is not by itself proof that the
+// field was actually persisted as written: a mutating admission webhook
+// can silently strip or rewrite it afterwards, which would otherwise look
+// like a successful update to every caller here. Returning an error (not
+// just logging) ensures that case surfaces as a failure instead of being
+// cached or reported as success, forcing the caller's next iteration to
+// re-check and retry.
+func verifyMetadataFieldApplied(k8sNodeName, fieldKind, key, want, got string) error {
+	if got == want {
+		return nil
+	}
+	glog.Warningf("Node %q %s %q was %q instead of the %q this process just wrote; a mutating admission webhook may be stripping or rewriting it", k8sNodeName, fieldKind, key, got, want)
+	return fmt.Errorf("node %q %s %q was not persisted as written (likely stripped or rewritten by a mutating admission webhook)", k8sNodeName, fieldKind, key)
+}
+
+// nodeIdLabelPrefix is the fixed prefix this file uses for the node-id label
+// written by --also-write-nodeid-label, so a node's labels and its node-id
+// annotation both make the relationship between a driver and its node ID
+// discoverable, just through different Kubernetes mechanisms.
+const nodeIdLabelPrefix = "csi-nodeid."
+
+// sanitizeLabelValue returns value unchanged if it is already a valid label
+// value (at most 63 characters, matching the label value character set).
+// Otherwise it returns a SHA-256 hash of value, hex-encoded and truncated to
+// 63 characters: hashing rather than truncating the raw node ID avoids two
+// different node IDs that merely share a common prefix colliding on the
+// same label value.
+func sanitizeLabelValue(value string) string {
+	if len(value) <= validation.LabelValueMaxLength && len(validation.IsValidLabelValue(value)) == 0 {
+		return value
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])[:validation.LabelValueMaxLength]
+}
+
+// getVerifyAndSetNodeIdLabel mirrors csiDriverNodeId into a
+// "csi-nodeid.<csiDriverName>" label on the k8sNodeName Node object, for
+// --also-write-nodeid-label. Unlike the node-id annotation, this only ever
+// tracks one driver's node ID per label (there is no JSON map to merge),
+// and the value is run through sanitizeLabelValue first, since label values
+// have stricter rules than annotation values.
+func getVerifyAndSetNodeIdLabel(
+	k8sNodeName string,
+	k8sNodesClient corev1.NodeInterface,
+	csiDriverName string,
+	csiDriverNodeId string,
+) error {
+	labelKey := nodeIdLabelPrefix + csiDriverName
+	if errs := validation.IsQualifiedName(labelKey); len(errs) != 0 {
+		return fmt.Errorf("cannot compute a valid node-id label key from driver name %q: %v", csiDriverName, errs)
+	}
+	labelValue := sanitizeLabelValue(csiDriverNodeId)
+
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result, getErr := k8sNodesClient.Get(k8sNodeName, metav1.GetOptions{})
+		if getErr != nil {
+			glog.Errorf("Failed to get latest version of Node: %v", getErr)
+			return getErr // do not wrap error
+		}
+
+		if result.ObjectMeta.Labels[labelKey] == labelValue {
+			return nil
+		}
+
+		labels := result.ObjectMeta.Labels
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[labelKey] = labelValue
+		result.ObjectMeta.Labels = labels
+		updated, updateErr := k8sNodesClient.Update(result)
+		if updateErr != nil {
+			return updateErr // do not wrap error
+		}
+		return verifyMetadataFieldApplied(k8sNodeName, "label", labelKey, labelValue, updated.ObjectMeta.Labels[labelKey])
+	})
+	if retryErr != nil {
+		return fmt.Errorf("Node node-id label update failed: %v", retryErr)
+	}
+	return nil
+}
+
+// csiVersionAnnotationPrefix is the fixed prefix this file uses for the
+// per-driver CSI vendor version annotation written by --annotate-csi-version,
+// mirroring nodeIdLabelPrefix's "one flat key per driver" shape rather than
+// the node-id annotation's single JSON-map-keyed-by-driver-name value, since
+// the requested key already embeds the driver name.
+const csiVersionAnnotationPrefix = "csi.volume.kubernetes.io/version-"
+
+// getVerifyAndSetCSIVersionAnnotation mirrors vendorVersion into a
+// "csi.volume.kubernetes.io/version-<csiDriverName>" annotation on the
+// k8sNodeName Node object, for --annotate-csi-version. Like the node-id
+// label, this only ever tracks one driver's version per annotation key
+// (there is no JSON map to merge).
+func getVerifyAndSetCSIVersionAnnotation(
+	k8sNodeName string,
+	k8sNodesClient corev1.NodeInterface,
+	csiDriverName string,
+	vendorVersion string,
+) error {
+	annotationKey := csiVersionAnnotationPrefix + csiDriverName
+	if errs := validation.IsQualifiedName(annotationKey); len(errs) != 0 {
+		return fmt.Errorf("cannot compute a valid CSI version annotation key from driver name %q: %v", csiDriverName, errs)
+	}
+
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result, getErr := k8sNodesClient.Get(k8sNodeName, metav1.GetOptions{})
+		if getErr != nil {
+			glog.Errorf("Failed to get latest version of Node: %v", getErr)
+			return getErr // do not wrap error
+		}
+
+		if result.ObjectMeta.Annotations[annotationKey] == vendorVersion {
+			return nil
+		}
+
+		result.ObjectMeta.Annotations = cloneAndAddAnnotation(result.ObjectMeta.Annotations, annotationKey, vendorVersion)
+		updated, updateErr := k8sNodesClient.Update(result)
+		if updateErr != nil {
+			return updateErr // do not wrap error
+		}
+		return verifyMetadataFieldApplied(k8sNodeName, "annotation", annotationKey, vendorVersion, updated.ObjectMeta.Annotations[annotationKey])
+	})
+	if retryErr != nil {
+		return fmt.Errorf("Node CSI version annotation update failed: %v", retryErr)
 	}
+	return nil
+}
 
-	// Get CSI Driver Node ID
-	glog.V(1).Infof("Calling CSI driver to discover node ID.")
-	ctx, cancel := context.WithTimeout(context.Background(), csiTimeout)
-	defer cancel()
-	csiDriverNodeId, err := csiConn.NodeGetId(ctx)
-	if err != nil {
-		glog.Error(err.Error())
-		os.Exit(1)
+// getVerifyAndDeleteCSIVersionAnnotation removes the
+// "csi.volume.kubernetes.io/version-<csiDriverName>" annotation from the
+// k8sNodeName Node object, for --annotate-csi-version's --deregister-on-shutdown
+// cleanup. A missing annotation (already removed, or never written because
+// the driver never reported a vendor version) is not an error.
+func getVerifyAndDeleteCSIVersionAnnotation(
+	k8sNodeName string,
+	k8sNodesClient corev1.NodeInterface,
+	csiDriverName string,
+) error {
+	annotationKey := csiVersionAnnotationPrefix + csiDriverName
+
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result, getErr := k8sNodesClient.Get(k8sNodeName, metav1.GetOptions{})
+		if getErr != nil {
+			glog.Errorf("Failed to get latest version of Node: %v", getErr)
+			return getErr // do not wrap error
+		}
+
+		if _, ok := result.ObjectMeta.Annotations[annotationKey]; !ok {
+			return nil
+		}
+
+		delete(result.ObjectMeta.Annotations, annotationKey)
+		updated, updateErr := k8sNodesClient.Update(result)
+		if updateErr != nil {
+			return updateErr // do not wrap error
+		}
+		return verifyMetadataFieldApplied(k8sNodeName, "annotation", annotationKey, "", updated.ObjectMeta.Annotations[annotationKey])
+	})
+	if retryErr != nil {
+		return fmt.Errorf("Node CSI version annotation removal failed: %v", retryErr)
 	}
-	glog.V(2).Infof("CSI driver node ID: %q", csiDriverNodeId)
+	return nil
+}
+
+// Fetches Kubernetes node API object corresponding to k8sNodeName.
+// If the csiDriverName's entry in the maxVolumesAnnotation map is not
+// already set to maxVolumesPerNode, this method updates it.
+func getVerifyAndSetMaxVolumesPerNode(
+	k8sNodeName string,
+	k8sNodesClient corev1.NodeInterface,
+	csiDriverName string,
+	maxVolumesPerNode int64,
+) error {
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result, getErr := k8sNodesClient.Get(k8sNodeName, metav1.GetOptions{})
+		if getErr != nil {
+			glog.Errorf("Failed to get latest version of Node: %v", getErr)
+			return getErr // do not wrap error
+		}
+
+		var previousAnnotationValue string
+		if result.ObjectMeta.Annotations != nil {
+			previousAnnotationValue =
+				result.ObjectMeta.Annotations[*maxVolumesAnnotation]
+			glog.V(3).Infof(
+				"previousAnnotationValue=%q", previousAnnotationValue)
+		}
 
-	// When kubeletRegistrationPath is specified then driver-registrar ONLY acts
-	// as gRPC server which replies to registration requests initiated by kubelet's
-	// pluginswatcher infrastructure. Node labeling is done by kubelet's csi code.
-	if *kubeletRegistrationPath != "" {
-		registrar := newRegistrationServer(csiDriverName, *kubeletRegistrationPath, supportedVersions)
-		socketPath := fmt.Sprintf("/registration/%s-reg.sock", csiDriverName)
-		fi, err := os.Stat(socketPath)
-		if err == nil && (fi.Mode()&os.ModeSocket) != 0 {
-			// Remove any socket, stale or not, but fall through for other files
-			if err := os.Remove(socketPath); err != nil {
-				glog.Errorf("failed to remove stale socket %s with error: %+v", socketPath, err)
-				os.Exit(1)
+		existingMaxVolumesMap := map[string]int64{}
+		if previousAnnotationValue != "" {
+			// Parse previousAnnotationValue as JSON
+			if err := json.Unmarshal([]byte(previousAnnotationValue), &existingMaxVolumesMap); err != nil {
+				return fmt.Errorf(
+					"Failed to parse node's %q annotation value (%q) err=%v",
+					*maxVolumesAnnotation,
+					previousAnnotationValue,
+					err)
 			}
 		}
-		if err != nil && !os.IsNotExist(err) {
-			glog.Errorf("failed to stat the socket %s with error: %+v", socketPath, err)
-			os.Exit(1)
+
+		if val, ok := existingMaxVolumesMap[csiDriverName]; ok && val == maxVolumesPerNode {
+			// Value already exists in node annotation, nothing more to do
+			return nil
 		}
-		// Default to only user accessible socket, caller can open up later if desired
-		oldmask := unix.Umask(0077)
 
-		glog.Infof("Starting Registration Server at: %s\n", socketPath)
-		lis, err := net.Listen("unix", socketPath)
+		existingMaxVolumesMap[csiDriverName] = maxVolumesPerNode
+		jsonObj, err := json.Marshal(existingMaxVolumesMap)
 		if err != nil {
-			glog.Errorf("failed to listen on socket: %s with error: %+v", socketPath, err)
-			os.Exit(1)
+			return fmt.Errorf(
+				"Failed while trying to add key value {%q: %d} to node %q annotation. Existing value: %v",
+				csiDriverName,
+				maxVolumesPerNode,
+				*maxVolumesAnnotation,
+				previousAnnotationValue)
 		}
-		unix.Umask(oldmask)
-		glog.Infof("Registration Server started at: %s\n", socketPath)
-		grpcServer := grpc.NewServer()
-		// Registers kubelet plugin watcher api.
-		registerapi.RegisterRegistrationServer(grpcServer, registrar)
 
-		// Starts service
-		if err := grpcServer.Serve(lis); err != nil {
-			glog.Errorf("Registration Server stopped serving: %v", err)
-			os.Exit(1)
+		result.ObjectMeta.Annotations = cloneAndAddAnnotation(
+			result.ObjectMeta.Annotations,
+			*maxVolumesAnnotation,
+			string(jsonObj))
+		updated, updateErr := k8sNodesClient.Update(result)
+		if updateErr != nil {
+			return updateErr // do not wrap error
 		}
-		// If gRPC server is gracefully shutdown, exit
-		os.Exit(0)
-	} else { // only apply Node label update when kubelet plugin not used
-		clientset, err := kubernetes.NewForConfig(config)
-		if err != nil {
-			glog.Error(err.Error())
-			os.Exit(1)
+		return verifyMetadataFieldApplied(k8sNodeName, "annotation", *maxVolumesAnnotation, string(jsonObj), updated.ObjectMeta.Annotations[*maxVolumesAnnotation])
+	})
+	if retryErr != nil {
+		return fmt.Errorf("Node update failed: %v", retryErr)
+	}
+	return nil
+}
+
+// getVerifyAndSetMaxVolumesNodeStatus is --volume-limits-mode=status's
+// counterpart to getVerifyAndSetMaxVolumesPerNode: instead of the
+// --maxvolumes-annotation-key map, it publishes maxVolumesPerNode as
+// csiDriverName's "attachable-volumes-<driver>" entry in the Node object's
+// status Capacity and Allocatable, via the status subresource, matching how
+// in-tree volume plugins and newer external CSI sidecars report volume
+// limits for a scheduler version that reads them from node status rather
+// than the annotation. Capacity and Allocatable are set to the same value,
+// since this process has no notion of volumes already in use to subtract.
+func getVerifyAndSetMaxVolumesNodeStatus(
+	k8sNodeName string,
+	k8sNodesClient corev1.NodeInterface,
+	csiDriverName string,
+	maxVolumesPerNode int64,
+) error {
+	resourceName := v1.ResourceName(v1.ResourceAttachableVolumesPrefix + csiDriverName)
+	quantity := resource.NewQuantity(maxVolumesPerNode, resource.DecimalSI)
+
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result, getErr := k8sNodesClient.Get(k8sNodeName, metav1.GetOptions{})
+		if getErr != nil {
+			glog.Errorf("Failed to get latest version of Node: %v", getErr)
+			return getErr // do not wrap error
+		}
+
+		if existing, ok := result.Status.Capacity[resourceName]; ok && existing.Cmp(*quantity) == 0 {
+			if existing, ok := result.Status.Allocatable[resourceName]; ok && existing.Cmp(*quantity) == 0 {
+				// Value already exists in node status, nothing more to do
+				return nil
+			}
 		}
 
-		glog.V(1).Infof("Attempt to update node annotation if needed")
-		k8sNodesClient := clientset.CoreV1().Nodes()
+		if result.Status.Capacity == nil {
+			result.Status.Capacity = v1.ResourceList{}
+		}
+		if result.Status.Allocatable == nil {
+			result.Status.Allocatable = v1.ResourceList{}
+		}
+		result.Status.Capacity[resourceName] = *quantity
+		result.Status.Allocatable[resourceName] = *quantity
 
-		// Set up goroutine to cleanup (aka deregister) on termination.
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		go func() {
-			<-c
-			err := getVerifyAndDeleteNodeId(
-				k8sNodeName,
-				k8sNodesClient,
-				csiDriverName)
+		_, updateErr := k8sNodesClient.UpdateStatus(result)
+		return updateErr // do not wrap error
+	})
+	if retryErr != nil {
+		return fmt.Errorf("Node status update failed: %v", retryErr)
+	}
+	return nil
+}
+
+// decodeAnnotationValue parses the node-id annotation value, transparently
+// handling both encodings --annotation-format can produce: a JSON object
+// mapping driver name to node ID(s), or (in "raw-single" mode) a bare node
+// ID string written while only one driver was registered. A bare value is
+// attributed to hintDriverName, since raw-single mode never records which
+// driver it belongs to; callers pass the driver they are currently
+// add/removing, which is correct as long as raw-single's one-driver
+// invariant holds.
+//
+// Each driver's entry in the JSON object form may itself be either a bare
+// JSON string (the original, and still by far the most common, single
+// node-id form) or a JSON array of strings, for a driver with more than one
+// node identity (see connection.CSIConnection.NodeGetIds). Both are
+// returned as a []string, of length 1 for the single-id form, so callers
+// don't need to care which form is on disk.
+//
+// A value that looks like a JSON object (starts with "{") but fails to
+// parse is reported as an error rather than silently treated as a
+// raw-single value, since that almost always means the annotation is
+// truncated or hand-edited rather than a legitimate bare node ID; see
+// getVerifyAndAddNodeId and getVerifyAndDeleteNodeId for how callers recover
+// from it.
+func decodeAnnotationValue(value string, hintDriverName string) (map[string][]string, error) {
+	driverMap := map[string][]string{}
+	if value == "" {
+		return driverMap, nil
+	}
+	var rawMap map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(value), &rawMap); err == nil {
+		for driverName, raw := range rawMap {
+			nodeIds, err := decodeNodeIdValue(raw)
 			if err != nil {
-				glog.Warning(err)
+				return nil, fmt.Errorf("driver %q: %v", driverName, err)
 			}
-			os.Exit(1)
-		}()
+			driverMap[driverName] = nodeIds
+		}
+		return driverMap, nil
+	} else if strings.HasPrefix(strings.TrimSpace(value), "{") {
+		return nil, fmt.Errorf("value looks like a JSON object but failed to parse: %v", err)
+	}
+	return map[string][]string{hintDriverName: {value}}, nil
+}
 
-		// This program is intended to run as a side-car container inside a
-		// Kubernetes DaemonSet. Kubernetes DaemonSet only have one RestartPolicy,
-		// always, meaning as soon as this container terminates, it will be started
-		// again. Therefore, this program will loop indefientley and periodically
-		// update the node annotation.
-		// The CSI driver name and node ID are assumed to be immutable, and are not
-		// refetched on subsequent loop iterations.
-		for {
-			err := getVerifyAndAddNodeId(
-				k8sNodeName,
-				k8sNodesClient,
-				csiDriverName,
-				csiDriverNodeId)
-			if err != nil {
-				glog.Warning(err)
+// decodeNodeIdValue parses one driver's entry from the node-id annotation's
+// JSON object form; see decodeAnnotationValue.
+func decodeNodeIdValue(raw json.RawMessage) ([]string, error) {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return []string{single}, nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return list, nil
+	}
+	return nil, fmt.Errorf("value %q is neither a string nor a list of strings", string(raw))
+}
+
+// encodeAnnotationValue renders driverMap for storage in the node-id
+// annotation, honoring --annotation-format. A driver with exactly one node
+// ID is always written as a bare JSON string, to keep the common case
+// byte-for-byte identical to before multi-node-id drivers were supported;
+// a driver with more than one is written as a JSON array. In "raw-single"
+// mode, a driverMap with exactly one driver that itself has exactly one
+// node ID is written as the bare node ID instead of a JSON object, for
+// downstream tooling that only ever expects one driver and one ID per node;
+// any other shape falls back to the "json" encoding, logging a warning so
+// the fallback is visible instead of silently producing unexpected output.
+//
+// The "json" encoding below marshals a Go map directly; encoding/json always
+// sorts map keys by the string they'll render as before emitting them (see
+// encoding/json's encoding.go), so this produces the same bytes regardless
+// of driverMap's iteration order, and getVerifyAndAddNodeId/
+// getVerifyAndDeleteNodeId only write a new value when it actually differs
+// from what was there (see stringSlicesEqual/stringSliceSetEqual),
+// together avoiding no-op annotation churn across repeated updates.
+func encodeAnnotationValue(driverMap map[string][]string) (string, error) {
+	if *annotationFormat == "raw-single" {
+		switch len(driverMap) {
+		case 0:
+			return "", nil
+		case 1:
+			for _, nodeIds := range driverMap {
+				if len(nodeIds) == 1 {
+					return nodeIds[0], nil
+				}
+				glog.Warningf(
+					"--annotation-format=raw-single requested but the node-id annotation's only driver has %d node IDs; falling back to JSON encoding",
+					len(nodeIds))
 			}
-			time.Sleep(sleepDuration)
+		default:
+			glog.Warningf(
+				"--annotation-format=raw-single requested but the node-id annotation would contain %d drivers; falling back to JSON encoding",
+				len(driverMap))
+		}
+	}
+	encoded := make(map[string]interface{}, len(driverMap))
+	for driverName, nodeIds := range driverMap {
+		if len(nodeIds) == 1 {
+			encoded[driverName] = nodeIds[0]
+		} else {
+			encoded[driverName] = nodeIds
+		}
+	}
+	jsonObj, err := json.Marshal(encoded)
+	if err != nil {
+		return "", err
+	}
+	return string(jsonObj), nil
+}
+
+// validateAnnotationSize rejects an encoded node-id annotation value larger
+// than maxBytes (--max-annotation-bytes), so that a node accumulating many
+// CSI drivers' entries (or a malformed merge loop) cannot silently grow this
+// one annotation large enough to threaten Kubernetes's 256KiB total
+// annotation size limit per object. driverCount is logged alongside the
+// size so an operator can tell at a glance whether the annotation is simply
+// tracking a lot of drivers or has actually gone pathological.
+func validateAnnotationSize(annotationKey, encodedValue string, driverCount, maxBytes int) error {
+	if len(encodedValue) <= maxBytes {
+		return nil
+	}
+	return fmt.Errorf(
+		"refusing to update node annotation %q: encoded value is %d bytes, over the --max-annotation-bytes limit of %d, across %d driver(s)",
+		annotationKey, len(encodedValue), maxBytes, driverCount)
+}
+
+// mergeNodeIds returns the union of existing and reported, in the order
+// existing's entries appear followed by any new ones from reported, so that
+// a multi-node-id driver's previously-registered IDs are preserved even if
+// a later restart reports only a subset of them.
+func mergeNodeIds(existing []string, reported []string) []string {
+	merged := append([]string{}, existing...)
+	seen := map[string]bool{}
+	for _, id := range existing {
+		seen[id] = true
+	}
+	for _, id := range reported {
+		if !seen[id] {
+			seen[id] = true
+			merged = append(merged, id)
+		}
+	}
+	return merged
+}
+
+// stringSlicesEqual reports whether a and b contain the same elements in
+// the same order.
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// stringSliceSetEqual reports whether a and b contain the same elements,
+// ignoring order and duplicates.
+func stringSliceSetEqual(a, b []string) bool {
+	toSet := func(s []string) map[string]bool {
+		set := make(map[string]bool, len(s))
+		for _, v := range s {
+			set[v] = true
+		}
+		return set
+	}
+	setA, setB := toSet(a), toSet(b)
+	if len(setA) != len(setB) {
+		return false
+	}
+	for v := range setA {
+		if !setB[v] {
+			return false
 		}
 	}
+	return true
 }
 
 // Fetches Kubernetes node API object corresponding to k8sNodeName.
 // If the csiDriverName and csiDriverNodeId are not present in the node
 // annotation, this method adds it.
+// nodeIdAnnotationCacheKey identifies one (driver, annotation key) pair in
+// nodeIdAnnotationCache. The annotation key is part of the key, not just
+// the driver name, because --additional-nodeid-annotation-key can have
+// getVerifyAndAddNodeId write the same driver's node ID to more than one
+// annotation key in the same loop iteration; without it, confirming the
+// first key would incorrectly mark every other key for that driver as
+// already applied too.
+type nodeIdAnnotationCacheKey struct {
+	driverName string
+	annotation string
+}
+
+// nodeIdAnnotationCache remembers, per (CSI driver, annotation key) pair,
+// the node ID this process last successfully saw stored there.
+// nodeRegister's annotation loop calls getVerifyAndAddNodeId on a timer
+// even when the CSI driver keeps reporting the same node ID, so in steady
+// state this lets getVerifyAndAddNodeId skip the apiserver Get and patch
+// construction entirely instead of paying for a Get every time only to
+// discover nothing changed.
+//
+// The cache is best-effort and local to this process: it does not itself
+// detect an external edit to the annotation, so anything that can cause one
+// (a SIGHUP resync, watchNodeForChanges noticing the Node was modified or
+// deleted) must call invalidateNodeIdAnnotationCache first, forcing the next
+// getVerifyAndAddNodeId call for that driver to pay for a real Get rather
+// than trusting a cached value that may now be wrong.
+var nodeIdAnnotationCache = struct {
+	mu      sync.Mutex
+	applied map[nodeIdAnnotationCacheKey]string // -> last-confirmed csiDriverNodeId
+}{applied: map[nodeIdAnnotationCacheKey]string{}}
+
+// invalidateNodeIdAnnotationCache drops csiDriverName's entries (under every
+// annotation key it writes, see --additional-nodeid-annotation-key) from
+// nodeIdAnnotationCache, so the next getVerifyAndAddNodeId call for that
+// driver does a real Get instead of trusting a cached value that something
+// else may have invalidated.
+func invalidateNodeIdAnnotationCache(csiDriverName string) {
+	nodeIdAnnotationCache.mu.Lock()
+	for key := range nodeIdAnnotationCache.applied {
+		if key.driverName == csiDriverName {
+			delete(nodeIdAnnotationCache.applied, key)
+		}
+	}
+	nodeIdAnnotationCache.mu.Unlock()
+}
+
+// nodeIdAnnotationCacheSkips counts how many times getVerifyAndAddNodeId
+// skipped its Get/patch because nodeIdAnnotationCache already matched.
+var nodeIdAnnotationCacheSkips uint64
+
+// errNodeNotFound is returned by getVerifyAndAddNodeId when the Node object
+// itself no longer exists (e.g. it was deleted from the cluster while this
+// process kept running), so runAnnotationLoop can tell "nothing to do this
+// iteration" apart from a retryable failure and skip it quietly instead of
+// logging an error and counting it against consecutiveFailures forever.
+var errNodeNotFound = stderrors.New("node not found")
+
 func getVerifyAndAddNodeId(
 	k8sNodeName string,
 	k8sNodesClient corev1.NodeInterface,
 	csiDriverName string,
 	csiDriverNodeId string,
+	nodeIdAnnotation string,
 ) error {
+	cacheKey := nodeIdAnnotationCacheKey{driverName: csiDriverName, annotation: nodeIdAnnotation}
+	nodeIdAnnotationCache.mu.Lock()
+	cachedNodeId, cached := nodeIdAnnotationCache.applied[cacheKey]
+	nodeIdAnnotationCache.mu.Unlock()
+	if cached && cachedNodeId == csiDriverNodeId {
+		atomic.AddUint64(&nodeIdAnnotationCacheSkips, 1)
+		glog.V(4).Infof(
+			"Node %q annotation %q already has the current node ID for CSI driver %q cached locally, skipping Get",
+			k8sNodeName, nodeIdAnnotation, csiDriverName)
+		return nil
+	}
+
 	// Add or update annotation on Node object
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+	retryErr := retry.RetryOnConflict(nodeUpdateBackoff(), func() error {
 		// Retrieve the latest version of Node before attempting update, so that
 		// existing changes are not overwritten. RetryOnConflict uses
 		// exponential backoff to avoid exhausting the apiserver.
 		result, getErr := k8sNodesClient.Get(k8sNodeName, metav1.GetOptions{})
+		if errors.IsNotFound(getErr) {
+			return getErr // do not wrap error; handled specially below
+		}
 		if getErr != nil {
 			glog.Errorf("Failed to get latest version of Node: %v", getErr)
 			return getErr // do not wrap error
@@ -171,75 +1960,241 @@ func getVerifyAndAddNodeId(
 		var previousAnnotationValue string
 		if result.ObjectMeta.Annotations != nil {
 			previousAnnotationValue =
-				result.ObjectMeta.Annotations[annotationKey]
+				result.ObjectMeta.Annotations[nodeIdAnnotation]
 			glog.V(3).Infof(
 				"previousAnnotationValue=%q", previousAnnotationValue)
 		}
 
-		existingDriverMap := map[string]string{}
-		if previousAnnotationValue != "" {
-			// Parse previousAnnotationValue as JSON
-			if err := json.Unmarshal([]byte(previousAnnotationValue), &existingDriverMap); err != nil {
+		existingDriverMap, err := decodeAnnotationValue(previousAnnotationValue, csiDriverName)
+		if err != nil {
+			if !*repairCorruptAnnotation {
 				return fmt.Errorf(
-					"Failed to parse node's %q annotation value (%q) err=%v",
-					annotationKey,
+					"Failed to parse node's %q annotation value (%q) err=%v; set --repair-corrupt-annotation to overwrite it instead of failing indefinitely",
+					nodeIdAnnotation,
 					previousAnnotationValue,
 					err)
 			}
+			glog.Warningf(
+				"Node %q annotation %q value %q is corrupt (%v); --repair-corrupt-annotation is set, so it will be overwritten with a fresh entry",
+				k8sNodeName, nodeIdAnnotation, previousAnnotationValue, err)
+			existingDriverMap = map[string][]string{}
 		}
 
-		if val, ok := existingDriverMap[csiDriverName]; ok {
-			if val == csiDriverNodeId {
-				// Value already exists in node annotation, nothing more to do
-				glog.V(1).Infof(
-					"The key value {%q: %q} alredy eixst in node %q annotation, no need to update: %v",
-					csiDriverName,
-					csiDriverNodeId,
-					annotationKey,
-					previousAnnotationValue)
-				return nil
-			}
+		// Merge the node IDs the driver just reported into any node IDs
+		// already stored for it, rather than overwriting them, so that a
+		// multi-node-id driver (see connection.CSIConnection.NodeGetIds)
+		// that reports a different subset of its IDs across restarts does
+		// not lose previously-registered ones.
+		mergedNodeIds := mergeNodeIds(existingDriverMap[csiDriverName], connection.SplitNodeIds(csiDriverNodeId))
+		if stringSlicesEqual(existingDriverMap[csiDriverName], mergedNodeIds) {
+			// Value already exists in node annotation, nothing more to do
+			glog.V(1).Infof(
+				"The key value {%q: %q} alredy eixst in node %q annotation, no need to update: %v",
+				csiDriverName,
+				csiDriverNodeId,
+				nodeIdAnnotation,
+				previousAnnotationValue)
+			nodeIdAnnotationCache.mu.Lock()
+			nodeIdAnnotationCache.applied[cacheKey] = csiDriverNodeId
+			nodeIdAnnotationCache.mu.Unlock()
+			return nil
 		}
 
 		// Add/update annotation value
-		existingDriverMap[csiDriverName] = csiDriverNodeId
-		jsonObj, err := json.Marshal(existingDriverMap)
+		existingDriverMap[csiDriverName] = mergedNodeIds
+		encodedValue, err := encodeAnnotationValue(existingDriverMap)
 		if err != nil {
 			return fmt.Errorf(
 				"Failed while trying to add key value {%q: %q} to node %q annotation. Existing value: %v",
 				csiDriverName,
 				csiDriverNodeId,
-				annotationKey,
+				nodeIdAnnotation,
 				previousAnnotationValue)
 		}
 
-		result.ObjectMeta.Annotations = cloneAndAddAnnotation(
-			result.ObjectMeta.Annotations,
-			annotationKey,
-			string(jsonObj))
-		_, updateErr := k8sNodesClient.Update(result)
-		if updateErr == nil {
+		if err := validateAnnotationSize(nodeIdAnnotation, encodedValue, len(existingDriverMap), *maxAnnotationBytes); err != nil {
+			return err
+		}
+
+		if *dryRun {
+			glog.Infof(
+				"dry-run: would update node %q annotation %q from %q to %q",
+				k8sNodeName,
+				nodeIdAnnotation,
+				previousAnnotationValue,
+				encodedValue)
+			return nil
+		}
+
+		patchErr := patchNodeAnnotation(k8sNodesClient, k8sNodeName, nodeIdAnnotation, encodedValue)
+		if patchErr == nil {
 			fmt.Printf(
 				"Updated node %q successfully for CSI driver %q and CSI node name %q",
 				k8sNodeName,
 				csiDriverName,
 				csiDriverNodeId)
+			nodeIdAnnotationCache.mu.Lock()
+			nodeIdAnnotationCache.applied[cacheKey] = csiDriverNodeId
+			nodeIdAnnotationCache.mu.Unlock()
 		}
-		return updateErr // do not wrap error
+		return patchErr // do not wrap error
 	})
 	if retryErr != nil {
+		// Whatever this process thought was already applied may not be; drop
+		// it from the cache rather than risk skipping a Get that could have
+		// corrected it.
+		nodeIdAnnotationCache.mu.Lock()
+		delete(nodeIdAnnotationCache.applied, cacheKey)
+		nodeIdAnnotationCache.mu.Unlock()
+		if errors.IsNotFound(retryErr) {
+			glog.V(1).Infof("Node %q not found while updating annotation %q for CSI driver %q; it was likely deleted from the cluster, skipping this iteration", k8sNodeName, nodeIdAnnotation, csiDriverName)
+			return errNodeNotFound
+		}
 		return fmt.Errorf("Node update failed: %v", retryErr)
 	}
 	return nil
 }
 
+// reconcileStaleNodeId overwrites csiDriverName's entry in the node-id
+// annotation with exactly csiDriverNodeId's current set of IDs, if what's
+// stored there differs. It exists because the steady-state registration
+// path, getVerifyAndAddNodeId, only ever merges node IDs in (see
+// mergeNodeIds), to tolerate a driver that reports a different subset of
+// its own IDs across restarts; that means a node ID this driver wrote under
+// a previous incarnation - e.g. before a topology change, or before a
+// crash that skipped --deregister-on-shutdown's cleanup because it runs
+// from a signal handler SIGKILL bypasses - is never cleaned up on its own.
+// --reconcile-stale-on-startup calls this once before the annotation loop
+// starts, to self-heal any such leftovers.
+//
+// Like getVerifyAndAddNodeId and getVerifyAndDeleteNodeId, this only ever
+// touches csiDriverName's own entry; other drivers' entries in the same
+// annotation, and any other part of the Node object, are left untouched. A
+// corrupt existing annotation value is left alone for
+// --repair-corrupt-annotation to deal with instead of being overwritten
+// here, since this is a best-effort self-heal, not the primary write path.
+func reconcileStaleNodeId(
+	k8sNodeName string,
+	k8sNodesClient corev1.NodeInterface,
+	csiDriverName string,
+	csiDriverNodeId string,
+	nodeIdAnnotation string,
+) error {
+	if csiDriverNodeId == "" {
+		return nil
+	}
+	currentIds := connection.SplitNodeIds(csiDriverNodeId)
+
+	retryErr := retry.RetryOnConflict(nodeUpdateBackoff(), func() error {
+		result, getErr := k8sNodesClient.Get(k8sNodeName, metav1.GetOptions{})
+		if getErr != nil {
+			glog.Errorf("Failed to get latest version of Node: %v", getErr)
+			return getErr // do not wrap error
+		}
+
+		var previousAnnotationValue string
+		if result.ObjectMeta.Annotations != nil {
+			previousAnnotationValue = result.ObjectMeta.Annotations[nodeIdAnnotation]
+		}
+		if previousAnnotationValue == "" {
+			return nil
+		}
+
+		existingDriverMap, err := decodeAnnotationValue(previousAnnotationValue, csiDriverName)
+		if err != nil {
+			glog.Warningf(
+				"Node %q annotation %q value %q is corrupt, leaving it for --repair-corrupt-annotation instead of reconciling: %v",
+				k8sNodeName, nodeIdAnnotation, previousAnnotationValue, err)
+			return nil
+		}
+
+		storedIds, ok := existingDriverMap[csiDriverName]
+		if !ok || stringSliceSetEqual(storedIds, currentIds) {
+			return nil
+		}
+
+		glog.Warningf(
+			"Node %q annotation %q has stale node ID(s) %v for CSI driver %q, which currently reports %v; reconciling",
+			k8sNodeName, nodeIdAnnotation, storedIds, csiDriverName, currentIds)
+
+		existingDriverMap[csiDriverName] = currentIds
+		encodedValue, err := encodeAnnotationValue(existingDriverMap)
+		if err != nil {
+			return fmt.Errorf(
+				"failed to re-encode node %q annotation %q while reconciling stale node ID(s) for CSI driver %q: %v",
+				k8sNodeName, nodeIdAnnotation, csiDriverName, err)
+		}
+
+		if err := validateAnnotationSize(nodeIdAnnotation, encodedValue, len(existingDriverMap), *maxAnnotationBytes); err != nil {
+			return err
+		}
+
+		if *dryRun {
+			glog.Infof(
+				"dry-run: would reconcile node %q annotation %q from %q to %q",
+				k8sNodeName, nodeIdAnnotation, previousAnnotationValue, encodedValue)
+			return nil
+		}
+
+		return patchNodeAnnotation(k8sNodesClient, k8sNodeName, nodeIdAnnotation, encodedValue)
+	})
+	if retryErr != nil {
+		return fmt.Errorf("failed to reconcile stale node ID(s) for CSI driver %q: %v", csiDriverName, retryErr)
+	}
+	return nil
+}
+
+// deregisterNodeIdWithRetry calls getVerifyAndDeleteNodeId up to attempts
+// times, waiting interval between each failed attempt, and returns the
+// error from the final attempt if none of them succeeded.
+// getVerifyAndDeleteNodeId already retries a Conflict error internally (see
+// nodeUpdateBackoff); this retries the call as a whole on top of that, for
+// a failure that isn't a Conflict, such as the apiserver being briefly
+// unreachable during the same outage that is taking this process down.
+// attempts <= 1 makes exactly one attempt with no retries.
+func deregisterNodeIdWithRetry(
+	k8sNodeName string,
+	k8sNodesClient corev1.NodeInterface,
+	csiDriverName string,
+	expectedNodeId string,
+	forceDeregister bool,
+	nodeIdAnnotation string,
+	attempts int,
+	interval time.Duration) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		lastErr = getVerifyAndDeleteNodeId(k8sNodeName, k8sNodesClient, csiDriverName, expectedNodeId, forceDeregister, nodeIdAnnotation)
+		if lastErr == nil {
+			return nil
+		}
+		if attempt < attempts {
+			glog.Warningf("Attempt %d/%d to remove node-id annotation entry for driver %q failed, retrying in %s: %v", attempt, attempts, csiDriverName, interval, lastErr)
+			time.Sleep(interval)
+		}
+	}
+	return lastErr
+}
+
 // Fetches Kubernetes node API object corresponding to k8sNodeName.
-// If the csiDriverName is present in the node annotation, it is removed.
+// If the csiDriverName is present in the node annotation, it is removed,
+// unless its stored value does not match expectedNodeId (this process's own
+// discovered node ID) and forceDeregister is false, in which case the entry
+// is left alone and a warning is logged. This guards against a different
+// registrar's entry being cleared out from under it, which could otherwise
+// happen if a Node object is reused (e.g. after a botched node rename)
+// while that other registrar is still running under the node ID it
+// originally wrote.
 func getVerifyAndDeleteNodeId(
 	k8sNodeName string,
 	k8sNodesClient corev1.NodeInterface,
-	csiDriverName string) error {
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+	csiDriverName string,
+	expectedNodeId string,
+	forceDeregister bool,
+	nodeIdAnnotation string) error {
+	retryErr := retry.RetryOnConflict(nodeUpdateBackoff(), func() error {
 		// Retrieve the latest version of Node before attempting update, so that
 		// existing changes are not overwritten. RetryOnConflict uses
 		// exponential backoff to avoid exhausting the apiserver.
@@ -252,63 +2207,75 @@ func getVerifyAndDeleteNodeId(
 		var previousAnnotationValue string
 		if result.ObjectMeta.Annotations != nil {
 			previousAnnotationValue =
-				result.ObjectMeta.Annotations[annotationKey]
+				result.ObjectMeta.Annotations[nodeIdAnnotation]
 			glog.V(3).Infof(
 				"previousAnnotationValue=%q", previousAnnotationValue)
 		}
 
-		existingDriverMap := map[string]string{}
 		if previousAnnotationValue == "" {
 			// Value already exists in node annotation, nothing more to do
 			glog.V(1).Infof(
 				"The key %q does not exist in node %q annotation, no need to cleanup.",
 				csiDriverName,
-				annotationKey)
+				nodeIdAnnotation)
 			return nil
 		}
 
-		// Parse previousAnnotationValue as JSON
-		if err := json.Unmarshal([]byte(previousAnnotationValue), &existingDriverMap); err != nil {
-			return fmt.Errorf(
-				"Failed to parse node's %q annotation value (%q) err=%v",
-				annotationKey,
-				previousAnnotationValue,
-				err)
+		existingDriverMap, err := decodeAnnotationValue(previousAnnotationValue, csiDriverName)
+		if err != nil {
+			glog.Warningf(
+				"Node %q annotation %q value %q is corrupt (%v); treating it as empty for deregistration",
+				k8sNodeName, nodeIdAnnotation, previousAnnotationValue, err)
+			existingDriverMap = map[string][]string{}
 		}
 
-		if _, ok := existingDriverMap[csiDriverName]; !ok {
+		storedNodeId, ok := existingDriverMap[csiDriverName]
+		if !ok {
 			// Value already exists in node annotation, nothing more to do
 			glog.V(1).Infof(
 				"The key %q does not eixst in node %q annotation, no need to cleanup: %v",
 				csiDriverName,
-				annotationKey,
+				nodeIdAnnotation,
 				previousAnnotationValue)
 			return nil
 		}
 
+		if !stringSliceSetEqual(storedNodeId, connection.SplitNodeIds(expectedNodeId)) && !forceDeregister {
+			glog.Warningf(
+				"Node %q annotation %q has CSI driver %q registered under node ID %q, which does not match this process's own discovered node ID %q; not removing it, since it likely belongs to another registrar that reused this Node object. Set --force-deregister to remove it anyway.",
+				k8sNodeName, nodeIdAnnotation, csiDriverName, storedNodeId, expectedNodeId)
+			return nil
+		}
+
 		// Add/update annotation value
 		delete(existingDriverMap, csiDriverName)
-		jsonObj, err := json.Marshal(existingDriverMap)
+		encodedValue, err := encodeAnnotationValue(existingDriverMap)
 		if err != nil {
 			return fmt.Errorf(
 				"Failed while trying to remove key %q from node %q annotation. Existing data: %v",
 				csiDriverName,
-				annotationKey,
+				nodeIdAnnotation,
 				previousAnnotationValue)
 		}
 
-		result.ObjectMeta.Annotations = cloneAndAddAnnotation(
-			result.ObjectMeta.Annotations,
-			annotationKey,
-			string(jsonObj))
-		_, updateErr := k8sNodesClient.Update(result)
-		if updateErr == nil {
+		if *dryRun {
+			glog.Infof(
+				"dry-run: would update node %q annotation %q from %q to %q",
+				k8sNodeName,
+				nodeIdAnnotation,
+				previousAnnotationValue,
+				encodedValue)
+			return nil
+		}
+
+		patchErr := patchNodeAnnotation(k8sNodesClient, k8sNodeName, nodeIdAnnotation, encodedValue)
+		if patchErr == nil {
 			fmt.Printf(
 				"Updated node %q annotation to remove CSI driver %q.",
 				k8sNodeName,
 				csiDriverName)
 		}
-		return updateErr // do not wrap error
+		return patchErr // do not wrap error
 	})
 	if retryErr != nil {
 		return fmt.Errorf("Node update failed: %v", retryErr)
@@ -316,6 +2283,25 @@ func getVerifyAndDeleteNodeId(
 	return nil
 }
 
+// patchNodeAnnotation sets a single annotation on the Node object via a
+// strategic merge patch, touching only that one field. Unlike a full
+// Update of the object fetched by the caller, this cannot clobber labels
+// or other annotations changed concurrently by another controller.
+func patchNodeAnnotation(k8sNodesClient corev1.NodeInterface, k8sNodeName, annotationKey, annotationValue string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				annotationKey: annotationValue,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to build annotation patch: %v", err)
+	}
+	_, err = k8sNodesClient.Patch(k8sNodeName, types.StrategicMergePatchType, patch)
+	return err
+}
+
 // Clones the given map and returns a new map with the given key and value added.
 // Returns the given map, if annotationKey is empty.
 func cloneAndAddAnnotation(
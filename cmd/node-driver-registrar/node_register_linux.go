@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// abstractSocketsSupported is true on Linux, the only OS with
+// abstract-namespace unix sockets.
+const abstractSocketsSupported = true
+
+// abstractSocketAddress turns socketPath into the net.Listen address for a
+// Linux abstract-namespace socket sharing that name: a leading "@", which
+// the net package maps to a NUL byte in sun_path, placing the socket outside
+// the filesystem entirely. There is nothing at socketPath itself to stat,
+// chmod, or remove when a stale instance is being cleaned up.
+func abstractSocketAddress(socketPath string) string {
+	return "@" + socketPath
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// abstractSocketsSupported is false on every OS but Linux; see
+// node_register_linux.go. validateRegistrationSocketType rejects
+// --registration-socket-type=abstract before abstractSocketAddress is ever
+// called on such a build.
+const abstractSocketsSupported = false
+
+// abstractSocketAddress is unreachable on a non-Linux build: see
+// abstractSocketsSupported.
+func abstractSocketAddress(socketPath string) string {
+	panic("abstractSocketAddress called without abstractSocketsSupported")
+}
@@ -0,0 +1,2460 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/watch"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	registerapi "k8s.io/kubernetes/pkg/kubelet/apis/pluginregistration/v1alpha1"
+
+	"github.com/kubernetes-csi/node-driver-registrar/pkg/connection"
+	"github.com/kubernetes-csi/node-driver-registrar/pkg/connection/fake"
+)
+
+const testNodeName = "test-node"
+
+// resetNodeIdAnnotationCacheForTest clears nodeIdAnnotationCache and its
+// skip counter. Tests call this before exercising getVerifyAndAddNodeId so
+// that cached state left behind by an earlier test (or an earlier call in
+// the same test) can't cause it to skip its Get/patch unexpectedly.
+func resetNodeIdAnnotationCacheForTest() {
+	nodeIdAnnotationCache.mu.Lock()
+	nodeIdAnnotationCache.applied = map[nodeIdAnnotationCacheKey]string{}
+	nodeIdAnnotationCache.mu.Unlock()
+	atomic.StoreUint64(&nodeIdAnnotationCacheSkips, 0)
+}
+
+// mockNodeClient is a minimal in-memory corev1.NodeInterface covering just
+// the Get/Update/Patch calls getVerifyAndAddNodeId and
+// getVerifyAndDeleteNodeId make, for tests that don't need a real API
+// server.
+type mockNodeClient struct {
+	node     *v1.Node
+	getCalls int
+
+	// forcedGetErr, if set, is returned by every Get call instead of the
+	// usual lookup, to simulate a persistent (non-Conflict) apiserver
+	// failure that retry.RetryOnConflict will not itself retry.
+	forcedGetErr error
+
+	// lastPatchType and lastPatchData record the most recent Patch call's
+	// arguments, for tests asserting which patch type patchNodeAnnotation
+	// actually sent and what it contained.
+	lastPatchType types.PatchType
+	lastPatchData []byte
+
+	// stripKeyOnUpdate, if set, is removed from both the stored and the
+	// returned node's Annotations and Labels on every Update call, after
+	// the update is otherwise applied and with a nil error returned. This
+	// simulates a mutating admission webhook silently stripping a field a
+	// caller just wrote, for tests of the post-Update verification in
+	// functions like getVerifyAndSetNodeIdLabel.
+	stripKeyOnUpdate string
+}
+
+var _ corev1.NodeInterface = &mockNodeClient{}
+
+func (m *mockNodeClient) Get(name string, options metav1.GetOptions) (*v1.Node, error) {
+	m.getCalls++
+	if m.forcedGetErr != nil {
+		return nil, m.forcedGetErr
+	}
+	if m.node == nil || m.node.Name != name {
+		return nil, errors.NewNotFound(v1.Resource("nodes"), name)
+	}
+	return m.node.DeepCopy(), nil
+}
+
+func (m *mockNodeClient) Update(node *v1.Node) (*v1.Node, error) {
+	m.node = node.DeepCopy()
+	if m.stripKeyOnUpdate != "" {
+		delete(m.node.Annotations, m.stripKeyOnUpdate)
+		delete(m.node.Labels, m.stripKeyOnUpdate)
+	}
+	return m.node.DeepCopy(), nil
+}
+
+func (m *mockNodeClient) Create(node *v1.Node) (*v1.Node, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (m *mockNodeClient) UpdateStatus(node *v1.Node) (*v1.Node, error) {
+	m.node = node.DeepCopy()
+	return m.node.DeepCopy(), nil
+}
+
+func (m *mockNodeClient) Delete(name string, options *metav1.DeleteOptions) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (m *mockNodeClient) DeleteCollection(options *metav1.DeleteOptions, listOptions metav1.ListOptions) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (m *mockNodeClient) List(opts metav1.ListOptions) (*v1.NodeList, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (m *mockNodeClient) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// Patch applies a strategic merge patch of the shape produced by
+// patchNodeAnnotation, merging the given annotations into the stored node
+// without touching any other field (in particular, Labels).
+func (m *mockNodeClient) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (*v1.Node, error) {
+	m.lastPatchType = pt
+	m.lastPatchData = data
+	if m.node == nil || m.node.Name != name {
+		return nil, errors.NewNotFound(v1.Resource("nodes"), name)
+	}
+	if pt != types.StrategicMergePatchType {
+		return nil, fmt.Errorf("unsupported patch type %q", pt)
+	}
+
+	var patch struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, fmt.Errorf("failed to parse patch: %v", err)
+	}
+
+	m.node = m.node.DeepCopy()
+	if m.node.Annotations == nil {
+		m.node.Annotations = map[string]string{}
+	}
+	for k, v := range patch.Metadata.Annotations {
+		m.node.Annotations[k] = v
+	}
+	return m.node.DeepCopy(), nil
+}
+
+func (m *mockNodeClient) PatchStatus(nodeName string, data []byte) (*v1.Node, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func newTestNode(annotations map[string]string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        testNodeName,
+			Annotations: annotations,
+		},
+	}
+}
+
+// mockConfigMapClient is a minimal in-memory corev1.ConfigMapInterface
+// covering just the Get/Create/Update calls tryAcquireOrRenewLock makes, for
+// tests that don't need a real API server.
+type mockConfigMapClient struct {
+	cm *v1.ConfigMap
+}
+
+var _ corev1.ConfigMapInterface = &mockConfigMapClient{}
+
+func (m *mockConfigMapClient) Get(name string, options metav1.GetOptions) (*v1.ConfigMap, error) {
+	if m.cm == nil || m.cm.Name != name {
+		return nil, errors.NewNotFound(v1.Resource("configmaps"), name)
+	}
+	return m.cm.DeepCopy(), nil
+}
+
+func (m *mockConfigMapClient) Create(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	if m.cm != nil && m.cm.Name == cm.Name {
+		return nil, errors.NewAlreadyExists(v1.Resource("configmaps"), cm.Name)
+	}
+	m.cm = cm.DeepCopy()
+	return m.cm.DeepCopy(), nil
+}
+
+func (m *mockConfigMapClient) Update(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	m.cm = cm.DeepCopy()
+	return m.cm.DeepCopy(), nil
+}
+
+func (m *mockConfigMapClient) Delete(name string, options *metav1.DeleteOptions) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (m *mockConfigMapClient) DeleteCollection(options *metav1.DeleteOptions, listOptions metav1.ListOptions) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (m *mockConfigMapClient) List(opts metav1.ListOptions) (*v1.ConfigMapList, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (m *mockConfigMapClient) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (m *mockConfigMapClient) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (*v1.ConfigMap, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func TestGetVerifyAndAddNodeId(t *testing.T) {
+	tests := []struct {
+		name                string
+		existingAnnotations map[string]string
+		driverName          string
+		nodeID              string
+		wantDriverMap       map[string]string
+	}{
+		{
+			name:          "no existing annotation",
+			driverName:    "csi.example.com",
+			nodeID:        "node-1",
+			wantDriverMap: map[string]string{"csi.example.com": "node-1"},
+		},
+		{
+			name: "preserves other drivers",
+			existingAnnotations: map[string]string{
+				defaultAnnotationKey: `{"other.example.com":"node-0"}`,
+			},
+			driverName:    "csi.example.com",
+			nodeID:        "node-1",
+			wantDriverMap: map[string]string{"other.example.com": "node-0", "csi.example.com": "node-1"},
+		},
+		{
+			name: "already up to date is a no-op",
+			existingAnnotations: map[string]string{
+				defaultAnnotationKey: `{"csi.example.com":"node-1"}`,
+			},
+			driverName:    "csi.example.com",
+			nodeID:        "node-1",
+			wantDriverMap: map[string]string{"csi.example.com": "node-1"},
+		},
+	}
+
+	for _, test := range tests {
+		resetNodeIdAnnotationCacheForTest()
+		client := &mockNodeClient{node: newTestNode(test.existingAnnotations)}
+
+		err := getVerifyAndAddNodeId(
+			testNodeName,
+			client,
+			test.driverName,
+			test.nodeID,
+			defaultAnnotationKey)
+		if err != nil {
+			t.Errorf("test %q: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		gotDriverMap := map[string]string{}
+		if err := json.Unmarshal([]byte(client.node.Annotations[defaultAnnotationKey]), &gotDriverMap); err != nil {
+			t.Fatalf("test %q: failed to parse annotation: %v", test.name, err)
+		}
+
+		if len(gotDriverMap) != len(test.wantDriverMap) {
+			t.Errorf("test %q: got %v, want %v", test.name, gotDriverMap, test.wantDriverMap)
+		}
+		for k, v := range test.wantDriverMap {
+			if gotDriverMap[k] != v {
+				t.Errorf("test %q: got %v, want %v", test.name, gotDriverMap, test.wantDriverMap)
+			}
+		}
+	}
+}
+
+// TestGetVerifyAndAddNodeIdMultipleAnnotationKeys covers
+// --additional-nodeid-annotation-key: writing the same driver's node ID to a
+// second annotation key, in the same loop iteration as the primary key, must
+// succeed for both, and the nodeIdAnnotationCache must track the two keys
+// independently (a cache hit on one must not cause the other's write to be
+// skipped).
+func TestGetVerifyAndAddNodeIdMultipleAnnotationKeys(t *testing.T) {
+	resetNodeIdAnnotationCacheForTest()
+	const secondKey = "csi.volume.kubernetes.io/nodeid-v2"
+	client := &mockNodeClient{node: newTestNode(map[string]string{})}
+
+	for _, key := range []string{defaultAnnotationKey, secondKey} {
+		if err := getVerifyAndAddNodeId(testNodeName, client, "csi.example.com", "node-1", key); err != nil {
+			t.Fatalf("unexpected error writing key %q: %v", key, err)
+		}
+	}
+
+	for _, key := range []string{defaultAnnotationKey, secondKey} {
+		gotDriverMap := map[string]string{}
+		if err := json.Unmarshal([]byte(client.node.Annotations[key]), &gotDriverMap); err != nil {
+			t.Fatalf("failed to parse annotation %q: %v", key, err)
+		}
+		if gotDriverMap["csi.example.com"] != "node-1" {
+			t.Errorf("key %q: got %v, want csi.example.com=node-1", key, gotDriverMap)
+		}
+	}
+
+	// A second pass should be a no-op skip for both keys (served from
+	// nodeIdAnnotationCache), not a missed write for the second key because
+	// the first key's entry already satisfied a shared cache key.
+	getCallsBefore := client.getCalls
+	for _, key := range []string{defaultAnnotationKey, secondKey} {
+		if err := getVerifyAndAddNodeId(testNodeName, client, "csi.example.com", "node-1", key); err != nil {
+			t.Fatalf("unexpected error on repeat write to key %q: %v", key, err)
+		}
+	}
+	if client.getCalls != getCallsBefore {
+		t.Errorf("expected both keys' repeat writes to be served from cache with no additional Get calls, got %d new calls", client.getCalls-getCallsBefore)
+	}
+}
+
+// TestGetVerifyAndAddNodeIdNodeDeleted covers the case where the Node
+// object has been removed from the cluster (e.g. the node itself was
+// deleted) while this process keeps running: getVerifyAndAddNodeId should
+// report errNodeNotFound instead of an ordinary error, so runAnnotationLoop
+// can skip the iteration quietly rather than retrying forever. This stands
+// in for exercising a real fake clientset, which this vendor snapshot lacks
+// (k8s.io/client-go/kubernetes/fake is unbuildable here, missing
+// go-spew); mockNodeClient's NotFound behavior for an absent node already
+// matches what that fake would do for the same scenario.
+func TestGetVerifyAndAddNodeIdNodeDeleted(t *testing.T) {
+	resetNodeIdAnnotationCacheForTest()
+	client := &mockNodeClient{} // no node set: every Get returns NotFound
+
+	err := getVerifyAndAddNodeId(testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey)
+	if err == nil {
+		t.Fatal("expected an error for a deleted Node object")
+	}
+	if !stderrors.Is(err, errNodeNotFound) {
+		t.Errorf("expected errNodeNotFound, got %v", err)
+	}
+}
+
+// TestGetVerifyAndSetMaxVolumesPerNode covers --volume-limits-mode=annotation
+// (the default): max volumes per node is stored in the
+// --maxvolumes-annotation-key map, keyed by driver name.
+func TestGetVerifyAndSetMaxVolumesPerNode(t *testing.T) {
+	client := &mockNodeClient{node: newTestNode(map[string]string{})}
+
+	if err := getVerifyAndSetMaxVolumesPerNode(testNodeName, client, "csi.example.com", 10); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	gotMap := map[string]int64{}
+	if err := json.Unmarshal([]byte(client.node.Annotations[defaultMaxVolumesAnnotationKey]), &gotMap); err != nil {
+		t.Fatalf("failed to parse annotation: %v", err)
+	}
+	if gotMap["csi.example.com"] != 10 {
+		t.Errorf("got %v, want csi.example.com=10", gotMap)
+	}
+
+	// Repeating the same value is a no-op: no additional Get beyond the one
+	// already made above plus this call's own Get.
+	getCallsBefore := client.getCalls
+	if err := getVerifyAndSetMaxVolumesPerNode(testNodeName, client, "csi.example.com", 10); err != nil {
+		t.Fatalf("unexpected error on repeat call: %v", err)
+	}
+	if client.getCalls != getCallsBefore+1 {
+		t.Errorf("expected exactly one additional Get call, got %d", client.getCalls-getCallsBefore)
+	}
+}
+
+// TestGetVerifyAndSetMaxVolumesNodeStatus covers --volume-limits-mode=status:
+// max volumes per node is published as an "attachable-volumes-<driver>"
+// entry in the Node object's status Capacity and Allocatable instead of the
+// annotation.
+func TestGetVerifyAndSetMaxVolumesNodeStatus(t *testing.T) {
+	client := &mockNodeClient{node: newTestNode(map[string]string{})}
+	resourceName := v1.ResourceName(v1.ResourceAttachableVolumesPrefix + "csi.example.com")
+
+	if err := getVerifyAndSetMaxVolumesNodeStatus(testNodeName, client, "csi.example.com", 10); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	gotCapacity, ok := client.node.Status.Capacity[resourceName]
+	if !ok || gotCapacity.Value() != 10 {
+		t.Errorf("got capacity %v, want %s=10", client.node.Status.Capacity, resourceName)
+	}
+	gotAllocatable, ok := client.node.Status.Allocatable[resourceName]
+	if !ok || gotAllocatable.Value() != 10 {
+		t.Errorf("got allocatable %v, want %s=10", client.node.Status.Allocatable, resourceName)
+	}
+
+	// The annotation map must be untouched in status mode.
+	if _, ok := client.node.Annotations[defaultMaxVolumesAnnotationKey]; ok {
+		t.Errorf("expected no %q annotation to be written in status mode, got %v", defaultMaxVolumesAnnotationKey, client.node.Annotations)
+	}
+
+	// Repeating the same value is a no-op: no additional Get beyond the one
+	// already made above plus this call's own Get.
+	getCallsBefore := client.getCalls
+	if err := getVerifyAndSetMaxVolumesNodeStatus(testNodeName, client, "csi.example.com", 10); err != nil {
+		t.Fatalf("unexpected error on repeat call: %v", err)
+	}
+	if client.getCalls != getCallsBefore+1 {
+		t.Errorf("expected exactly one additional Get call, got %d", client.getCalls-getCallsBefore)
+	}
+}
+
+func TestValidateAnnotationSize(t *testing.T) {
+	if err := validateAnnotationSize(defaultAnnotationKey, strings.Repeat("a", 100), 1, 1000); err != nil {
+		t.Errorf("expected a value under the limit to be accepted, got: %v", err)
+	}
+	if err := validateAnnotationSize(defaultAnnotationKey, strings.Repeat("a", 1000), 1, 1000); err != nil {
+		t.Errorf("expected a value exactly at the limit to be accepted, got: %v", err)
+	}
+	if err := validateAnnotationSize(defaultAnnotationKey, strings.Repeat("a", 1001), 5, 1000); err == nil {
+		t.Error("expected a value over the limit to be rejected")
+	}
+}
+
+// TestGetVerifyAndAddNodeIdRejectsOversizedAnnotation constructs a node-id
+// map large enough to exceed a small --max-annotation-bytes, to exercise the
+// validateAnnotationSize guard from getVerifyAndAddNodeId itself, not just
+// in isolation.
+func TestGetVerifyAndAddNodeIdRejectsOversizedAnnotation(t *testing.T) {
+	resetNodeIdAnnotationCacheForTest()
+	oldMax := *maxAnnotationBytes
+	*maxAnnotationBytes = 200
+	defer func() { *maxAnnotationBytes = oldMax }()
+
+	existing := map[string]interface{}{}
+	for i := 0; i < 50; i++ {
+		existing[fmt.Sprintf("csi-%d.example.com", i)] = fmt.Sprintf("node-%d", i)
+	}
+	existingJSON, err := json.Marshal(existing)
+	if err != nil {
+		t.Fatalf("failed to build fixture annotation: %v", err)
+	}
+	client := &mockNodeClient{node: newTestNode(map[string]string{
+		defaultAnnotationKey: string(existingJSON),
+	})}
+
+	err = getVerifyAndAddNodeId(testNodeName, client, "csi.example.com", "node-new", defaultAnnotationKey)
+	if err == nil {
+		t.Fatal("expected an error for an annotation value over --max-annotation-bytes")
+	}
+	if got := client.node.Annotations[defaultAnnotationKey]; got != string(existingJSON) {
+		t.Errorf("expected the Node object to be left unchanged, got annotation %q", got)
+	}
+}
+
+// TestGetVerifyAndAddNodeIdMergesMultipleIds covers a multi-node-id driver
+// (see connection.CSIConnection.NodeGetIds): re-registering with a
+// comma-separated node ID merges its entries into any already stored for
+// that driver, rather than discarding previously-registered ones.
+func TestGetVerifyAndAddNodeIdMergesMultipleIds(t *testing.T) {
+	resetNodeIdAnnotationCacheForTest()
+	client := &mockNodeClient{node: newTestNode(map[string]string{
+		defaultAnnotationKey: `{"csi.example.com":["node-1"]}`,
+	})}
+
+	if err := getVerifyAndAddNodeId(
+		testNodeName, client, "csi.example.com", "node-2,node-3", defaultAnnotationKey); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	gotDriverMap := map[string][]string{}
+	if err := json.Unmarshal([]byte(client.node.Annotations[defaultAnnotationKey]), &gotDriverMap); err != nil {
+		t.Fatalf("failed to parse annotation: %v", err)
+	}
+	if want := []string{"node-1", "node-2", "node-3"}; !stringSlicesEqual(gotDriverMap["csi.example.com"], want) {
+		t.Errorf("got %v, want %v", gotDriverMap["csi.example.com"], want)
+	}
+}
+
+// TestGetVerifyAndAddNodeIdCachesSuccessfulResult covers
+// nodeIdAnnotationCache: once getVerifyAndAddNodeId has confirmed a node ID
+// is stored for a driver, reporting that same node ID again should skip the
+// Get/patch entirely, since nodeRegister's annotation loop calls this on a
+// timer with an unchanged node ID in steady state.
+func TestGetVerifyAndAddNodeIdCachesSuccessfulResult(t *testing.T) {
+	resetNodeIdAnnotationCacheForTest()
+	client := &mockNodeClient{node: newTestNode(nil)}
+
+	if err := getVerifyAndAddNodeId(
+		testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey); err != nil {
+		t.Fatalf("unexpected error on first call: %v", err)
+	}
+	if client.getCalls != 1 {
+		t.Fatalf("expected exactly one Get on the first call, got %d", client.getCalls)
+	}
+	if got := atomic.LoadUint64(&nodeIdAnnotationCacheSkips); got != 0 {
+		t.Fatalf("expected no cache skips yet, got %d", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := getVerifyAndAddNodeId(
+			testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error on repeat call %d: %v", i, err)
+		}
+	}
+	if client.getCalls != 1 {
+		t.Errorf("expected repeat calls with an unchanged node ID to skip Get, but it was called %d times", client.getCalls)
+	}
+	if got, want := atomic.LoadUint64(&nodeIdAnnotationCacheSkips), uint64(3); got != want {
+		t.Errorf("expected the skip counter to be %d, got %d", want, got)
+	}
+
+	// A genuinely different node ID must not be skipped.
+	if err := getVerifyAndAddNodeId(
+		testNodeName, client, "csi.example.com", "node-2", defaultAnnotationKey); err != nil {
+		t.Fatalf("unexpected error reporting a changed node ID: %v", err)
+	}
+	if client.getCalls != 2 {
+		t.Errorf("expected a changed node ID to trigger a fresh Get, got %d total Get calls", client.getCalls)
+	}
+	if got, want := atomic.LoadUint64(&nodeIdAnnotationCacheSkips), uint64(3); got != want {
+		t.Errorf("expected the skip counter to stay at %d for a changed node ID, got %d", want, got)
+	}
+}
+
+// TestGetVerifyAndAddNodeIdCacheInvalidation covers the two bugs a warm
+// nodeIdAnnotationCache entry used to hide: a stripped annotation never
+// being restored, and a deleted Node never being reported as such. Both
+// depend on whatever triggered the re-check (watchNodeForChanges, SIGHUP)
+// calling invalidateNodeIdAnnotationCache first, the same way runAnnotationLoop's
+// nodeChanged case and handleResyncSignal do.
+func TestGetVerifyAndAddNodeIdCacheInvalidation(t *testing.T) {
+	t.Run("an invalidated cache entry lets a stripped annotation be restored", func(t *testing.T) {
+		resetNodeIdAnnotationCacheForTest()
+		client := &mockNodeClient{node: newTestNode(nil)}
+		if err := getVerifyAndAddNodeId(
+			testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error on first call: %v", err)
+		}
+		if client.getCalls != 1 {
+			t.Fatalf("expected exactly one Get on the first call, got %d", client.getCalls)
+		}
+
+		// Simulate another actor stripping the annotation back out from under
+		// a still-warm cache entry.
+		delete(client.node.Annotations, defaultAnnotationKey)
+
+		if err := getVerifyAndAddNodeId(
+			testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error on re-check: %v", err)
+		}
+		if client.getCalls != 1 {
+			t.Errorf("expected the re-check to still skip Get while the cache is warm, got %d Get calls", client.getCalls)
+		}
+		if _, ok := client.node.Annotations[defaultAnnotationKey]; ok {
+			t.Fatal("the stripped annotation should still be missing before the cache is invalidated")
+		}
+
+		invalidateNodeIdAnnotationCache("csi.example.com")
+		if err := getVerifyAndAddNodeId(
+			testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error after cache invalidation: %v", err)
+		}
+		if client.getCalls != 2 {
+			t.Errorf("expected the invalidated cache to force a fresh Get, got %d total Get calls", client.getCalls)
+		}
+		if _, ok := client.node.Annotations[defaultAnnotationKey]; !ok {
+			t.Error("expected the stripped annotation to be restored after cache invalidation, it is still missing")
+		}
+	})
+
+	t.Run("an invalidated cache entry lets a deleted Node be reported as not found", func(t *testing.T) {
+		resetNodeIdAnnotationCacheForTest()
+		client := &mockNodeClient{node: newTestNode(nil)}
+		if err := getVerifyAndAddNodeId(
+			testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error on first call: %v", err)
+		}
+
+		// Simulate the Node being deleted from the cluster out from under a
+		// still-warm cache entry.
+		client.node = nil
+
+		if err := getVerifyAndAddNodeId(
+			testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey); err != nil {
+			t.Fatalf("expected the warm cache to skip Get and report no error, got: %v", err)
+		}
+
+		invalidateNodeIdAnnotationCache("csi.example.com")
+		err := getVerifyAndAddNodeId(
+			testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey)
+		if !stderrors.Is(err, errNodeNotFound) {
+			t.Fatalf("expected errNodeNotFound after cache invalidation surfaces the deleted Node, got: %v", err)
+		}
+	})
+}
+
+// TestWatchNodeForChangesDrain covers watchNodeForChangesDrain in isolation:
+// Added/Modified/Deleted events should each produce a signal, the signal
+// channel must never block a slow consumer, and a closed result channel (the
+// watch ending) must return so watchNodeForChanges can restart it.
+func TestWatchNodeForChangesDrain(t *testing.T) {
+	fakeWatch := watch.NewFake()
+	changed := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		watchNodeForChangesDrain(context.Background(), fakeWatch, changed)
+		close(done)
+	}()
+
+	node := newTestNode(nil)
+	fakeWatch.Add(node)
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a signal after an Added event")
+	}
+
+	// A second event before the first signal is drained must not block.
+	fakeWatch.Modify(node)
+	fakeWatch.Delete(node)
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a signal after Modified/Deleted events")
+	}
+
+	fakeWatch.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for watchNodeForChangesDrain to return after the watch stopped")
+	}
+}
+
+// fakeWatchNodeClient wraps mockNodeClient to return a caller-supplied
+// watch.Interface from Watch, so watchNodeForChanges can be exercised
+// end-to-end without a real apiserver.
+type fakeWatchNodeClient struct {
+	mockNodeClient
+	watcher watch.Interface
+}
+
+func (f *fakeWatchNodeClient) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	return f.watcher, nil
+}
+
+// TestWatchNodeForChangesReEnqueuesOnExternalEdit covers watchNodeForChanges
+// end-to-end: an external edit to the watched Node should produce a signal,
+// and cancelling the context should close the returned channel.
+func TestWatchNodeForChangesReEnqueuesOnExternalEdit(t *testing.T) {
+	fakeWatch := watch.NewFake()
+	client := &fakeWatchNodeClient{
+		mockNodeClient: mockNodeClient{node: newTestNode(nil)},
+		watcher:        fakeWatch,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := watchNodeForChanges(ctx, client, testNodeName)
+
+	fakeWatch.Modify(newTestNode(map[string]string{defaultAnnotationKey: `{}`}))
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a signal after an external edit")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-changed:
+		if ok {
+			t.Error("expected the channel to be closed after ctx is cancelled, got a value instead")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the channel to close after cancelling ctx")
+	}
+}
+
+func TestGetVerifyAndDeleteNodeId(t *testing.T) {
+	client := &mockNodeClient{node: newTestNode(map[string]string{
+		defaultAnnotationKey: `{"other.example.com":"node-0","csi.example.com":"node-1"}`,
+	})}
+
+	err := getVerifyAndDeleteNodeId(
+		testNodeName,
+		client,
+		"csi.example.com",
+		"node-1",
+		false,
+		defaultAnnotationKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	gotDriverMap := map[string]string{}
+	if err := json.Unmarshal([]byte(client.node.Annotations[defaultAnnotationKey]), &gotDriverMap); err != nil {
+		t.Fatalf("failed to parse annotation: %v", err)
+	}
+	if _, ok := gotDriverMap["csi.example.com"]; ok {
+		t.Errorf("expected csi.example.com to be removed, got %v", gotDriverMap)
+	}
+	if gotDriverMap["other.example.com"] != "node-0" {
+		t.Errorf("expected other.example.com to be preserved, got %v", gotDriverMap)
+	}
+}
+
+// TestGetVerifyAndDeleteNodeIdMultipleIds covers a multi-node-id driver: the
+// stored list and expectedNodeId are compared as sets, so the order
+// SplitNodeIds returns them in doesn't spuriously block deletion.
+func TestGetVerifyAndDeleteNodeIdMultipleIds(t *testing.T) {
+	client := &mockNodeClient{node: newTestNode(map[string]string{
+		defaultAnnotationKey: `{"csi.example.com":["node-1","node-2"]}`,
+	})}
+
+	if err := getVerifyAndDeleteNodeId(
+		testNodeName, client, "csi.example.com", "node-2,node-1", false, defaultAnnotationKey); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	gotDriverMap := map[string][]string{}
+	if err := json.Unmarshal([]byte(client.node.Annotations[defaultAnnotationKey]), &gotDriverMap); err != nil {
+		t.Fatalf("failed to parse annotation: %v", err)
+	}
+	if _, ok := gotDriverMap["csi.example.com"]; ok {
+		t.Errorf("expected csi.example.com to be removed, got %v", gotDriverMap)
+	}
+}
+
+// TestGetVerifyAndDeleteNodeIdMismatchedNodeId covers the safeguard against
+// deleting an entry that does not belong to this process: it should be left
+// alone unless --force-deregister is set.
+func TestGetVerifyAndDeleteNodeIdMismatchedNodeId(t *testing.T) {
+	t.Run("refuses to delete a mismatched entry by default", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(map[string]string{
+			defaultAnnotationKey: `{"csi.example.com":"node-1"}`,
+		})}
+
+		if err := getVerifyAndDeleteNodeId(
+			testNodeName, client, "csi.example.com", "node-2", false, defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if got, want := client.node.Annotations[defaultAnnotationKey], `{"csi.example.com":"node-1"}`; got != want {
+			t.Errorf("got annotation %q, want it left untouched at %q", got, want)
+		}
+	})
+
+	t.Run("deletes a mismatched entry when --force-deregister is set", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(map[string]string{
+			defaultAnnotationKey: `{"csi.example.com":"node-1"}`,
+		})}
+
+		if err := getVerifyAndDeleteNodeId(
+			testNodeName, client, "csi.example.com", "node-2", true, defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if got, want := client.node.Annotations[defaultAnnotationKey], "{}"; got != want {
+			t.Errorf("got annotation %q, want %q", got, want)
+		}
+	})
+}
+
+// TestDeregisterNodeIdWithRetry covers the retry loop run on shutdown (see
+// --deregister-retry-attempts): a persistent, non-Conflict failure should be
+// retried exactly the configured number of times before giving up, and a
+// failure that clears up partway through should not be retried further.
+func TestDeregisterNodeIdWithRetry(t *testing.T) {
+	t.Run("gives up after the configured number of attempts", func(t *testing.T) {
+		client := &mockNodeClient{
+			node:         newTestNode(map[string]string{defaultAnnotationKey: `{"csi.example.com":"node-1"}`}),
+			forcedGetErr: fmt.Errorf("simulated persistent apiserver failure"),
+		}
+
+		err := deregisterNodeIdWithRetry(
+			testNodeName, client, "csi.example.com", "node-1", false, defaultAnnotationKey, 3, time.Millisecond)
+		if err == nil {
+			t.Fatal("expected an error after every attempt fails, got none")
+		}
+		if client.getCalls != 3 {
+			t.Errorf("expected exactly 3 attempts, got %d", client.getCalls)
+		}
+	})
+
+	t.Run("stops retrying once an attempt succeeds", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(map[string]string{
+			defaultAnnotationKey: `{"csi.example.com":"node-1"}`,
+		})}
+
+		err := deregisterNodeIdWithRetry(
+			testNodeName, client, "csi.example.com", "node-1", false, defaultAnnotationKey, 3, time.Millisecond)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if client.getCalls != 1 {
+			t.Errorf("expected exactly 1 attempt once the first succeeds, got %d", client.getCalls)
+		}
+		if _, ok := client.node.Annotations[defaultAnnotationKey]; !ok {
+			t.Fatalf("expected the annotation key to remain present (as an empty map), got %v", client.node.Annotations)
+		}
+		if got, want := client.node.Annotations[defaultAnnotationKey], "{}"; got != want {
+			t.Errorf("got annotation %q, want %q", got, want)
+		}
+	})
+
+	t.Run("treats attempts <= 1 as a single attempt", func(t *testing.T) {
+		client := &mockNodeClient{
+			node:         newTestNode(map[string]string{defaultAnnotationKey: `{"csi.example.com":"node-1"}`}),
+			forcedGetErr: fmt.Errorf("simulated persistent apiserver failure"),
+		}
+
+		if err := deregisterNodeIdWithRetry(
+			testNodeName, client, "csi.example.com", "node-1", false, defaultAnnotationKey, 0, time.Millisecond); err == nil {
+			t.Fatal("expected an error, got none")
+		}
+		if client.getCalls != 1 {
+			t.Errorf("expected exactly 1 attempt for attempts<=1, got %d", client.getCalls)
+		}
+	})
+}
+
+// TestDeregisterNodeIdWithRetryMultipleAnnotationKeys covers
+// --deregister-annotation-keys: shutdown cleanup driven one key at a time by
+// the runAnnotationLoop caller (see deregisterAnnotationKeysEffective) must
+// remove only the key(s) it was asked to, leaving any other active key (e.g.
+// one mid-migration, still being written by --additional-nodeid-annotation-key)
+// untouched.
+func TestDeregisterNodeIdWithRetryMultipleAnnotationKeys(t *testing.T) {
+	const secondKey = "csi.volume.kubernetes.io/nodeid-v2"
+	client := &mockNodeClient{node: newTestNode(map[string]string{
+		defaultAnnotationKey: `{"csi.example.com":"node-1"}`,
+		secondKey:            `{"csi.example.com":"node-1"}`,
+	})}
+
+	// Only the old (primary) key is being cleaned up, as if
+	// --deregister-annotation-keys were set to just that key partway
+	// through a migration to secondKey.
+	if err := deregisterNodeIdWithRetry(
+		testNodeName, client, "csi.example.com", "node-1", false, defaultAnnotationKey, 3, time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got, want := client.node.Annotations[defaultAnnotationKey], "{}"; got != want {
+		t.Errorf("expected the primary key to be cleaned up, got annotation %q, want %q", got, want)
+	}
+	if got, want := client.node.Annotations[secondKey], `{"csi.example.com":"node-1"}`; got != want {
+		t.Errorf("expected the second key to be left untouched, got annotation %q, want %q", got, want)
+	}
+}
+
+// TestReconcileStaleNodeId covers --reconcile-stale-on-startup's self-heal
+// logic: a stale node ID left behind by a previous incarnation of this
+// driver should be overwritten with exactly what the driver reports now,
+// other drivers' entries must survive untouched, and a few no-op cases
+// (no annotation yet, already up to date, empty csiDriverNodeId) must not
+// touch the Node object at all.
+func TestReconcileStaleNodeId(t *testing.T) {
+	t.Run("overwrites a stale entry with the current node id", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(map[string]string{
+			defaultAnnotationKey: `{"other.example.com":"node-0","csi.example.com":"node-stale"}`,
+		})}
+
+		if err := reconcileStaleNodeId(testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		gotDriverMap := map[string]string{}
+		if err := json.Unmarshal([]byte(client.node.Annotations[defaultAnnotationKey]), &gotDriverMap); err != nil {
+			t.Fatalf("failed to parse annotation: %v", err)
+		}
+		if gotDriverMap["csi.example.com"] != "node-1" {
+			t.Errorf("got %v, want csi.example.com reconciled to node-1", gotDriverMap)
+		}
+		if gotDriverMap["other.example.com"] != "node-0" {
+			t.Errorf("got %v, want other.example.com left untouched", gotDriverMap)
+		}
+	})
+
+	t.Run("reconciles a stale multi-node-id entry down to the current set", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(map[string]string{
+			defaultAnnotationKey: `{"csi.example.com":["node-old-1","node-old-2"]}`,
+		})}
+
+		if err := reconcileStaleNodeId(testNodeName, client, "csi.example.com", "node-1,node-2", defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		gotDriverMap := map[string][]string{}
+		if err := json.Unmarshal([]byte(client.node.Annotations[defaultAnnotationKey]), &gotDriverMap); err != nil {
+			t.Fatalf("failed to parse annotation: %v", err)
+		}
+		if want := []string{"node-1", "node-2"}; !stringSliceSetEqual(gotDriverMap["csi.example.com"], want) {
+			t.Errorf("got %v, want %v", gotDriverMap["csi.example.com"], want)
+		}
+	})
+
+	t.Run("is a no-op when already up to date", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(map[string]string{
+			defaultAnnotationKey: `{"csi.example.com":"node-1"}`,
+		})}
+
+		if err := reconcileStaleNodeId(testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got, want := client.node.Annotations[defaultAnnotationKey], `{"csi.example.com":"node-1"}`; got != want {
+			t.Errorf("got annotation %q, want it left untouched at %q", got, want)
+		}
+	})
+
+	t.Run("is a no-op when no annotation exists yet", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(nil)}
+
+		if err := reconcileStaleNodeId(testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, ok := client.node.Annotations[defaultAnnotationKey]; ok {
+			t.Errorf("expected no annotation to be created, got %v", client.node.Annotations)
+		}
+	})
+
+	t.Run("is a no-op when csiDriverNodeId is empty", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(map[string]string{
+			defaultAnnotationKey: `{"csi.example.com":"node-stale"}`,
+		})}
+
+		if err := reconcileStaleNodeId(testNodeName, client, "csi.example.com", "", defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got, want := client.node.Annotations[defaultAnnotationKey], `{"csi.example.com":"node-stale"}`; got != want {
+			t.Errorf("got annotation %q, want it left untouched at %q", got, want)
+		}
+	})
+
+	t.Run("leaves another driver's entry alone when this driver has none yet", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(map[string]string{
+			defaultAnnotationKey: `{"other.example.com":"node-0"}`,
+		})}
+
+		if err := reconcileStaleNodeId(testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got, want := client.node.Annotations[defaultAnnotationKey], `{"other.example.com":"node-0"}`; got != want {
+			t.Errorf("got annotation %q, want it left untouched at %q", got, want)
+		}
+	})
+}
+
+// TestHandleResyncSignal drives handleResyncSignal with a real SIGHUP
+// delivered to this test process (following the same self-signal pattern
+// Go's own os/signal tests use), confirming it both wakes resync and
+// invalidates nodeIdAnnotationCache for the given driver so the next
+// annotation loop iteration pays for a real Get.
+func TestHandleResyncSignal(t *testing.T) {
+	resetNodeIdAnnotationCacheForTest()
+	primaryKey := nodeIdAnnotationCacheKey{driverName: "csi.example.com", annotation: defaultAnnotationKey}
+	additionalKey := nodeIdAnnotationCacheKey{driverName: "csi.example.com", annotation: "csi.volume.kubernetes.io/nodeid-v2"}
+	nodeIdAnnotationCache.mu.Lock()
+	nodeIdAnnotationCache.applied[primaryKey] = "node-1"
+	nodeIdAnnotationCache.applied[additionalKey] = "node-1"
+	nodeIdAnnotationCache.mu.Unlock()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	resync := make(chan struct{}, 1)
+	go handleResyncSignal(hup, "csi.example.com", resync)
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("failed to self-signal SIGHUP: %v", err)
+	}
+
+	select {
+	case <-resync:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for handleResyncSignal to signal resync")
+	}
+
+	nodeIdAnnotationCache.mu.Lock()
+	_, primaryCached := nodeIdAnnotationCache.applied[primaryKey]
+	_, additionalCached := nodeIdAnnotationCache.applied[additionalKey]
+	nodeIdAnnotationCache.mu.Unlock()
+	if primaryCached || additionalCached {
+		t.Error("expected SIGHUP to drop the driver's cached annotation state under every annotation key, but it is still cached")
+	}
+}
+
+func TestShutdownSignalsIncludesSIGTERM(t *testing.T) {
+	// Registers against shutdownSignals itself (the slice nodeRegister passes
+	// to signal.Notify) and delivers a real SIGTERM via the OS, not a write
+	// to the test's own channel: Kubernetes sends SIGTERM, never SIGINT, to
+	// stop a container, so a test that only proved a channel send wakes up
+	// nodeRegister's goroutine would pass even if shutdownSignals omitted
+	// SIGTERM entirely.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, shutdownSignals...)
+	defer signal.Stop(c)
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("failed to self-signal SIGTERM: %v", err)
+	}
+
+	select {
+	case sig := <-c:
+		if sig != syscall.SIGTERM {
+			t.Errorf("expected to receive SIGTERM, got %v", sig)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a real SIGTERM to be delivered through shutdownSignals")
+	}
+}
+
+func TestDecodeAnnotationValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantMap map[string][]string
+		wantErr bool
+	}{
+		{
+			name:    "empty value",
+			value:   "",
+			wantMap: map[string][]string{},
+		},
+		{
+			name:    "valid json, single id",
+			value:   `{"csi.example.com":"node-1"}`,
+			wantMap: map[string][]string{"csi.example.com": {"node-1"}},
+		},
+		{
+			name:    "valid json, multiple ids",
+			value:   `{"csi.example.com":["node-1","node-2"]}`,
+			wantMap: map[string][]string{"csi.example.com": {"node-1", "node-2"}},
+		},
+		{
+			name:    "raw-single bare value",
+			value:   "node-1",
+			wantMap: map[string][]string{"csi.example.com": {"node-1"}},
+		},
+		{
+			name:    "truncated json object is corrupt, not a bare value",
+			value:   `{"csi.example.com":"node-1"`,
+			wantErr: true,
+		},
+		{
+			name:    "hand-edited json object is corrupt",
+			value:   `{not valid json}`,
+			wantErr: true,
+		},
+		{
+			name:    "driver entry that is neither a string nor a list is corrupt",
+			value:   `{"csi.example.com":42}`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := decodeAnnotationValue(test.value, "csi.example.com")
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("test %q: expected an error, got %v", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %q: unexpected error: %v", test.name, err)
+			continue
+		}
+		if len(got) != len(test.wantMap) {
+			t.Errorf("test %q: got %v, want %v", test.name, got, test.wantMap)
+		}
+		for k, v := range test.wantMap {
+			if !stringSlicesEqual(got[k], v) {
+				t.Errorf("test %q: got %v, want %v", test.name, got, test.wantMap)
+			}
+		}
+	}
+}
+
+func TestEncodeAnnotationValue(t *testing.T) {
+	oldFormat := *annotationFormat
+	defer func() { *annotationFormat = oldFormat }()
+	*annotationFormat = "json"
+
+	tests := []struct {
+		name      string
+		driverMap map[string][]string
+		want      string
+	}{
+		{
+			name:      "single id encodes as a bare string for backward compatibility",
+			driverMap: map[string][]string{"csi.example.com": {"node-1"}},
+			want:      `{"csi.example.com":"node-1"}`,
+		},
+		{
+			name:      "multiple ids encode as a json array",
+			driverMap: map[string][]string{"csi.example.com": {"node-1", "node-2"}},
+			want:      `{"csi.example.com":["node-1","node-2"]}`,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := encodeAnnotationValue(test.driverMap)
+		if err != nil {
+			t.Errorf("test %q: unexpected error: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("test %q: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// TestEncodeAnnotationValueStableAcrossRuns asserts that encoding the same
+// logical driver map always produces byte-identical output regardless of the
+// order its entries were inserted in, which is what getVerifyAndAddNodeId and
+// getVerifyAndDeleteNodeId rely on to avoid rewriting the node-id annotation
+// (and generating a spurious update event) when nothing actually changed.
+func TestEncodeAnnotationValueStableAcrossRuns(t *testing.T) {
+	oldFormat := *annotationFormat
+	defer func() { *annotationFormat = oldFormat }()
+	*annotationFormat = "json"
+
+	driverNames := []string{"csi-a.example.com", "csi-b.example.com", "csi-c.example.com", "csi-d.example.com"}
+
+	forward := map[string][]string{}
+	for i, name := range driverNames {
+		forward[name] = []string{fmt.Sprintf("node-%d", i)}
+	}
+	backward := map[string][]string{}
+	for i := len(driverNames) - 1; i >= 0; i-- {
+		backward[driverNames[i]] = []string{fmt.Sprintf("node-%d", i)}
+	}
+
+	want, err := encodeAnnotationValue(forward)
+	if err != nil {
+		t.Fatalf("unexpected error encoding forward-ordered map: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		got, err := encodeAnnotationValue(backward)
+		if err != nil {
+			t.Fatalf("unexpected error encoding backward-ordered map on run %d: %v", i, err)
+		}
+		if got != want {
+			t.Errorf("run %d: got %q, want %q (encoding must not depend on map iteration order)", i, got, want)
+		}
+	}
+}
+
+func TestEncodeAnnotationValueRawSingleWithMultipleIdsFallsBackToJSON(t *testing.T) {
+	oldFormat := *annotationFormat
+	defer func() { *annotationFormat = oldFormat }()
+	*annotationFormat = "raw-single"
+
+	got, err := encodeAnnotationValue(map[string][]string{"csi.example.com": {"node-1", "node-2"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := `{"csi.example.com":["node-1","node-2"]}`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGetVerifyAndAddNodeIdCorruptAnnotation(t *testing.T) {
+	oldRepair := *repairCorruptAnnotation
+	defer func() { *repairCorruptAnnotation = oldRepair }()
+
+	corrupt := map[string]string{defaultAnnotationKey: `{"other.example.com":"node-0"`}
+
+	t.Run("fails by default", func(t *testing.T) {
+		resetNodeIdAnnotationCacheForTest()
+		*repairCorruptAnnotation = false
+		client := &mockNodeClient{node: newTestNode(corrupt)}
+		if err := getVerifyAndAddNodeId(testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey); err == nil {
+			t.Error("expected an error, got nil")
+		}
+	})
+
+	t.Run("repairs when --repair-corrupt-annotation is set", func(t *testing.T) {
+		resetNodeIdAnnotationCacheForTest()
+		*repairCorruptAnnotation = true
+		client := &mockNodeClient{node: newTestNode(corrupt)}
+		if err := getVerifyAndAddNodeId(testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		gotDriverMap := map[string]string{}
+		if err := json.Unmarshal([]byte(client.node.Annotations[defaultAnnotationKey]), &gotDriverMap); err != nil {
+			t.Fatalf("failed to parse repaired annotation: %v", err)
+		}
+		if len(gotDriverMap) != 1 || gotDriverMap["csi.example.com"] != "node-1" {
+			t.Errorf("got %v, want only csi.example.com: node-1", gotDriverMap)
+		}
+	})
+}
+
+func TestGetVerifyAndDeleteNodeIdCorruptAnnotation(t *testing.T) {
+	client := &mockNodeClient{node: newTestNode(map[string]string{
+		defaultAnnotationKey: `{"csi.example.com":"node-1"`,
+	})}
+
+	if err := getVerifyAndDeleteNodeId(testNodeName, client, "csi.example.com", "node-1", false, defaultAnnotationKey); err != nil {
+		t.Fatalf("expected corrupt annotation to be treated as empty, got error: %v", err)
+	}
+}
+
+// TestGetVerifyAndAddNodeIdPreservesLabels verifies that patching the node
+// ID annotation leaves labels set by another controller untouched, unlike a
+// full Update of a Node object fetched before those labels were added.
+func TestGetVerifyAndAddNodeIdPreservesLabels(t *testing.T) {
+	resetNodeIdAnnotationCacheForTest()
+	node := newTestNode(nil)
+	node.Labels = map[string]string{"added-by-other-controller": "true"}
+	client := &mockNodeClient{node: node}
+
+	if err := getVerifyAndAddNodeId(
+		testNodeName,
+		client,
+		"csi.example.com",
+		"node-1",
+		defaultAnnotationKey); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if client.node.Labels["added-by-other-controller"] != "true" {
+		t.Errorf("expected label to survive patch, got %v", client.node.Labels)
+	}
+}
+
+func TestSanitizeLabelValue(t *testing.T) {
+	short := "node-1"
+	if got := sanitizeLabelValue(short); got != short {
+		t.Errorf("got %q, want a short already-valid value passed through unchanged", got)
+	}
+
+	invalidChars := "node/with:invalid@chars"
+	got := sanitizeLabelValue(invalidChars)
+	if len(validation.IsValidLabelValue(got)) != 0 {
+		t.Errorf("sanitizeLabelValue(%q) = %q, which is not a valid label value", invalidChars, got)
+	}
+	if got == invalidChars {
+		t.Errorf("expected an invalid-character node ID to be hashed, got it back unchanged")
+	}
+
+	tooLong := strings.Repeat("a", 100)
+	got = sanitizeLabelValue(tooLong)
+	if len(got) > 63 {
+		t.Errorf("sanitizeLabelValue(%q) = %q, want at most 63 characters, got %d", tooLong, got, len(got))
+	}
+	if len(validation.IsValidLabelValue(got)) != 0 {
+		t.Errorf("sanitizeLabelValue(%q) = %q, which is not a valid label value", tooLong, got)
+	}
+
+	// Two different over-length node IDs sharing a common prefix must not
+	// collide on the same hashed label value.
+	tooLongB := tooLong + "b"
+	if gotB := sanitizeLabelValue(tooLongB); gotB == got {
+		t.Errorf("expected distinct over-length node IDs to hash to distinct label values, both got %q", got)
+	}
+}
+
+func TestGetVerifyAndSetNodeIdLabel(t *testing.T) {
+	t.Run("writes a sanitized label for a short node id", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(nil)}
+		if err := getVerifyAndSetNodeIdLabel(testNodeName, client, "csi.example.com", "node-1"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got, want := client.node.Labels["csi-nodeid.csi.example.com"], "node-1"; got != want {
+			t.Errorf("got label %q, want %q", got, want)
+		}
+	})
+
+	t.Run("hashes a node id that exceeds the label value length limit", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(nil)}
+		longNodeID := strings.Repeat("a", 100)
+		if err := getVerifyAndSetNodeIdLabel(testNodeName, client, "csi.example.com", longNodeID); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got := client.node.Labels["csi-nodeid.csi.example.com"]
+		if len(got) > 63 {
+			t.Errorf("got label value %q of length %d, want at most 63", got, len(got))
+		}
+		if got == longNodeID {
+			t.Error("expected the over-length node ID to be hashed, got it back unchanged")
+		}
+	})
+
+	t.Run("is a no-op when the label is already set to the sanitized value", func(t *testing.T) {
+		node := newTestNode(nil)
+		node.Labels = map[string]string{"csi-nodeid.csi.example.com": "node-1"}
+		client := &mockNodeClient{node: node}
+		if err := getVerifyAndSetNodeIdLabel(testNodeName, client, "csi.example.com", "node-1"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got, want := client.node.Labels["csi-nodeid.csi.example.com"], "node-1"; got != want {
+			t.Errorf("got label %q, want %q", got, want)
+		}
+	})
+
+	t.Run("returns an error when a webhook strips the label back out on update", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(nil), stripKeyOnUpdate: "csi-nodeid.csi.example.com"}
+		err := getVerifyAndSetNodeIdLabel(testNodeName, client, "csi.example.com", "node-1")
+		if err == nil {
+			t.Fatal("expected an error when the label does not stick after a successful update, got none")
+		}
+	})
+}
+
+func TestApplyTopologyLabels(t *testing.T) {
+	segments := map[string]string{"zone": "us-central1-a", "region": "us-central1"}
+
+	t.Run("writes a label per topology segment", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(nil)}
+		if err := applyTopologyLabels(testNodeName, client, "csi.example.com", segments); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got, want := client.node.Labels["topology.csi.example.com/zone"], "us-central1-a"; got != want {
+			t.Errorf("got zone label %q, want %q", got, want)
+		}
+		if got, want := client.node.Labels["topology.csi.example.com/region"], "us-central1"; got != want {
+			t.Errorf("got region label %q, want %q", got, want)
+		}
+	})
+
+	t.Run("is a no-op when the labels already match", func(t *testing.T) {
+		node := newTestNode(nil)
+		node.Labels = map[string]string{
+			"topology.csi.example.com/zone":   "us-central1-a",
+			"topology.csi.example.com/region": "us-central1",
+		}
+		client := &mockNodeClient{node: node}
+		if err := applyTopologyLabels(testNodeName, client, "csi.example.com", segments); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got, want := client.node.Labels["topology.csi.example.com/zone"], "us-central1-a"; got != want {
+			t.Errorf("got zone label %q, want %q", got, want)
+		}
+	})
+
+	t.Run("updates only the segment whose label is stale, leaving an already-correct one alone", func(t *testing.T) {
+		node := newTestNode(nil)
+		node.Labels = map[string]string{"topology.csi.example.com/region": "us-central1"}
+		client := &mockNodeClient{node: node}
+		if err := applyTopologyLabels(testNodeName, client, "csi.example.com", segments); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got, want := client.node.Labels["topology.csi.example.com/zone"], "us-central1-a"; got != want {
+			t.Errorf("got zone label %q, want %q", got, want)
+		}
+	})
+
+	t.Run("returns an error when a webhook strips a topology label back out on update", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(nil), stripKeyOnUpdate: "topology.csi.example.com/zone"}
+		err := applyTopologyLabels(testNodeName, client, "csi.example.com", segments)
+		if err == nil {
+			t.Fatal("expected an error when a topology label does not stick after a successful update, got none")
+		}
+	})
+}
+
+func TestGetVerifyAndSetCSIVersionAnnotation(t *testing.T) {
+	t.Run("writes the version annotation for a driver", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(nil)}
+		if err := getVerifyAndSetCSIVersionAnnotation(testNodeName, client, "csi.example.com", "1.2.0"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got, want := client.node.Annotations["csi.volume.kubernetes.io/version-csi.example.com"], "1.2.0"; got != want {
+			t.Errorf("got annotation %q, want %q", got, want)
+		}
+	})
+
+	t.Run("is a no-op when the annotation is already set to the given version", func(t *testing.T) {
+		node := newTestNode(nil)
+		node.Annotations = map[string]string{"csi.volume.kubernetes.io/version-csi.example.com": "1.2.0"}
+		client := &mockNodeClient{node: node}
+		if err := getVerifyAndSetCSIVersionAnnotation(testNodeName, client, "csi.example.com", "1.2.0"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got, want := client.node.Annotations["csi.volume.kubernetes.io/version-csi.example.com"], "1.2.0"; got != want {
+			t.Errorf("got annotation %q, want %q", got, want)
+		}
+	})
+
+	t.Run("overwrites a stale version on change", func(t *testing.T) {
+		node := newTestNode(nil)
+		node.Annotations = map[string]string{"csi.volume.kubernetes.io/version-csi.example.com": "1.0.0"}
+		client := &mockNodeClient{node: node}
+		if err := getVerifyAndSetCSIVersionAnnotation(testNodeName, client, "csi.example.com", "1.2.0"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got, want := client.node.Annotations["csi.volume.kubernetes.io/version-csi.example.com"], "1.2.0"; got != want {
+			t.Errorf("got annotation %q, want %q", got, want)
+		}
+	})
+
+	t.Run("returns an error when a webhook strips the annotation back out on update", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(nil), stripKeyOnUpdate: "csi.volume.kubernetes.io/version-csi.example.com"}
+		err := getVerifyAndSetCSIVersionAnnotation(testNodeName, client, "csi.example.com", "1.2.0")
+		if err == nil {
+			t.Fatal("expected an error when the annotation does not stick after a successful update, got none")
+		}
+	})
+}
+
+func TestGetVerifyAndDeleteCSIVersionAnnotation(t *testing.T) {
+	t.Run("removes an existing version annotation", func(t *testing.T) {
+		node := newTestNode(nil)
+		node.Annotations = map[string]string{"csi.volume.kubernetes.io/version-csi.example.com": "1.2.0"}
+		client := &mockNodeClient{node: node}
+		if err := getVerifyAndDeleteCSIVersionAnnotation(testNodeName, client, "csi.example.com"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, ok := client.node.Annotations["csi.volume.kubernetes.io/version-csi.example.com"]; ok {
+			t.Error("expected the version annotation to have been removed")
+		}
+	})
+
+	t.Run("is a no-op when the annotation is already absent", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(nil)}
+		if err := getVerifyAndDeleteCSIVersionAnnotation(testNodeName, client, "csi.example.com"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestPatchNodeAnnotation(t *testing.T) {
+	t.Run("uses a strategic merge patch by default", func(t *testing.T) {
+		client := &mockNodeClient{node: newTestNode(nil)}
+		if err := patchNodeAnnotation(client, testNodeName, "example.com/key", "value"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if client.lastPatchType != types.StrategicMergePatchType {
+			t.Errorf("got patch type %q, want %q", client.lastPatchType, types.StrategicMergePatchType)
+		}
+		if got, want := client.node.Annotations["example.com/key"], "value"; got != want {
+			t.Errorf("got annotation %q, want %q", got, want)
+		}
+	})
+
+}
+
+// TestAnnotationFormat covers --annotation-format's "raw-single" mode: the
+// single-driver case writes a bare node ID, a second driver forces a
+// fallback to JSON, and both getVerifyAndAddNodeId/getVerifyAndDeleteNodeId
+// can read either encoding regardless of the currently configured format.
+func TestAnnotationFormat(t *testing.T) {
+	oldFormat := *annotationFormat
+	defer func() { *annotationFormat = oldFormat }()
+
+	t.Run("raw-single writes a bare node id for the only driver", func(t *testing.T) {
+		resetNodeIdAnnotationCacheForTest()
+		*annotationFormat = "raw-single"
+		client := &mockNodeClient{node: newTestNode(nil)}
+
+		if err := getVerifyAndAddNodeId(
+			testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if got, want := client.node.Annotations[defaultAnnotationKey], "node-1"; got != want {
+			t.Errorf("got annotation %q, want %q", got, want)
+		}
+	})
+
+	t.Run("raw-single falls back to json for a second driver", func(t *testing.T) {
+		resetNodeIdAnnotationCacheForTest()
+		*annotationFormat = "raw-single"
+		client := &mockNodeClient{node: newTestNode(map[string]string{
+			defaultAnnotationKey: `{"other.example.com":"node-0"}`,
+		})}
+
+		if err := getVerifyAndAddNodeId(
+			testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		gotDriverMap := map[string]string{}
+		if err := json.Unmarshal([]byte(client.node.Annotations[defaultAnnotationKey]), &gotDriverMap); err != nil {
+			t.Fatalf("expected a JSON fallback, failed to parse annotation %q: %v", client.node.Annotations[defaultAnnotationKey], err)
+		}
+		if gotDriverMap["csi.example.com"] != "node-1" {
+			t.Errorf("got %v, missing csi.example.com=node-1", gotDriverMap)
+		}
+	})
+
+	t.Run("json mode can read a previously written raw-single value", func(t *testing.T) {
+		*annotationFormat = "json"
+		client := &mockNodeClient{node: newTestNode(map[string]string{
+			defaultAnnotationKey: "node-0",
+		})}
+
+		if err := getVerifyAndDeleteNodeId(
+			testNodeName, client, "csi.example.com", "node-0", false, defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if got := client.node.Annotations[defaultAnnotationKey]; got != "{}" {
+			t.Errorf("got annotation %q, want an empty JSON object", got)
+		}
+	})
+
+	t.Run("raw-single mode can read a previously written json value and deregister down to a bare value", func(t *testing.T) {
+		*annotationFormat = "raw-single"
+		client := &mockNodeClient{node: newTestNode(map[string]string{
+			defaultAnnotationKey: `{"other.example.com":"node-0","csi.example.com":"node-1"}`,
+		})}
+
+		if err := getVerifyAndDeleteNodeId(
+			testNodeName, client, "csi.example.com", "node-1", false, defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if got, want := client.node.Annotations[defaultAnnotationKey], "node-0"; got != want {
+			t.Errorf("got annotation %q, want raw-single value %q", got, want)
+		}
+	})
+
+	t.Run("raw-single mode clears the annotation when the last driver deregisters", func(t *testing.T) {
+		*annotationFormat = "raw-single"
+		client := &mockNodeClient{node: newTestNode(map[string]string{
+			defaultAnnotationKey: "node-1",
+		})}
+
+		if err := getVerifyAndDeleteNodeId(
+			testNodeName, client, "csi.example.com", "node-1", false, defaultAnnotationKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if got := client.node.Annotations[defaultAnnotationKey]; got != "" {
+			t.Errorf("got annotation %q, want empty", got)
+		}
+	})
+}
+
+// dryRunTrackingNodeClient wraps mockNodeClient to additionally record
+// whether Patch was ever called, so dry-run tests can assert the Node
+// object was never actually written to.
+type dryRunTrackingNodeClient struct {
+	mockNodeClient
+	patched bool
+}
+
+func (m *dryRunTrackingNodeClient) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (*v1.Node, error) {
+	m.patched = true
+	return m.mockNodeClient.Patch(name, pt, data, subresources...)
+}
+
+func TestGetVerifyAndAddNodeIdDryRun(t *testing.T) {
+	resetNodeIdAnnotationCacheForTest()
+	oldDryRun := *dryRun
+	defer func() { *dryRun = oldDryRun }()
+	*dryRun = true
+
+	client := &dryRunTrackingNodeClient{mockNodeClient: mockNodeClient{node: newTestNode(nil)}}
+
+	if err := getVerifyAndAddNodeId(
+		testNodeName, client, "csi.example.com", "node-1", defaultAnnotationKey); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if client.patched {
+		t.Error("expected dry-run to skip the Patch call, but it was issued")
+	}
+	if _, ok := client.node.Annotations[defaultAnnotationKey]; ok {
+		t.Errorf("expected dry-run to leave the Node object unmodified, got annotations %v", client.node.Annotations)
+	}
+}
+
+func TestGetVerifyAndDeleteNodeIdDryRun(t *testing.T) {
+	oldDryRun := *dryRun
+	defer func() { *dryRun = oldDryRun }()
+	*dryRun = true
+
+	client := &dryRunTrackingNodeClient{mockNodeClient: mockNodeClient{node: newTestNode(map[string]string{
+		defaultAnnotationKey: `{"csi.example.com":"node-1"}`,
+	})}}
+
+	if err := getVerifyAndDeleteNodeId(
+		testNodeName, client, "csi.example.com", "node-1", false, defaultAnnotationKey); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if client.patched {
+		t.Error("expected dry-run to skip the Patch call, but it was issued")
+	}
+	if got := client.node.Annotations[defaultAnnotationKey]; got != `{"csi.example.com":"node-1"}` {
+		t.Errorf("expected dry-run to leave the Node object unmodified, got annotation %q", got)
+	}
+}
+
+// TestRunAnnotationLoopDegradesWhenKubeClientFailsAndRegistrationActive
+// covers the graceful-degradation path: a kube client build failure should
+// only disable annotation mode, not exit the process, as long as this
+// driver's registration socket is still serving.
+func TestRunAnnotationLoopDegradesWhenKubeClientFailsAndRegistrationActive(t *testing.T) {
+	// An invalid Host makes kubernetes.NewForConfig fail before any network
+	// call is attempted.
+	badConfig := &rest.Config{Host: "%zzzzz"}
+
+	done := make(chan struct{})
+	go func() {
+		runAnnotationLoop(context.Background(), badConfig, testNodeName, nil, "csi.example.com", "", "/run/csi/socket", "node-1", 0, nil, true, nil, func() {})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runAnnotationLoop did not return promptly when the kube client failed to build with registrationActive=true")
+	}
+}
+
+func TestRefreshIdentity(t *testing.T) {
+	t.Run("node id change is picked up", func(t *testing.T) {
+		drv := fake.NewCSIDriver()
+		defer drv.Stop()
+		drv.DriverName = "csi.example.com"
+		drv.NodeID = "node-2"
+
+		csiConn, err := drv.Connect()
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer csiConn.Close()
+
+		got, err := refreshIdentity(context.Background(), csiConn, "csi.example.com", "node-1", "/run/csi/socket")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != "node-2" {
+			t.Errorf("got node ID %q, want %q", got, "node-2")
+		}
+	})
+
+	t.Run("driver name change is only logged, not returned", func(t *testing.T) {
+		drv := fake.NewCSIDriver()
+		defer drv.Stop()
+		drv.DriverName = "other.example.com"
+		drv.NodeID = "node-1"
+
+		csiConn, err := drv.Connect()
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer csiConn.Close()
+
+		got, err := refreshIdentity(context.Background(), csiConn, "csi.example.com", "node-1", "/run/csi/socket")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != "node-1" {
+			t.Errorf("got node ID %q, want unchanged %q", got, "node-1")
+		}
+	})
+}
+
+func TestGetNodeInfoEmptyNodeID(t *testing.T) {
+	drv := fake.NewCSIDriver()
+	defer drv.Stop()
+	drv.DriverName = "csi.example.com"
+	drv.NodeID = ""
+
+	csiConn, err := drv.Connect()
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer csiConn.Close()
+
+	nodeID, _, _, err := getNodeInfo(context.Background(), csiConn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if nodeID != "" {
+		t.Errorf("got node ID %q, want the fake driver's empty node ID to be passed through for validateDiscoveredNodeID to judge", nodeID)
+	}
+}
+
+func TestValidateDiscoveredNodeID(t *testing.T) {
+	if fatal := validateDiscoveredNodeID("csi.example.com", "node-1", false); fatal {
+		t.Error("expected a non-empty node ID to never be fatal")
+	}
+	if fatal := validateDiscoveredNodeID("csi.example.com", "", false); !fatal {
+		t.Error("expected an empty node ID to be fatal by default")
+	}
+	if fatal := validateDiscoveredNodeID("csi.example.com", "", true); fatal {
+		t.Error("expected an empty node ID to be tolerated, not fatal, with allowEmptyNodeID set")
+	}
+}
+
+func TestNodeUpdateBackoff(t *testing.T) {
+	oldSteps, oldBaseDelay, oldFactor := *nodeUpdateRetrySteps, *nodeUpdateRetryBaseDelay, *nodeUpdateRetryFactor
+	defer func() {
+		*nodeUpdateRetrySteps, *nodeUpdateRetryBaseDelay, *nodeUpdateRetryFactor = oldSteps, oldBaseDelay, oldFactor
+	}()
+
+	*nodeUpdateRetrySteps = 7
+	*nodeUpdateRetryBaseDelay = 25 * time.Millisecond
+	*nodeUpdateRetryFactor = 2.0
+
+	backoff := nodeUpdateBackoff()
+	if backoff.Steps != 7 {
+		t.Errorf("got Steps %d, want 7", backoff.Steps)
+	}
+	if backoff.Duration != 25*time.Millisecond {
+		t.Errorf("got Duration %v, want 25ms", backoff.Duration)
+	}
+	if backoff.Factor != 2.0 {
+		t.Errorf("got Factor %v, want 2.0", backoff.Factor)
+	}
+}
+
+func TestValidateSocketPathLength(t *testing.T) {
+	// maxDriverNameLength-long driver name, the longest validateDriverName
+	// allows; combined with the default registration dir this still fits.
+	maxDriverName := strings.Repeat("a", maxDriverNameLength)
+	shortPath := fmt.Sprintf("/registration/%s-reg.sock", maxDriverName)
+	if err := validateSocketPathLength(shortPath); err != nil {
+		t.Errorf("unexpected error for a %d byte path: %v", len(shortPath), err)
+	}
+
+	// A long --registration-dir can still push a maximal driver name's
+	// assembled path past the limit even though the driver name alone is
+	// within maxDriverNameLength.
+	longDir := "/" + strings.Repeat("d", 80)
+	longPath := fmt.Sprintf("%s/%s-reg.sock", longDir, maxDriverName)
+	if err := validateSocketPathLength(longPath); err == nil {
+		t.Errorf("expected an error for a %d byte path, which is at or beyond the unix socket path limit", len(longPath))
+	}
+}
+
+func TestIsSocketLive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registration-socket-live")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("live socket is detected", func(t *testing.T) {
+		socketPath := filepath.Join(dir, "live.sock")
+		lis, err := net.Listen("unix", socketPath)
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		defer lis.Close()
+
+		if !isSocketLive(socketPath) {
+			t.Error("expected a live socket to be detected as live")
+		}
+	})
+
+	t.Run("stale socket file is not live", func(t *testing.T) {
+		socketPath := filepath.Join(dir, "stale.sock")
+		lis, err := net.Listen("unix", socketPath)
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		lis.Close() // leaves the socket file on disk with nothing serving it
+
+		if isSocketLive(socketPath) {
+			t.Error("expected a stale socket to not be detected as live")
+		}
+	})
+
+	t.Run("missing socket is not live", func(t *testing.T) {
+		if isSocketLive(filepath.Join(dir, "does-not-exist.sock")) {
+			t.Error("expected a nonexistent socket to not be detected as live")
+		}
+	})
+}
+
+func TestCreateRegistrationSocket(t *testing.T) {
+	oldManage := *manageSocketUmask
+	defer func() { *manageSocketUmask = oldManage }()
+
+	dir, err := ioutil.TempDir("", "registration-socket-create")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, manage := range []bool{true, false} {
+		*manageSocketUmask = manage
+		socketPath := filepath.Join(dir, fmt.Sprintf("manage-%v.sock", manage))
+
+		lis, err := createRegistrationSocket(socketPath, registrationSocketTypeUnix)
+		if err != nil {
+			t.Fatalf("manageSocketUmask=%v: unexpected error: %v", manage, err)
+		}
+		defer lis.Close()
+
+		fi, err := os.Stat(socketPath)
+		if err != nil {
+			t.Fatalf("manageSocketUmask=%v: failed to stat socket: %v", manage, err)
+		}
+		if fi.Mode().Perm() != registrationSocketOwnerOnlyMode {
+			t.Errorf("manageSocketUmask=%v: got mode %o, want %o", manage, fi.Mode().Perm(), registrationSocketOwnerOnlyMode)
+		}
+	}
+}
+
+// TestCreateRegistrationSocketAbstract covers --registration-socket-type=abstract,
+// which is only meaningful on Linux: the listener is reachable at socketPath,
+// but leaves no filesystem entry behind, unlike the "unix" socket type.
+func TestCreateRegistrationSocketAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract-namespace sockets are Linux-only")
+	}
+
+	dir, err := ioutil.TempDir("", "registration-socket-abstract")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "abstract.sock")
+
+	lis, err := createRegistrationSocket(socketPath, registrationSocketTypeAbstract)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer lis.Close()
+
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("expected no filesystem entry for an abstract socket, got err=%v", err)
+	}
+
+	conn, err := net.Dial("unix", "@"+socketPath)
+	if err != nil {
+		t.Fatalf("failed to dial abstract socket: %v", err)
+	}
+	conn.Close()
+}
+
+func TestPrepareRegistrationSocketPath(t *testing.T) {
+	t.Run("no existing file is a no-op", func(t *testing.T) {
+		socketPath := filepath.Join(t.TempDir(), "csi-reg.sock")
+		if err := prepareRegistrationSocketPath(socketPath, "csi.example.com", false); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("stale socket is always removed", func(t *testing.T) {
+		socketPath := filepath.Join(t.TempDir(), "csi-reg.sock")
+		lis, err := net.Listen("unix", socketPath)
+		if err != nil {
+			t.Fatalf("failed to create fixture socket: %v", err)
+		}
+		lis.Close() // nothing is listening anymore, but the socket file remains
+
+		if err := prepareRegistrationSocketPath(socketPath, "csi.example.com", false); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+			t.Errorf("expected the stale socket to be removed, got err=%v", err)
+		}
+	})
+
+	t.Run("live socket is a fatal error", func(t *testing.T) {
+		socketPath := filepath.Join(t.TempDir(), "csi-reg.sock")
+		lis, err := net.Listen("unix", socketPath)
+		if err != nil {
+			t.Fatalf("failed to create fixture socket: %v", err)
+		}
+		defer lis.Close()
+
+		if err := prepareRegistrationSocketPath(socketPath, "csi.example.com", false); err == nil {
+			t.Error("expected an error for a socket another process is still serving")
+		}
+		if _, err := os.Stat(socketPath); err != nil {
+			t.Errorf("expected the live socket to be left alone, got err=%v", err)
+		}
+	})
+
+	t.Run("regular file without force-socket-cleanup is a fatal error", func(t *testing.T) {
+		socketPath := filepath.Join(t.TempDir(), "csi-reg.sock")
+		if err := ioutil.WriteFile(socketPath, []byte("not a socket"), 0644); err != nil {
+			t.Fatalf("failed to create fixture file: %v", err)
+		}
+
+		if err := prepareRegistrationSocketPath(socketPath, "csi.example.com", false); err == nil {
+			t.Error("expected an error for a regular file at the socket path")
+		}
+		if _, err := os.Stat(socketPath); err != nil {
+			t.Errorf("expected the regular file to be left alone without --force-socket-cleanup, got err=%v", err)
+		}
+	})
+
+	t.Run("regular file with force-socket-cleanup is removed", func(t *testing.T) {
+		socketPath := filepath.Join(t.TempDir(), "csi-reg.sock")
+		if err := ioutil.WriteFile(socketPath, []byte("not a socket"), 0644); err != nil {
+			t.Fatalf("failed to create fixture file: %v", err)
+		}
+
+		if err := prepareRegistrationSocketPath(socketPath, "csi.example.com", true); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+			t.Errorf("expected the regular file to be removed, got err=%v", err)
+		}
+	})
+}
+
+func TestApplyRegistrationSocketOwnership(t *testing.T) {
+	oldMode, oldGroup := *registrationSocketMode, *registrationSocketGroup
+	defer func() { *registrationSocketMode, *registrationSocketGroup = oldMode, oldGroup }()
+
+	dir, err := ioutil.TempDir("", "registration-socket")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("no-op when both flags are unset", func(t *testing.T) {
+		*registrationSocketMode, *registrationSocketGroup = "", ""
+		socketPath := filepath.Join(dir, "noop.sock")
+		if err := ioutil.WriteFile(socketPath, nil, 0600); err != nil {
+			t.Fatalf("failed to create fake socket file: %v", err)
+		}
+		if err := applyRegistrationSocketOwnership(socketPath); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("applies the requested mode", func(t *testing.T) {
+		*registrationSocketMode, *registrationSocketGroup = "0660", ""
+		socketPath := filepath.Join(dir, "mode.sock")
+		if err := ioutil.WriteFile(socketPath, nil, 0600); err != nil {
+			t.Fatalf("failed to create fake socket file: %v", err)
+		}
+		if err := applyRegistrationSocketOwnership(socketPath); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		fi, err := os.Stat(socketPath)
+		if err != nil {
+			t.Fatalf("failed to stat socket: %v", err)
+		}
+		if fi.Mode().Perm() != 0660 {
+			t.Errorf("got mode %o, want %o", fi.Mode().Perm(), 0660)
+		}
+	})
+
+	t.Run("rejects an unparsable mode", func(t *testing.T) {
+		*registrationSocketMode, *registrationSocketGroup = "not-octal", ""
+		socketPath := filepath.Join(dir, "bad-mode.sock")
+		if err := ioutil.WriteFile(socketPath, nil, 0600); err != nil {
+			t.Fatalf("failed to create fake socket file: %v", err)
+		}
+		if err := applyRegistrationSocketOwnership(socketPath); err == nil {
+			t.Error("expected an error, got none")
+		}
+	})
+
+	t.Run("rejects an unresolvable group", func(t *testing.T) {
+		*registrationSocketMode, *registrationSocketGroup = "", "no-such-group-should-exist"
+		socketPath := filepath.Join(dir, "bad-group.sock")
+		if err := ioutil.WriteFile(socketPath, nil, 0600); err != nil {
+			t.Fatalf("failed to create fake socket file: %v", err)
+		}
+		if err := applyRegistrationSocketOwnership(socketPath); err == nil {
+			t.Error("expected an error, got none")
+		}
+	})
+}
+
+func TestResolveGroupID(t *testing.T) {
+	if _, err := resolveGroupID("0"); err != nil {
+		t.Errorf("unexpected error resolving numeric GID: %v", err)
+	}
+	if _, err := resolveGroupID("no-such-group-should-exist"); err == nil {
+		t.Error("expected an error resolving a nonexistent group name, got none")
+	}
+}
+
+func TestGetNodeName(t *testing.T) {
+	oldEnv, hadEnv := os.LookupEnv("KUBE_NODE_NAME")
+	oldNodeNameFile := *nodeNameFile
+	defer func() {
+		if hadEnv {
+			os.Setenv("KUBE_NODE_NAME", oldEnv)
+		} else {
+			os.Unsetenv("KUBE_NODE_NAME")
+		}
+		*nodeNameFile = oldNodeNameFile
+	}()
+
+	dir, err := ioutil.TempDir("", "node-name-file")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	nodeNameFilePath := filepath.Join(dir, "node-name")
+	if err := ioutil.WriteFile(nodeNameFilePath, []byte("node-from-file\n"), 0644); err != nil {
+		t.Fatalf("failed to write node name file: %v", err)
+	}
+
+	t.Run("env var takes precedence", func(t *testing.T) {
+		os.Setenv("KUBE_NODE_NAME", "node-from-env")
+		*nodeNameFile = nodeNameFilePath
+		got, err := getNodeName()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != "node-from-env" {
+			t.Errorf("got %q, want %q", got, "node-from-env")
+		}
+	})
+
+	t.Run("falls back to file when env var is empty", func(t *testing.T) {
+		os.Unsetenv("KUBE_NODE_NAME")
+		*nodeNameFile = nodeNameFilePath
+		got, err := getNodeName()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != "node-from-file" {
+			t.Errorf("got %q, want %q", got, "node-from-file")
+		}
+	})
+
+	t.Run("errors when both sources are empty", func(t *testing.T) {
+		os.Unsetenv("KUBE_NODE_NAME")
+		*nodeNameFile = ""
+		if _, err := getNodeName(); err == nil {
+			t.Error("expected an error, got none")
+		}
+	})
+
+	t.Run("errors when file cannot be read", func(t *testing.T) {
+		os.Unsetenv("KUBE_NODE_NAME")
+		*nodeNameFile = filepath.Join(dir, "does-not-exist")
+		if _, err := getNodeName(); err == nil {
+			t.Error("expected an error, got none")
+		}
+	})
+}
+
+// TestReconnectCSI verifies that reconnectCSI can establish a fresh
+// connection to a driver restarted on the same socket path, after the old
+// connection has gone dead.
+func TestReconnectCSI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node-driver-registrar-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "csi.sock")
+
+	oldDrv := fake.NewCSIDriver()
+	oldDrv.DriverName = "csi.example.com"
+	if err := oldDrv.ServeUnix(socketPath); err != nil {
+		t.Fatalf("failed to serve on unix socket: %v", err)
+	}
+	oldConn, err := connection.WaitForServer(context.Background(), socketPath)
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %v", err)
+	}
+
+	// Simulate the driver container restarting: the old server goes away
+	// and a new one comes up on the same socket path.
+	oldDrv.Stop()
+	os.Remove(socketPath)
+
+	newDrv := fake.NewCSIDriver()
+	defer newDrv.Stop()
+	newDrv.DriverName = "csi.example.com"
+	if err := newDrv.ServeUnix(socketPath); err != nil {
+		t.Fatalf("failed to serve on unix socket: %v", err)
+	}
+
+	newConn, err := reconnectCSI(context.Background(), socketPath, oldConn)
+	if err != nil {
+		t.Fatalf("unexpected error reconnecting: %v", err)
+	}
+	defer newConn.Close()
+
+	name, err := newConn.GetDriverName(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error calling GetDriverName on reconnected connection: %v", err)
+	}
+	if name != "csi.example.com" {
+		t.Errorf("got unexpected driver name: %q", name)
+	}
+}
+
+func TestTouchReadyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node-driver-registrar-ready-file")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ready")
+
+	if err := touchReadyFile(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected %q to exist: %v", path, err)
+	}
+
+	// Calling it again (as the loop would on a later iteration, though it
+	// guards against that) must not fail.
+	if err := touchReadyFile(path); err != nil {
+		t.Errorf("unexpected error on second call: %v", err)
+	}
+}
+
+func TestAnnotationLoopBackoff(t *testing.T) {
+	tests := []struct {
+		name                string
+		consecutiveFailures int
+		want                time.Duration
+	}{
+		{
+			name:                "steady state",
+			consecutiveFailures: 0,
+			want:                sleepDuration,
+		},
+		{
+			name:                "first failure doubles",
+			consecutiveFailures: 1,
+			want:                2 * sleepDuration,
+		},
+		{
+			name:                "second consecutive failure doubles again",
+			consecutiveFailures: 2,
+			want:                4 * sleepDuration,
+		},
+		{
+			name:                "many consecutive failures cap out",
+			consecutiveFailures: 20,
+			want:                maxAnnotationBackoff,
+		},
+	}
+
+	for _, test := range tests {
+		if got := annotationLoopBackoff(test.consecutiveFailures); got != test.want {
+			t.Errorf("test %q: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestJitteredAnnotationLoopBackoff(t *testing.T) {
+	oldFactor := *resyncJitterFactor
+	defer func() { *resyncJitterFactor = oldFactor }()
+
+	t.Run("zero factor disables jitter", func(t *testing.T) {
+		*resyncJitterFactor = 0
+		if got := jitteredAnnotationLoopBackoff(0); got != sleepDuration {
+			t.Errorf("got %v, want %v", got, sleepDuration)
+		}
+	})
+
+	t.Run("nonzero factor only adds jitter", func(t *testing.T) {
+		*resyncJitterFactor = 0.1
+		base := annotationLoopBackoff(0)
+		for i := 0; i < 100; i++ {
+			got := jitteredAnnotationLoopBackoff(0)
+			if got < base || got > base+time.Duration(float64(base)*0.1) {
+				t.Fatalf("got %v, want within [%v, %v]", got, base, base+time.Duration(float64(base)*0.1))
+			}
+		}
+	})
+}
+
+// blockingRegistrationServer implements registerapi.RegistrationServer with
+// a GetInfo call that blocks until unblock is closed, for exercising
+// gracefulStopWithDeadline against a call that is still in flight when
+// shutdown begins.
+type blockingRegistrationServer struct {
+	unblock chan struct{}
+}
+
+func (s *blockingRegistrationServer) GetInfo(ctx context.Context, req *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
+	<-s.unblock
+	return &registerapi.PluginInfo{Type: registerapi.CSIPlugin, Name: "csi.example.com"}, nil
+}
+
+func (s *blockingRegistrationServer) NotifyRegistrationStatus(ctx context.Context, status *registerapi.RegistrationStatus) (*registerapi.RegistrationStatusResponse, error) {
+	return &registerapi.RegistrationStatusResponse{}, nil
+}
+
+// startBlockingRegistrationServer starts grpcServer (already registered with
+// a blockingRegistrationServer) on a real unix socket and returns a client
+// dialed against it, so callers can exercise a slow in-flight call alongside
+// gracefulStopWithDeadline.
+func startBlockingRegistrationServer(t *testing.T, grpcServer *grpc.Server) registerapi.RegistrationClient {
+	t.Helper()
+	socketPath := filepath.Join(t.TempDir(), "reg.sock")
+	lis, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go grpcServer.Serve(lis)
+
+	conn, err := grpc.Dial(
+		"unix://"+socketPath,
+		grpc.WithInsecure(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", socketPath, timeout)
+		}),
+		grpc.WithBlock(),
+		grpc.WithTimeout(5*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return registerapi.NewRegistrationClient(conn)
+}
+
+func TestGracefulStopWithDeadline(t *testing.T) {
+	t.Run("in-flight call completes within the grace period", func(t *testing.T) {
+		srv := &blockingRegistrationServer{unblock: make(chan struct{})}
+		grpcServer := grpc.NewServer()
+		registerapi.RegisterRegistrationServer(grpcServer, srv)
+		client := startBlockingRegistrationServer(t, grpcServer)
+
+		callDone := make(chan error, 1)
+		go func() {
+			_, err := client.GetInfo(context.Background(), &registerapi.InfoRequest{})
+			callDone <- err
+		}()
+		time.Sleep(50 * time.Millisecond) // let the call reach the server and block
+
+		stopDone := make(chan struct{})
+		go func() {
+			gracefulStopWithDeadline(grpcServer, time.Second)
+			close(stopDone)
+		}()
+		time.Sleep(50 * time.Millisecond) // let GracefulStop start draining
+		close(srv.unblock)
+
+		if err := <-callDone; err != nil {
+			t.Errorf("expected the in-flight call to complete successfully, got: %v", err)
+		}
+		<-stopDone
+	})
+
+	t.Run("in-flight call is cut off after the hard deadline", func(t *testing.T) {
+		srv := &blockingRegistrationServer{unblock: make(chan struct{})}
+		defer close(srv.unblock) // unblock the handler so its goroutine doesn't leak
+		grpcServer := grpc.NewServer()
+		registerapi.RegisterRegistrationServer(grpcServer, srv)
+		client := startBlockingRegistrationServer(t, grpcServer)
+
+		callDone := make(chan error, 1)
+		go func() {
+			_, err := client.GetInfo(context.Background(), &registerapi.InfoRequest{})
+			callDone <- err
+		}()
+		time.Sleep(50 * time.Millisecond) // let the call reach the server and block
+
+		gracefulStopWithDeadline(grpcServer, 10*time.Millisecond)
+
+		if err := <-callDone; err == nil {
+			t.Error("expected the in-flight call to be cut off by the hard deadline, got no error")
+		}
+	})
+}
+
+func TestRegistrationLoggingInterceptor(t *testing.T) {
+	srv := &blockingRegistrationServer{unblock: make(chan struct{})}
+	close(srv.unblock) // calls should return immediately
+	metrics := newRegistrationMethodMetrics()
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(registrationLoggingInterceptor(metrics)))
+	registerapi.RegisterRegistrationServer(grpcServer, srv)
+	client := startBlockingRegistrationServer(t, grpcServer)
+
+	if _, err := client.GetInfo(context.Background(), &registerapi.InfoRequest{}); err != nil {
+		t.Fatalf("GetInfo: unexpected error: %v", err)
+	}
+	if _, err := client.NotifyRegistrationStatus(context.Background(), &registerapi.RegistrationStatus{}); err != nil {
+		t.Fatalf("NotifyRegistrationStatus: unexpected error: %v", err)
+	}
+
+	const getInfoMethod = "/pluginregistration.Registration/GetInfo"
+	const notifyMethod = "/pluginregistration.Registration/NotifyRegistrationStatus"
+	if got := metrics.snapshot(getInfoMethod, codes.OK); got != 1 {
+		t.Errorf("expected GetInfo to be recorded once with codes.OK, got %d", got)
+	}
+	if got := metrics.snapshot(notifyMethod, codes.OK); got != 1 {
+		t.Errorf("expected NotifyRegistrationStatus to be recorded once with codes.OK, got %d", got)
+	}
+}
+
+func TestRegistrationRateLimitInterceptor(t *testing.T) {
+	srv := &blockingRegistrationServer{unblock: make(chan struct{})}
+	close(srv.unblock) // calls should return immediately once past the interceptor
+	limiter := rate.NewLimiter(rate.Limit(1), 1)
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(registrationRateLimitInterceptor(limiter)))
+	registerapi.RegisterRegistrationServer(grpcServer, srv)
+	client := startBlockingRegistrationServer(t, grpcServer)
+
+	if _, err := client.GetInfo(context.Background(), &registerapi.InfoRequest{}); err != nil {
+		t.Fatalf("expected the first call within the burst to succeed, got: %v", err)
+	}
+
+	_, err := client.GetInfo(context.Background(), &registerapi.InfoRequest{})
+	if err == nil {
+		t.Fatal("expected the second call to be rejected once the burst is exhausted")
+	}
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected codes.ResourceExhausted, got: %v", err)
+	}
+
+	limiter.SetLimit(rate.Inf) // simulate the limiter having recovered
+	if _, err := client.GetInfo(context.Background(), &registerapi.InfoRequest{}); err != nil {
+		t.Errorf("expected a call to succeed once the limiter has recovered, got: %v", err)
+	}
+}
+
+func TestCheckNodeRBAC(t *testing.T) {
+	tests := []struct {
+		name        string
+		deniedVerbs map[string]bool
+		wantErr     bool
+	}{
+		{
+			name: "all verbs allowed",
+		},
+		{
+			name:        "get denied",
+			deniedVerbs: map[string]bool{"get": true},
+			wantErr:     true,
+		},
+		{
+			name:        "patch denied",
+			deniedVerbs: map[string]bool{"patch": true},
+			wantErr:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reviews := &mockSelfSubjectAccessReviews{deniedVerbs: test.deniedVerbs}
+
+			err := checkNodeRBAC(reviews)
+			if test.wantErr && err == nil {
+				t.Error("expected an error, got nil")
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// mockSelfSubjectAccessReviews is a minimal authorizationv1client.
+// SelfSubjectAccessReviewInterface that grants every verb except those
+// listed in deniedVerbs, for tests that don't need a real API server.
+type mockSelfSubjectAccessReviews struct {
+	deniedVerbs map[string]bool
+}
+
+func (m *mockSelfSubjectAccessReviews) Create(review *authorizationv1.SelfSubjectAccessReview) (*authorizationv1.SelfSubjectAccessReview, error) {
+	result := review.DeepCopy()
+	result.Status.Allowed = !m.deniedVerbs[review.Spec.ResourceAttributes.Verb]
+	return result, nil
+}
+
+func TestStartupSummaryModes(t *testing.T) {
+	oldEnableNodeIdAnnotation := *enableNodeIdAnnotation
+	defer func() { *enableNodeIdAnnotation = oldEnableNodeIdAnnotation }()
+	*enableNodeIdAnnotation = optionalBoolFlag{}
+
+	tests := []struct {
+		name                    string
+		kubeletRegistrationPath string
+		want                    []string
+	}{
+		{
+			name:                    "registration path set defaults to registration only",
+			kubeletRegistrationPath: "/var/lib/kubelet/plugins/csi.example.com/csi.sock",
+			want:                    []string{"registration"},
+		},
+		{
+			name:                    "registration path empty defaults to annotation only",
+			kubeletRegistrationPath: "",
+			want:                    []string{"annotation"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := startupSummaryModes(test.kubeletRegistrationPath)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("startupSummaryModes(%q) = %v, want %v", test.kubeletRegistrationPath, got, test.want)
+			}
+		})
+	}
+
+	*enableNodeIdAnnotation = optionalBoolFlag{isSet: true, value: true}
+	if got, want := startupSummaryModes("/var/lib/kubelet/plugins/csi.example.com/csi.sock"), []string{"registration", "annotation"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with --enable-node-id-annotation forced on, startupSummaryModes(...) = %v, want %v", got, want)
+	}
+}
+
+func TestLeaderElectionLockName(t *testing.T) {
+	got := leaderElectionLockName("node-1", "csi.example.com")
+	want := "node-driver-registrar-node-1-csi.example.com"
+	if got != want {
+		t.Errorf("leaderElectionLockName(...) = %q, want %q", got, want)
+	}
+}
+
+func TestTryAcquireOrRenewLock(t *testing.T) {
+	const lockName = "node-driver-registrar-node-1-csi.example.com"
+	client := &mockConfigMapClient{}
+
+	held, err := tryAcquireOrRenewLock(client, lockName, "holder-a", time.Minute)
+	if err != nil || !held {
+		t.Fatalf("expected holder-a to acquire a never-before-held lock, got held=%v err=%v", held, err)
+	}
+
+	held, err = tryAcquireOrRenewLock(client, lockName, "holder-b", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if held {
+		t.Error("expected holder-b to fail to acquire a lock freshly held by holder-a")
+	}
+
+	held, err = tryAcquireOrRenewLock(client, lockName, "holder-a", time.Minute)
+	if err != nil || !held {
+		t.Fatalf("expected holder-a to renew its own lock, got held=%v err=%v", held, err)
+	}
+
+	var record leaderElectionRecord
+	if err := json.Unmarshal([]byte(client.cm.Annotations[leaderElectionRecordAnnotationKey]), &record); err != nil {
+		t.Fatalf("failed to parse lock record: %v", err)
+	}
+	record.RenewTime = record.RenewTime.Add(-time.Hour)
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("failed to re-marshal lock record: %v", err)
+	}
+	client.cm.Annotations[leaderElectionRecordAnnotationKey] = string(data)
+
+	held, err = tryAcquireOrRenewLock(client, lockName, "holder-b", time.Minute)
+	if err != nil || !held {
+		t.Fatalf("expected holder-b to acquire an expired lock, got held=%v err=%v", held, err)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+)
+
+// driverConfig is one entry of effectiveConfig.Drivers, the --print-config
+// view of a single --csi-address and everything paired with it.
+type driverConfig struct {
+	CSIAddress                    string `json:"csiAddress"`
+	CSIAddressSource              string `json:"csiAddressSource,omitempty"`
+	KubeletRegistrationPath       string `json:"kubeletRegistrationPath,omitempty"`
+	KubeletRegistrationPathSource string `json:"kubeletRegistrationPathSource,omitempty"`
+	DriverEndpoint                string `json:"driverEndpoint,omitempty"`
+	AnnotationOnly                bool   `json:"annotationOnly"`
+	NodeIDAnnotationEnabled       bool   `json:"nodeIdAnnotationEnabled"`
+
+	// RegistrationSocketPathPattern is the registration socket path this
+	// driver's actual name would be substituted into, e.g.
+	// "/registration/{driver-name}-reg.sock". --print-config never connects
+	// to the CSI driver, so the driver name (and therefore the real path) is
+	// not yet known; the pattern is printed instead of leaving this out
+	// entirely, since --registration-dir is still a common source of
+	// misconfiguration worth confirming up front. Empty for a driver running
+	// in annotation-only mode, which never serves a registration socket.
+	RegistrationSocketPathPattern string `json:"registrationSocketPathPattern,omitempty"`
+}
+
+// effectiveConfig is the --print-config output: every flag and environment
+// variable fallback this process would actually use, resolved to its final
+// value, without dialing the CSI driver or the apiserver. Grouped by area
+// (registration, node annotation, CSI, Kubernetes, observability) rather
+// than as one flat map, so the JSON/YAML output reads like a config file a user could
+// plausibly have written by hand.
+type effectiveConfig struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+
+	Drivers []driverConfig `json:"drivers"`
+
+	Registration struct {
+		RegistrationDir              string   `json:"registrationDir"`
+		RegistrationSocketType       string   `json:"registrationSocketType"`
+		RegistrationSocketMode       string   `json:"registrationSocketMode,omitempty"`
+		RegistrationSocketGroup      string   `json:"registrationSocketGroup,omitempty"`
+		ManageSocketUmask            bool     `json:"manageSocketUmask"`
+		SupportedVersions            []string `json:"supportedVersions"`
+		PluginRegistrationAPIVersion string   `json:"pluginRegistrationAPIVersion"`
+		OneShot                      bool     `json:"oneShot"`
+	} `json:"registration"`
+
+	NodeAnnotation struct {
+		NodeIDAnnotationKey            string   `json:"nodeIdAnnotationKey"`
+		AdditionalNodeIDAnnotationKeys []string `json:"additionalNodeIdAnnotationKeys,omitempty"`
+		DeregisterAnnotationKeys       []string `json:"deregisterAnnotationKeys,omitempty"`
+		MaxVolumesAnnotationKey        string   `json:"maxVolumesAnnotationKey"`
+		VolumeLimitsMode               string   `json:"volumeLimitsMode"`
+		AnnotationFormat               string   `json:"annotationFormat"`
+		AlsoWriteNodeIDLabel           bool     `json:"alsoWriteNodeIdLabel"`
+		AnnotateCSIVersion             bool     `json:"annotateCSIVersion"`
+		EnableTopology                 bool     `json:"enableTopology"`
+		DryRun                         bool     `json:"dryRun"`
+		DeregisterOnShutdown           bool     `json:"deregisterOnShutdown"`
+	} `json:"nodeAnnotation"`
+
+	CSI struct {
+		ExpectedDriverName string `json:"expectedDriverName,omitempty"`
+		// TLSCAFile/TLSCertFile/TLSKeyFile are the configured paths to TLS
+		// material, never its contents: --csi-tls-key's flag value is itself
+		// already just a filesystem path, so there is no secret value here to
+		// accidentally print.
+		TLSCAFile   string `json:"tlsCAFile,omitempty"`
+		TLSCertFile string `json:"tlsCertFile,omitempty"`
+		TLSKeyFile  string `json:"tlsKeyFile,omitempty"`
+	} `json:"csi"`
+
+	Kubernetes struct {
+		Kubeconfig   string  `json:"kubeconfig,omitempty"`
+		KubeContext  string  `json:"kubeContext,omitempty"`
+		KubeAPIQPS   float64 `json:"kubeAPIQPS"`
+		KubeAPIBurst int     `json:"kubeAPIBurst"`
+		FieldManager string  `json:"fieldManager"`
+	} `json:"kubernetes"`
+
+	Observability struct {
+		DebugAddress  string `json:"debugAddress,omitempty"`
+		StatusAddress string `json:"statusAddress,omitempty"`
+		LogFormat     string `json:"logFormat"`
+		EnableTracing bool   `json:"enableTracing"`
+		OTELEndpoint  string `json:"otelEndpoint,omitempty"`
+	} `json:"observability"`
+}
+
+// buildEffectiveConfig resolves opts (already the product of flag.Parse and
+// applyEnvVarDefaults) and the package-level flags Options does not carry
+// into an effectiveConfig, pairing --csi-address with
+// --kubelet-registration-path/--driver-endpoint the same way run does
+// (runProbe pairs only --kubelet-registration-path).
+func buildEffectiveConfig(opts Options) (effectiveConfig, error) {
+	var cfg effectiveConfig
+	cfg.Version = version
+	cfg.GitCommit = gitCommit
+
+	registrationPaths, err := pairRegistrationPaths(opts.CSIAddresses, opts.KubeletRegistrationPaths)
+	if err != nil {
+		return cfg, err
+	}
+	driverEndpoints, err := resolveDriverEndpoints(registrationPaths, opts.DriverEndpoints)
+	if err != nil {
+		return cfg, err
+	}
+
+	for i, addr := range opts.CSIAddresses {
+		d := driverConfig{
+			CSIAddress:                    addr,
+			CSIAddressSource:              csiAddressSource,
+			KubeletRegistrationPath:       registrationPaths[i],
+			KubeletRegistrationPathSource: kubeletRegistrationPathSource,
+			DriverEndpoint:                driverEndpoints[i],
+			AnnotationOnly:                registrationPaths[i] == "",
+			NodeIDAnnotationEnabled:       enableNodeIdAnnotationEffective(registrationPaths[i]),
+		}
+		if !d.AnnotationOnly {
+			d.RegistrationSocketPathPattern = fmt.Sprintf("%s/{driver-name}-reg.sock", opts.RegistrationDir)
+		}
+		cfg.Drivers = append(cfg.Drivers, d)
+	}
+
+	cfg.Registration.RegistrationDir = opts.RegistrationDir
+	cfg.Registration.RegistrationSocketType = *registrationSocketType
+	cfg.Registration.RegistrationSocketMode = *registrationSocketMode
+	cfg.Registration.RegistrationSocketGroup = *registrationSocketGroup
+	cfg.Registration.ManageSocketUmask = *manageSocketUmask
+	cfg.Registration.SupportedVersions = supportedVersions.values
+	cfg.Registration.PluginRegistrationAPIVersion = opts.PluginRegistrationAPIVersion
+	cfg.Registration.OneShot = *oneShot
+
+	cfg.NodeAnnotation.NodeIDAnnotationKey = opts.NodeIDAnnotationKey
+	cfg.NodeAnnotation.AdditionalNodeIDAnnotationKeys = additionalNodeIdAnnotationKeys.values
+	cfg.NodeAnnotation.DeregisterAnnotationKeys = deregisterAnnotationKeys.values
+	cfg.NodeAnnotation.MaxVolumesAnnotationKey = *maxVolumesAnnotation
+	cfg.NodeAnnotation.VolumeLimitsMode = *volumeLimitsMode
+	cfg.NodeAnnotation.AnnotationFormat = *annotationFormat
+	cfg.NodeAnnotation.AlsoWriteNodeIDLabel = *alsoWriteNodeIdLabel
+	cfg.NodeAnnotation.AnnotateCSIVersion = *annotateCSIVersion
+	cfg.NodeAnnotation.EnableTopology = *enableTopology
+	cfg.NodeAnnotation.DryRun = *dryRun
+	cfg.NodeAnnotation.DeregisterOnShutdown = *deregisterOnShutdown
+
+	cfg.CSI.ExpectedDriverName = opts.ExpectedDriverName
+	cfg.CSI.TLSCAFile = opts.CSITLSCA
+	cfg.CSI.TLSCertFile = opts.CSITLSCert
+	cfg.CSI.TLSKeyFile = opts.CSITLSKey
+
+	cfg.Kubernetes.Kubeconfig = opts.Kubeconfig
+	cfg.Kubernetes.KubeContext = opts.KubeContext
+	cfg.Kubernetes.KubeAPIQPS = opts.KubeAPIQPS
+	cfg.Kubernetes.KubeAPIBurst = opts.KubeAPIBurst
+	cfg.Kubernetes.FieldManager = opts.FieldManager
+
+	cfg.Observability.DebugAddress = opts.DebugAddress
+	cfg.Observability.StatusAddress = opts.StatusAddress
+	cfg.Observability.LogFormat = *logFormat
+	cfg.Observability.EnableTracing = *enableTracing
+	cfg.Observability.OTELEndpoint = *otelEndpoint
+
+	return cfg, nil
+}
+
+// runPrintConfig implements --print-config: resolve every flag and
+// environment variable fallback into an effectiveConfig and print it in
+// --print-config-format, without dialing the CSI driver or the apiserver.
+func runPrintConfig(opts Options) int {
+	cfg, err := buildEffectiveConfig(opts)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return exitGeneralError
+	}
+
+	var out []byte
+	switch *printConfigFormat {
+	case "json":
+		out, err = json.MarshalIndent(cfg, "", "  ")
+	case "yaml":
+		out, err = yaml.Marshal(cfg)
+	default:
+		err = fmt.Errorf("unsupported --print-config-format %q: must be \"json\" or \"yaml\"", *printConfigFormat)
+	}
+	if err != nil {
+		glog.Errorf("failed to render effective configuration: %v", err)
+		return exitGeneralError
+	}
+
+	fmt.Println(string(out))
+	return 0
+}
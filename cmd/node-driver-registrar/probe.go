@@ -0,0 +1,113 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	registerapi "k8s.io/kubernetes/pkg/kubelet/apis/pluginregistration/v1alpha1"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-csi/node-driver-registrar/pkg/connection"
+)
+
+// probeDialTimeout bounds how long --probe waits to dial a socket before
+// reporting it unhealthy; it is deliberately short, since an exec liveness
+// probe is expected to fail fast rather than hang past its own timeout.
+const probeDialTimeout = 5 * time.Second
+
+// runProbe implements --probe: a liveness check meant to be invoked as a
+// Kubernetes exec probe (e.g. a container command of
+// "node-driver-registrar --probe --csi-address=$ADDRESS
+// --kubelet-registration-path=$REGISTRATION_PATH"), instead of this process
+// exposing a separate HTTP health port that would need its own port and
+// probe type wired into the Pod spec. It reuses the same flags that
+// configure normal operation and dials whatever socket(s) that
+// configuration would register, returning 0 if every one of them answers,
+// or exitGeneralError otherwise.
+func runProbe(ctx context.Context, opts Options) int {
+	registrationPaths, err := pairRegistrationPaths(opts.CSIAddresses, opts.KubeletRegistrationPaths)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return exitGeneralError
+	}
+
+	healthy := true
+	for i, csiAddress := range opts.CSIAddresses {
+		if err := probeDriver(ctx, csiAddress, registrationPaths[i], opts.RegistrationDir); err != nil {
+			glog.Errorf("probe failed for CSI driver at %q: %v", csiAddress, err)
+			healthy = false
+		}
+	}
+	if !healthy {
+		return exitGeneralError
+	}
+	fmt.Println("ok")
+	return 0
+}
+
+// probeDriver checks the liveness of one driver's socket(s). It always
+// dials csiAddress and calls GetPluginInfo (via GetDriverName), to confirm
+// the CSI driver itself is responsive and to learn its name. If
+// kubeletRegistrationPath is also set, it additionally dials
+// "<registrationDir>/<driver>-reg.sock" and calls GetInfo, the same RPC
+// kubelet's plugin watcher relies on, which exercises this process's own
+// registration server rather than only the CSI driver behind it.
+func probeDriver(ctx context.Context, csiAddress, kubeletRegistrationPath, registrationDir string) error {
+	ctx, cancel := context.WithTimeout(ctx, probeDialTimeout)
+	defer cancel()
+
+	csiConn, err := connection.NewConnection(csiAddress, probeDialTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to dial CSI driver at %q: %v", csiAddress, err)
+	}
+	driverName, err := csiConn.GetDriverName(ctx)
+	csiConn.Close()
+	if err != nil {
+		return fmt.Errorf("CSI driver at %q did not respond to GetDriverName: %v", csiAddress, err)
+	}
+
+	if kubeletRegistrationPath == "" {
+		// Annotation-only mode: there is no registration socket to check, so
+		// having already reached this point (a successful GetDriverName call
+		// above) is the whole check.
+		return nil
+	}
+
+	regSocket := fmt.Sprintf("%s/%s-reg.sock", registrationDir, driverName)
+	if err := validateSocketPathLength(regSocket); err != nil {
+		return err
+	}
+	dialer := func(addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("unix", addr, timeout)
+	}
+	conn, err := grpc.DialContext(ctx, regSocket, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithDialer(dialer))
+	if err != nil {
+		return fmt.Errorf("failed to dial registration socket %q: %v", regSocket, err)
+	}
+	defer conn.Close()
+
+	client := registerapi.NewRegistrationClient(conn)
+	if _, err := client.GetInfo(ctx, &registerapi.InfoRequest{}); err != nil {
+		return fmt.Errorf("registration socket %q did not respond to GetInfo: %v", regSocket, err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	registerapi "k8s.io/kubernetes/pkg/kubelet/apis/pluginregistration/v1alpha1"
+
+	"github.com/kubernetes-csi/node-driver-registrar/pkg/connection/fake"
+)
+
+func TestProbeDriverAnnotationOnly(t *testing.T) {
+	drv := fake.NewCSIDriver()
+	defer drv.Stop()
+	drv.DriverName = "csi.example.com"
+
+	dir := t.TempDir()
+	csiSocket := filepath.Join(dir, "csi.sock")
+	if err := drv.ServeUnix(csiSocket); err != nil {
+		t.Fatalf("failed to serve fake CSI driver on a unix socket: %v", err)
+	}
+
+	if err := probeDriver(context.Background(), csiSocket, "", dir); err != nil {
+		t.Errorf("unexpected error probing a responsive annotation-only driver: %v", err)
+	}
+}
+
+func TestProbeDriverWithRegistrationSocket(t *testing.T) {
+	drv := fake.NewCSIDriver()
+	defer drv.Stop()
+	drv.DriverName = "csi.example.com"
+
+	dir := t.TempDir()
+	csiSocket := filepath.Join(dir, "csi.sock")
+	if err := drv.ServeUnix(csiSocket); err != nil {
+		t.Fatalf("failed to serve fake CSI driver on a unix socket: %v", err)
+	}
+
+	registrar := newRegistrationServer("csi.example.com", "/var/lib/kubelet/plugins/csi.example.com/csi.sock", []string{"1.0.0"}, "test-node", nil, nil)
+	regSocket := filepath.Join(dir, "csi.example.com-reg.sock")
+	lis, err := net.Listen("unix", regSocket)
+	if err != nil {
+		t.Fatalf("failed to listen on registration socket: %v", err)
+	}
+	grpcServer := grpc.NewServer()
+	registerapi.RegisterRegistrationServer(grpcServer, registrar)
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	if err := probeDriver(context.Background(), csiSocket, "/var/lib/kubelet/plugins/csi.example.com/csi.sock", dir); err != nil {
+		t.Errorf("unexpected error probing a responsive driver with a registration socket: %v", err)
+	}
+}
+
+func TestProbeDriverUnresponsiveCSIDriver(t *testing.T) {
+	dir := t.TempDir()
+	csiSocket := filepath.Join(dir, "csi.sock")
+
+	if err := probeDriver(context.Background(), csiSocket, "", dir); err == nil {
+		t.Error("expected an error probing a CSI driver with nothing listening, got none")
+	}
+}
+
+func TestProbeDriverMissingRegistrationSocket(t *testing.T) {
+	drv := fake.NewCSIDriver()
+	defer drv.Stop()
+	drv.DriverName = "csi.example.com"
+
+	dir := t.TempDir()
+	csiSocket := filepath.Join(dir, "csi.sock")
+	if err := drv.ServeUnix(csiSocket); err != nil {
+		t.Fatalf("failed to serve fake CSI driver on a unix socket: %v", err)
+	}
+
+	if err := probeDriver(context.Background(), csiSocket, "/var/lib/kubelet/plugins/csi.example.com/csi.sock", dir); err == nil {
+		t.Error("expected an error probing a driver whose registration socket does not exist, got none")
+	}
+}
+
+func TestRunProbe(t *testing.T) {
+	drv := fake.NewCSIDriver()
+	defer drv.Stop()
+	drv.DriverName = "csi.example.com"
+
+	dir := t.TempDir()
+	csiSocket := filepath.Join(dir, "csi.sock")
+	if err := drv.ServeUnix(csiSocket); err != nil {
+		t.Fatalf("failed to serve fake CSI driver on a unix socket: %v", err)
+	}
+
+	opts := Options{
+		CSIAddresses:             []string{csiSocket},
+		KubeletRegistrationPaths: &stringSliceFlag{},
+		RegistrationDir:          dir,
+	}
+	if got := runProbe(context.Background(), opts); got != 0 {
+		t.Errorf("got exit code %d, want 0 for a responsive annotation-only driver", got)
+	}
+
+	opts.CSIAddresses = []string{filepath.Join(dir, "does-not-exist.sock")}
+	if got := runProbe(context.Background(), opts); got == 0 {
+		t.Error("expected a non-zero exit code for an unresponsive driver, got 0")
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/grpc"
+	registerapi "k8s.io/kubernetes/pkg/kubelet/apis/pluginregistration/v1alpha1"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-csi/node-driver-registrar/pkg/connection"
+)
+
+// selfTestTimeout bounds each individual --selftest step, so a hung CSI
+// driver fails the whole self-test promptly instead of hanging an init
+// container indefinitely.
+const selfTestTimeout = 10 * time.Second
+
+// runSelfTest implements --selftest: a DaemonSet init-container check that
+// exercises the same discovery and registration-socket machinery nodeRegister
+// uses, against a real CSI driver, without touching the apiserver. The goal
+// is to fail fast and with a specific, step-labeled message on an obviously
+// broken node (CSI driver not listening, kubelet plugin directory not
+// writable, etc.) before the main sidecar container starts and kubelet
+// begins its own registration retries against it.
+func runSelfTest(ctx context.Context, opts Options) int {
+	allPassed := true
+	for _, csiAddress := range opts.CSIAddresses {
+		if !selfTestDriver(ctx, csiAddress, opts.RegistrationDir) {
+			allPassed = false
+		}
+	}
+	if !allPassed {
+		return exitGeneralError
+	}
+	return 0
+}
+
+// selfTestDriver runs every self-test step against one driver's csiAddress,
+// printing a "[PASS]"/"[FAIL]" line per step as it goes (so a human reading
+// init container logs sees a full report, not just the first failure), and
+// returns whether every step passed.
+func selfTestDriver(ctx context.Context, csiAddress, registrationDir string) bool {
+	fmt.Printf("Self-test for CSI driver at %q:\n", csiAddress)
+	passed := true
+
+	report := func(step string, err error) {
+		if err != nil {
+			fmt.Printf("  [FAIL] %s: %v\n", step, err)
+			passed = false
+			return
+		}
+		fmt.Printf("  [PASS] %s\n", step)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	csiConn, err := connection.NewConnection(csiAddress, selfTestTimeout)
+	report("connect to CSI driver", err)
+	if err != nil {
+		return false
+	}
+	defer csiConn.Close()
+
+	driverName, _, err := discoverDriverName(ctx, csiConn, csiAddress, selfTestTimeout)
+	report("discover driver name", err)
+
+	nodeID, err := csiConn.NodeGetId(ctx)
+	if err == nil && nodeID == "" {
+		err = fmt.Errorf("driver reported an empty node ID")
+	}
+	report("discover node ID", err)
+
+	if driverName != "" {
+		report("open and accept a connection on a temporary registration socket", selfTestRegistrationSocket(ctx, driverName, registrationDir))
+	} else {
+		fmt.Printf("  [SKIP] open and accept a connection on a temporary registration socket: driver name unknown\n")
+	}
+
+	return passed
+}
+
+// selfTestRegistrationSocket serves a throwaway registrationServer on
+// "<registrationDir>/.selftest-<driverName>-reg.sock" (a name that will
+// never collide with the real "<driverName>-reg.sock" kubelet's plugin
+// watcher scans for) just long enough to dial it and confirm a connection
+// is accepted, then tears it down. This exercises the same directory
+// permissions and socket machinery runRegistrationServer depends on,
+// without leaving anything behind or interfering with a real registrar
+// that might already be serving this driver's actual socket.
+func selfTestRegistrationSocket(ctx context.Context, driverName, registrationDir string) error {
+	socketPath := filepath.Join(registrationDir, fmt.Sprintf(".selftest-%s-reg.sock", driverName))
+	if err := validateSocketPathLength(socketPath); err != nil {
+		return err
+	}
+	os.Remove(socketPath) // ignore error: best-effort cleanup of a stale run
+
+	lis, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %q: %v", socketPath, err)
+	}
+	defer os.Remove(socketPath)
+
+	grpcServer := grpc.NewServer()
+	registerapi.RegisterRegistrationServer(grpcServer, newRegistrationServer(driverName, "", nil, "", nil, nil))
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	conn, err := net.DialTimeout("unix", socketPath, selfTestTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to dial %q: %v", socketPath, err)
+	}
+	conn.Close()
+
+	glog.V(2).Infof("self-test: registration socket %q accepted a connection", socketPath)
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/kubernetes-csi/node-driver-registrar/pkg/connection/fake"
+)
+
+func TestSelfTestDriverPasses(t *testing.T) {
+	drv := fake.NewCSIDriver()
+	defer drv.Stop()
+	drv.DriverName = "csi.example.com"
+	drv.NodeID = "test-node-id"
+
+	dir := t.TempDir()
+	csiSocket := filepath.Join(dir, "csi.sock")
+	if err := drv.ServeUnix(csiSocket); err != nil {
+		t.Fatalf("failed to serve fake CSI driver on a unix socket: %v", err)
+	}
+
+	if !selfTestDriver(context.Background(), csiSocket, dir) {
+		t.Error("expected selfTestDriver to pass against a responsive fake driver")
+	}
+}
+
+func TestSelfTestDriverFailsWithNoDriverListening(t *testing.T) {
+	dir := t.TempDir()
+	csiSocket := filepath.Join(dir, "csi.sock")
+
+	if selfTestDriver(context.Background(), csiSocket, dir) {
+		t.Error("expected selfTestDriver to fail with nothing listening on the CSI socket")
+	}
+}
+
+func TestSelfTestDriverFailsWithEmptyNodeID(t *testing.T) {
+	drv := fake.NewCSIDriver()
+	defer drv.Stop()
+	drv.DriverName = "csi.example.com"
+	drv.NodeID = ""
+
+	dir := t.TempDir()
+	csiSocket := filepath.Join(dir, "csi.sock")
+	if err := drv.ServeUnix(csiSocket); err != nil {
+		t.Fatalf("failed to serve fake CSI driver on a unix socket: %v", err)
+	}
+
+	if selfTestDriver(context.Background(), csiSocket, dir) {
+		t.Error("expected selfTestDriver to fail when the driver reports an empty node ID")
+	}
+}
+
+func TestRunSelfTest(t *testing.T) {
+	drv := fake.NewCSIDriver()
+	defer drv.Stop()
+	drv.DriverName = "csi.example.com"
+	drv.NodeID = "test-node-id"
+
+	dir := t.TempDir()
+	csiSocket := filepath.Join(dir, "csi.sock")
+	if err := drv.ServeUnix(csiSocket); err != nil {
+		t.Fatalf("failed to serve fake CSI driver on a unix socket: %v", err)
+	}
+
+	opts := Options{
+		CSIAddresses:    []string{csiSocket},
+		RegistrationDir: dir,
+	}
+	if got := runSelfTest(context.Background(), opts); got != 0 {
+		t.Errorf("got exit code %d, want 0 for a responsive driver", got)
+	}
+
+	opts.CSIAddresses = []string{filepath.Join(dir, "does-not-exist.sock")}
+	if got := runSelfTest(context.Background(), opts); got == 0 {
+		t.Error("expected a non-zero exit code for an unresponsive driver, got 0")
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// driverStatus is the live state this process has discovered or last
+// updated for one CSI driver, served as JSON by the --status-address
+// endpoint. Fields are only ever overwritten with newer values (e.g. NodeID
+// after a reconnect, LastAnnotationSuccess after each successful update), so
+// a request always sees the most recently known state.
+type driverStatus struct {
+	CSIAddress                  string    `json:"csiAddress"`
+	DriverName                  string    `json:"driverName,omitempty"`
+	NodeID                      string    `json:"nodeId,omitempty"`
+	SupportedVersions           []string  `json:"supportedVersions,omitempty"`
+	RegistrationSocketPath      string    `json:"registrationSocketPath,omitempty"`
+	RegistrationSocketReadyTime time.Time `json:"registrationSocketReadyTime,omitempty"`
+	FirstGetInfoTime            time.Time `json:"firstGetInfoTime,omitempty"`
+	LastAnnotationSuccess       time.Time `json:"lastAnnotationSuccess,omitempty"`
+}
+
+// statusMu guards statuses, since it is read by the status HTTP handler and
+// written concurrently by every driver's goroutines.
+var (
+	statusMu sync.Mutex
+	statuses = map[string]*driverStatus{}
+)
+
+// updateDriverStatus applies update to the driverStatus for csiAddress,
+// creating it first if this is the first update for that driver.
+func updateDriverStatus(csiAddress string, update func(s *driverStatus)) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	s, ok := statuses[csiAddress]
+	if !ok {
+		s = &driverStatus{CSIAddress: csiAddress}
+		statuses[csiAddress] = s
+	}
+	update(s)
+}
+
+// statusSnapshot returns a stable-ordered copy of every driver's current
+// status, safe to marshal without holding statusMu.
+func statusSnapshot() []driverStatus {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	out := make([]driverStatus, 0, len(statuses))
+	for _, s := range statuses {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CSIAddress < out[j].CSIAddress })
+	return out
+}
+
+// startStatusServer serves a JSON array of every registered driver's
+// driverStatus at "/status" on address, for kubectl exec-based debugging and
+// sidecar health tooling that wants the discovered driver name and node id
+// without grepping logs. It runs for the lifetime of the process.
+func startStatusServer(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(statusSnapshot()); err != nil {
+			glog.Errorf("failed to encode status response: %v", err)
+		}
+	})
+	glog.Infof("Starting status server on %s", address)
+	go func() {
+		if err := http.ListenAndServe(address, mux); err != nil {
+			glog.Errorf("status server on %s stopped: %v", address, err)
+		}
+	}()
+}
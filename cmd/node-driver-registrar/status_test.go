@@ -0,0 +1,90 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUpdateDriverStatusAndSnapshot(t *testing.T) {
+	statusMu.Lock()
+	statuses = map[string]*driverStatus{}
+	statusMu.Unlock()
+
+	updateDriverStatus("/run/csi/b.sock", func(s *driverStatus) { s.DriverName = "b.example.com" })
+	updateDriverStatus("/run/csi/a.sock", func(s *driverStatus) { s.DriverName = "a.example.com" })
+	updateDriverStatus("/run/csi/a.sock", func(s *driverStatus) { s.NodeID = "node-1" })
+
+	got := statusSnapshot()
+	if len(got) != 2 {
+		t.Fatalf("expected 2 drivers, got %d: %+v", len(got), got)
+	}
+	if got[0].CSIAddress != "/run/csi/a.sock" || got[0].DriverName != "a.example.com" || got[0].NodeID != "node-1" {
+		t.Errorf("unexpected status for a.sock: %+v", got[0])
+	}
+	if got[1].CSIAddress != "/run/csi/b.sock" || got[1].DriverName != "b.example.com" {
+		t.Errorf("unexpected status for b.sock: %+v", got[1])
+	}
+}
+
+func TestStatusServerServesJSON(t *testing.T) {
+	statusMu.Lock()
+	statuses = map[string]*driverStatus{}
+	statusMu.Unlock()
+	updateDriverStatus("/run/csi/socket", func(s *driverStatus) {
+		s.DriverName = "csi.example.com"
+		s.NodeID = "node-1"
+	})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a port: %v", err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	startStatusServer(addr)
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = http.Get(fmt.Sprintf("http://%s/status", addr))
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("failed to reach status server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 from /status, got %d", resp.StatusCode)
+	}
+
+	var got []driverStatus
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode response body: %v", err)
+	}
+	if len(got) != 1 || got[0].DriverName != "csi.example.com" || got[0].NodeID != "node-1" {
+		t.Errorf("unexpected status response: %+v", got)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// startupSpan times one phase of the startup sequence (waiting for the CSI
+// driver socket, discovering its driver name or node ID, or the first
+// successful annotation/registration), tagged with the driver and node name
+// it was taken for once those are known.
+//
+// This tree does not vendor an OpenTelemetry SDK, so these are not real
+// OTLP spans: startSpan logs nothing on its own, and End logs a single
+// structured line with the span's name, duration, and outcome. --otel-endpoint
+// exists so callers configuring this like a real tracing integration get a
+// clear warning instead of a silently-ignored flag, rather than accepting a
+// fabricated dependency this repository cannot build.
+type startupSpan struct {
+	name  string
+	start time.Time
+}
+
+// startSpan begins a startupSpan if --enable-tracing is set, and returns nil
+// (a no-op receiver for End) otherwise, so callers do not need to guard
+// every call site on the flag themselves.
+func startSpan(name string) *startupSpan {
+	if !*enableTracing {
+		return nil
+	}
+	return &startupSpan{name: name, start: time.Now()}
+}
+
+// End logs the span's duration and outcome, tagged with driverName and
+// nodeName (either of which may be empty if not yet known at this phase).
+// It is a no-op on a nil span, i.e. whenever --enable-tracing is unset.
+func (s *startupSpan) End(driverName, nodeName string, err error) {
+	if s == nil {
+		return
+	}
+	duration := time.Since(s.start)
+	if err != nil {
+		glog.Errorf("span %q failed after %s (driver=%q node=%q): %v", s.name, duration, driverName, nodeName, err)
+		return
+	}
+	glog.Infof("span %q completed in %s (driver=%q node=%q)", s.name, duration, driverName, nodeName)
+}
+
+// warnIfOTLPExportUnavailable logs a startup warning if --otel-endpoint is
+// set, since this tree has no OpenTelemetry SDK vendored to actually export
+// to it; see startupSpan.
+func warnIfOTLPExportUnavailable() {
+	if *otelEndpoint != "" {
+		glog.Warningf("--otel-endpoint=%q has no effect: this build does not vendor an OpenTelemetry SDK to export OTLP spans to it. Startup spans are still logged locally if --enable-tracing is set.", *otelEndpoint)
+	}
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStartSpanDisabledByDefault(t *testing.T) {
+	old := *enableTracing
+	*enableTracing = false
+	defer func() { *enableTracing = old }()
+
+	span := startSpan("test-span")
+	if span != nil {
+		t.Fatalf("expected a nil span with --enable-tracing unset, got %+v", span)
+	}
+	// End on a nil span must not panic.
+	span.End("driver", "node", nil)
+}
+
+func TestStartSpanEnabled(t *testing.T) {
+	old := *enableTracing
+	*enableTracing = true
+	defer func() { *enableTracing = old }()
+
+	span := startSpan("test-span")
+	if span == nil {
+		t.Fatal("expected a non-nil span with --enable-tracing set")
+	}
+	if span.name != "test-span" {
+		t.Errorf("expected span name %q, got %q", "test-span", span.name)
+	}
+	// End must not panic either on success or on error.
+	span.End("driver", "node", nil)
+
+	span = startSpan("test-span-failure")
+	span.End("driver", "node", fmt.Errorf("simulated span failure"))
+}
@@ -18,8 +18,11 @@ package connection
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -28,9 +31,89 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/status"
 )
 
+// KeepaliveTime and KeepaliveTimeout configure the gRPC keepalive pings sent
+// on the connection to the CSI driver socket, so an idle connection silently
+// dropped by the kernel or an intermediary proxy is noticed and torn down
+// instead of hanging the next call until its own timeout. This is mostly
+// defensive, since the driver is typically a local unix socket, but helps in
+// unusual CNI/sidecar-proxy topologies. Callers (e.g. main, via
+// --csi-keepalive-time and --csi-keepalive-timeout) may override these
+// before connecting.
+var (
+	KeepaliveTime    = 30 * time.Second
+	KeepaliveTimeout = 10 * time.Second
+)
+
+// TLSConfig configures transport credentials for a TCP csi-address (e.g.
+// some-host:1234) that requires TLS or mTLS, set by main before connecting
+// via --csi-tls-ca/--csi-tls-cert/--csi-tls-key. A unix socket address is
+// always dialed insecurely regardless of this setting, since it is already
+// protected by filesystem permissions. Nil (the default) dials a TCP
+// address insecurely too, for drivers that don't speak TLS.
+var TLSConfig *tls.Config
+
+// transportCredentialsDialOption selects transport security for a dial
+// target reached over network ("unix" or "tcp", as returned by
+// ParseAddress): TLSConfig's credentials for "tcp" when TLSConfig is set,
+// insecure otherwise. A unix socket is always dialed insecurely regardless
+// of TLSConfig, since it is already protected by filesystem permissions.
+func transportCredentialsDialOption(network string) grpc.DialOption {
+	if network != "unix" && TLSConfig != nil {
+		return grpc.WithTransportCredentials(credentials.NewTLS(TLSConfig))
+	}
+	return grpc.WithInsecure()
+}
+
+// ParseAddress splits a --csi-address value into the network it should be
+// dialed over ("unix" or "tcp") and the bare target to dial (a filesystem
+// path for "unix", a host:port for "tcp"), so callers don't each have to
+// reimplement the same scheme handling.
+//
+// An explicit "unix://" or "tcp://" prefix is honored and stripped. An
+// address with neither prefix is accepted for backward compatibility with
+// addresses given before this scheme handling existed: one starting with
+// "/" is treated as a unix socket path, and anything else (e.g. a bare
+// "host:port") is treated as TCP. Any other scheme prefix (e.g. "http://")
+// is rejected with a clear error instead of being silently passed to the
+// gRPC dialer, which would otherwise fail later with a much less specific
+// one.
+func ParseAddress(address string) (network, target string, err error) {
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		return "unix", strings.TrimPrefix(address, "unix://"), nil
+	case strings.HasPrefix(address, "tcp://"):
+		return "tcp", strings.TrimPrefix(address, "tcp://"), nil
+	case strings.Contains(address, "://"):
+		return "", "", fmt.Errorf("unsupported scheme in CSI address %q: only \"unix://\" and \"tcp://\" are supported", address)
+	case strings.HasPrefix(address, "/"):
+		return "unix", address, nil
+	default:
+		return "tcp", address, nil
+	}
+}
+
+// keepaliveParams returns the currently configured client keepalive
+// parameters, for use both when dialing and in tests asserting the
+// configured values take effect.
+func keepaliveParams() keepalive.ClientParameters {
+	return keepalive.ClientParameters{
+		Time:    KeepaliveTime,
+		Timeout: KeepaliveTimeout,
+	}
+}
+
+// TODO(synth-547): add a GetFSGroupPolicy method once the vendored CSI spec
+// carries a PluginCapability type for it. The spec.lib.go.csi package
+// vendored in this tree only defines PluginCapability_Service (CONTROLLER_
+// SERVICE, VOLUME_ACCESSIBILITY_CONSTRAINTS); GetPluginCapabilities has no
+// way to report an fsGroup policy yet, so there is nothing here to query or
+// annotate onto the Node object until the CSI dependency is updated.
+
 // CSIConnection is gRPC connection to a remote CSI driver and abstracts all
 // CSI calls.
 type CSIConnection interface {
@@ -41,8 +124,40 @@ type CSIConnection interface {
 	// NodeGetId returns node ID of the current according to the CSI driver.
 	NodeGetId(ctx context.Context) (string, error)
 
+	// NodeGetIds returns the node ID(s) reported by the CSI driver as a
+	// list. The CSI spec's NodeGetInfoResponse carries only a single
+	// node_id string field, so a driver that legitimately has more than one
+	// node identity (e.g. a multipath fabric with one identity per path)
+	// has no spec-defined way to report that beyond packing them into that
+	// one field; the established convention this registrar honors is a
+	// comma-separated NodeId. A single, comma-free NodeId is returned as a
+	// one-element list.
+	NodeGetIds(ctx context.Context) ([]string, error)
+
+	// GetPluginVendorVersion returns the vendor_version field of the
+	// driver's GetPluginInfo response, which may be empty if the driver
+	// does not report one.
+	GetPluginVendorVersion(ctx context.Context) (string, error)
+
+	// NodeGetInfo returns the node ID, the maximum number of volumes that
+	// can be attached to the node, and the node's accessible topology (if
+	// any), as reported by the CSI driver's NodeGetInfo call.
+	NodeGetInfo(ctx context.Context) (nodeID string, maxVolumesPerNode int64, accessibleTopology *csi.Topology, err error)
+
+	// Probe calls the Identity Probe RPC and reports whether the driver
+	// considers itself ready to serve. A driver that does not implement
+	// Probe (codes.Unimplemented) is treated as always ready, per the CSI
+	// spec's description of Probe as optional.
+	Probe(ctx context.Context) (ready bool, err error)
+
 	// Close the connection
 	Close() error
+
+	// GetState returns the current connectivity state of the underlying
+	// gRPC connection, so callers can detect a dead connection (e.g. after
+	// the CSI driver container restarts) without waiting for the next RPC
+	// to fail.
+	GetState() connectivity.State
 }
 
 type csiConnection struct {
@@ -64,19 +179,235 @@ func NewConnection(
 	}, nil
 }
 
+// NewConnectionFromClientConn creates a CSIConnection backed by an already
+// established gRPC client connection. It is primarily useful for tests that
+// dial a fake CSI driver over an in-process transport such as bufconn,
+// where the usual address-based dialing in NewConnection does not apply.
+func NewConnectionFromClientConn(conn *grpc.ClientConn) CSIConnection {
+	return &csiConnection{
+		conn: conn,
+	}
+}
+
+// UnimplementedError wraps a gRPC error returned by a CSI call that reports
+// codes.Unimplemented: the driver understood the request but deliberately
+// does not support that RPC (e.g. an older driver's NodeGetInfo). Callers
+// use errors.As to detect this and fall back to an older/optional code path
+// instead of treating it as a failure.
+type UnimplementedError struct {
+	Err error
+}
+
+func (e *UnimplementedError) Error() string {
+	return fmt.Sprintf("CSI call is not implemented by the driver: %v", e.Err)
+}
+
+func (e *UnimplementedError) Unwrap() error {
+	return e.Err
+}
+
+// UnavailableError wraps a gRPC error returned by a CSI call that reports
+// codes.Unavailable: a transient condition (e.g. the driver is restarting)
+// that is usually worth retrying, as opposed to one that indicates a
+// permanent misconfiguration. Callers use errors.As to detect this and
+// decide whether to retry or reconnect instead of exiting immediately.
+type UnavailableError struct {
+	Err error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("CSI driver is unavailable: %v", e.Err)
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// classifyCSIError wraps err in UnimplementedError or UnavailableError when
+// its gRPC status code identifies one of those conditions, so callers can
+// use errors.As instead of comparing status.Code(err) themselves. Any other
+// error, including nil, is returned unchanged.
+func classifyCSIError(err error) error {
+	switch status.Code(err) {
+	case codes.Unimplemented:
+		return &UnimplementedError{Err: err}
+	case codes.Unavailable:
+		return &UnavailableError{Err: err}
+	default:
+		return err
+	}
+}
+
+// SocketNotFoundError is returned by WaitForServer when ctx expires before
+// the socket file at address ever appeared on disk. It is distinct from a
+// gRPC dial or Probe failure, which means the driver process exists but is
+// not answering yet.
+type SocketNotFoundError struct {
+	Address string
+}
+
+func (e *SocketNotFoundError) Error() string {
+	return fmt.Sprintf("socket %q does not exist", e.Address)
+}
+
+// ProbeError is returned by WaitForServer when the socket exists and a gRPC
+// connection was established, but the driver did not answer a Probe call
+// successfully before ctx expired.
+type ProbeError struct {
+	Address string
+	Err     error
+}
+
+func (e *ProbeError) Error() string {
+	return fmt.Sprintf("driver at %q did not respond to Probe: %v", e.Address, e.Err)
+}
+
+// socketPollInterval is how often WaitForServer checks for the socket file.
+const socketPollInterval = 10 * time.Millisecond
+
+// resolveSocketAddress resolves address (a unix socket path) through any
+// symlinks, so a driver that exposes its socket via a symlink it repoints
+// on every restart (e.g. writing a new socket file elsewhere and then
+// atomically renaming the symlink onto it, to avoid a window with no
+// socket at all) is dialed against whatever the symlink currently points
+// at, not whatever it happened to point at when this process last resolved
+// it. It is called on every dial attempt (see connect and WaitForServer's
+// grpc.WithDialer), not just once at startup, so a reconnection after the
+// driver restarts and repoints the symlink picks up the new target
+// automatically.
+//
+// A non-path address (host:port) is returned unchanged, since symlinks
+// don't apply to those. address is also returned unchanged if it cannot be
+// resolved (e.g. it does not exist, or is a dangling symlink): that is not
+// an error here, the dial attempt that follows will fail clearly on its
+// own, and WaitForServer's own socketTargetExists already keeps callers
+// from reaching this point until the target exists in the first place.
+func resolveSocketAddress(address string) string {
+	if !strings.HasPrefix(address, "/") {
+		return address
+	}
+	resolved, err := filepath.EvalSymlinks(address)
+	if err != nil {
+		return address
+	}
+	if resolved != address {
+		glog.V(4).Infof("Resolved CSI driver socket %q to %q", address, resolved)
+	}
+	return resolved
+}
+
+// socketTargetExists reports whether address (a unix socket path, possibly
+// a symlink) currently resolves to something dialable. A plain os.Stat
+// already follows a symlink to its target on its own; this only exists to
+// tell a missing path apart from a symlink that exists but is dangling
+// (its target has not been created yet, e.g. mid-restart) for a clearer log
+// message, since WaitForServer's caller otherwise has no way to know which
+// of the two it is still waiting on.
+func socketTargetExists(address string) bool {
+	if _, err := os.Stat(address); err == nil {
+		return true
+	}
+	if fi, err := os.Lstat(address); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		glog.V(4).Infof("CSI driver socket symlink %q exists but its target does not exist yet", address)
+	}
+	return false
+}
+
+// WaitForServer waits for address (see ParseAddress for the accepted
+// "unix://"/"tcp://"/bare-path forms) to appear on disk if it is a unix
+// socket, then establishes a gRPC connection and waits for the driver to
+// answer a Probe call, so callers can tell a missing socket file
+// (SocketNotFoundError) apart from an unresponsive driver (ProbeError). A
+// TCP address skips the file check and waits only on Probe.
+func WaitForServer(ctx context.Context, address string) (CSIConnection, error) {
+	network, target, err := ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		for {
+			if socketTargetExists(target) {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return nil, &SocketNotFoundError{Address: address}
+			case <-time.After(socketPollInterval):
+			}
+		}
+	}
+
+	dialOptions := []grpc.DialOption{
+		transportCredentialsDialOption(network),
+		grpc.WithBackoffMaxDelay(time.Second),
+		grpc.WithUnaryInterceptor(logGRPC),
+		grpc.WithKeepaliveParams(keepaliveParams()),
+		grpc.WithBlock(),
+	}
+	if network == "unix" {
+		dialOptions = append(dialOptions, grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", resolveSocketAddress(addr), timeout)
+		}))
+	}
+	conn, err := grpc.DialContext(ctx, target, dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	csiConn := &csiConnection{conn: conn}
+
+	client := csi.NewIdentityClient(conn)
+	if _, err := client.Probe(ctx, &csi.ProbeRequest{}); err != nil {
+		csiConn.Close()
+		return nil, &ProbeError{Address: address, Err: err}
+	}
+
+	return csiConn, nil
+}
+
+// WaitForReady polls csiConnection's Probe RPC every socketPollInterval
+// until the driver reports ready, ctx is cancelled, or a non-Unimplemented
+// error occurs. It exists because a driver can accept connections and
+// answer Probe successfully well before it has finished initializing (e.g.
+// still loading its own config), and would otherwise have its name and node
+// ID queried prematurely. address is only used to annotate the returned
+// error.
+func WaitForReady(ctx context.Context, csiConn CSIConnection, address string) error {
+	for {
+		ready, err := csiConn.Probe(ctx)
+		if err != nil {
+			return &ProbeError{Address: address, Err: err}
+		}
+		if ready {
+			return nil
+		}
+		glog.V(3).Infof("Driver at %q reported not ready yet, waiting to retry", address)
+		select {
+		case <-ctx.Done():
+			return &ProbeError{Address: address, Err: ctx.Err()}
+		case <-time.After(socketPollInterval):
+		}
+	}
+}
+
 func connect(address string, timeout time.Duration) (*grpc.ClientConn, error) {
 	glog.V(2).Infof("Connecting to %s", address)
+	network, target, err := ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
 	dialOptions := []grpc.DialOption{
-		grpc.WithInsecure(),
+		transportCredentialsDialOption(network),
 		grpc.WithBackoffMaxDelay(time.Second),
 		grpc.WithUnaryInterceptor(logGRPC),
+		grpc.WithKeepaliveParams(keepaliveParams()),
 	}
-	if strings.HasPrefix(address, "/") {
+	if network == "unix" {
 		dialOptions = append(dialOptions, grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
-			return net.DialTimeout("unix", addr, timeout)
+			return net.DialTimeout("unix", resolveSocketAddress(addr), timeout)
 		}))
 	}
-	conn, err := grpc.Dial(address, dialOptions...)
+	conn, err := grpc.Dial(target, dialOptions...)
 
 	if err != nil {
 		return nil, err
@@ -103,7 +434,7 @@ func (c *csiConnection) GetDriverName(ctx context.Context) (string, error) {
 
 	rsp, err := client.GetPluginInfo(ctx, &req)
 	if err != nil {
-		return "", err
+		return "", classifyCSIError(err)
 	}
 	name := rsp.GetName()
 	if name == "" {
@@ -112,6 +443,42 @@ func (c *csiConnection) GetDriverName(ctx context.Context) (string, error) {
 	return name, nil
 }
 
+// Probe calls the Identity Probe RPC. A response with no Ready field set
+// means "assume ready" per the CSI spec; codes.Unimplemented means the
+// driver does not support Probe at all, which is likewise treated as ready
+// since there is nothing further to wait on.
+func (c *csiConnection) Probe(ctx context.Context) (bool, error) {
+	client := csi.NewIdentityClient(c.conn)
+
+	rsp, err := client.Probe(ctx, &csi.ProbeRequest{})
+	if err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			return true, nil
+		}
+		return false, err
+	}
+	if rsp.GetReady() == nil {
+		return true, nil
+	}
+	return rsp.GetReady().GetValue(), nil
+}
+
+func (c *csiConnection) GetPluginVendorVersion(ctx context.Context) (string, error) {
+	client := csi.NewIdentityClient(c.conn)
+
+	req := csi.GetPluginInfoRequest{}
+
+	rsp, err := client.GetPluginInfo(ctx, &req)
+	if err != nil {
+		return "", classifyCSIError(err)
+	}
+	return rsp.GetVendorVersion(), nil
+}
+
+// NodeGetId returns the CSI driver's node ID. It does not itself reject an
+// empty node ID: callers that care (node_register.go's getNodeInfo, via
+// validateDiscoveredNodeID) are better positioned to decide whether that is
+// fatal or tolerable.
 func (c *csiConnection) NodeGetId(ctx context.Context) (string, error) {
 	client := csi.NewNodeClient(c.conn)
 
@@ -119,19 +486,113 @@ func (c *csiConnection) NodeGetId(ctx context.Context) (string, error) {
 
 	rsp, err := client.NodeGetInfo(ctx, &req)
 	if err != nil {
-		return "", err
+		return "", classifyCSIError(err)
 	}
-	nodeID := rsp.GetNodeId()
+	return rsp.GetNodeId(), nil
+}
+
+// NodeGetIds calls NodeGetId and splits its result on "," to recover the
+// individual node identities of a multi-node-id driver; see NodeGetIds'
+// interface doc comment for why a comma is the convention used.
+func (c *csiConnection) NodeGetIds(ctx context.Context) ([]string, error) {
+	nodeID, err := c.NodeGetId(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return SplitNodeIds(nodeID), nil
+}
+
+// SplitNodeIds splits a (possibly comma-separated) node ID string into its
+// individual node identities, trimming whitespace around each and dropping
+// empty entries. An empty input yields an empty (not nil) slice.
+func SplitNodeIds(nodeID string) []string {
 	if nodeID == "" {
-		return "", fmt.Errorf("node ID is empty")
+		return []string{}
 	}
-	return nodeID, nil
+	parts := strings.Split(nodeID, ",")
+	ids := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			ids = append(ids, p)
+		}
+	}
+	return ids
+}
+
+// NodeGetInfo returns the CSI driver's node ID, max volumes per node, and
+// accessible topology. Like NodeGetId, it does not itself reject an empty
+// node ID; see NodeGetId's comment.
+func (c *csiConnection) NodeGetInfo(ctx context.Context) (string, int64, *csi.Topology, error) {
+	client := csi.NewNodeClient(c.conn)
+
+	req := csi.NodeGetInfoRequest{}
+
+	rsp, err := client.NodeGetInfo(ctx, &req)
+	if err != nil {
+		return "", 0, nil, classifyCSIError(err)
+	}
+	return rsp.GetNodeId(), rsp.GetMaxVolumesPerNode(), rsp.GetAccessibleTopology(), nil
+}
+
+// Identity is what DiscoverIdentity discovers about a CSI driver in a
+// single call: its self-reported driver name, node ID, and vendor version
+// (the latter empty if the driver does not report one).
+type Identity struct {
+	DriverName    string
+	NodeID        string
+	VendorVersion string
+}
+
+// DiscoverIdentity calls GetDriverName, GetPluginVendorVersion, and
+// NodeGetId on conn, reusing its single connection rather than dialing
+// separately for each, and returns what they reported as an Identity.
+// driverNameTimeout and nodeIDTimeout are each applied to their respective
+// call via a context derived from ctx, which itself carries no deadline of
+// its own; GetPluginVendorVersion shares driverNameTimeout, since it is
+// answered by the same underlying GetPluginInfo RPC as GetDriverName.
+//
+// It exists to collect these per-call timeouts in one place instead of
+// duplicating them at each call site that needs more than one of them
+// together (see node_register.go's refreshIdentity).
+//
+// GetDriverName and NodeGetId failures are both returned as a single error,
+// since a caller cannot proceed meaningfully with only one of the two. A
+// GetPluginVendorVersion failure is only logged: every CSI driver is
+// expected to implement the GetPluginInfo RPC it shares with GetDriverName,
+// but the vendor_version field within it is optional, so VendorVersion is
+// simply left empty rather than failing the whole call over it.
+func DiscoverIdentity(ctx context.Context, conn CSIConnection, driverNameTimeout, nodeIDTimeout time.Duration) (*Identity, error) {
+	driverNameCtx, driverNameCancel := context.WithTimeout(ctx, driverNameTimeout)
+	defer driverNameCancel()
+	driverName, err := conn.GetDriverName(driverNameCtx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover CSI driver name: %v", err)
+	}
+
+	vendorVersion, err := conn.GetPluginVendorVersion(driverNameCtx)
+	if err != nil {
+		glog.Warningf("Unable to determine CSI driver vendor version: %v", err)
+	}
+
+	nodeIDCtx, nodeIDCancel := context.WithTimeout(ctx, nodeIDTimeout)
+	defer nodeIDCancel()
+	nodeID, err := conn.NodeGetId(nodeIDCtx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover CSI driver node ID: %v", err)
+	}
+
+	return &Identity{DriverName: driverName, NodeID: nodeID, VendorVersion: vendorVersion}, nil
 }
 
 func (c *csiConnection) Close() error {
 	return c.conn.Close()
 }
 
+func (c *csiConnection) GetState() connectivity.State {
+	return c.conn.GetState()
+}
+
 func logGRPC(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
 	glog.V(5).Infof("GRPC call: %s", method)
 	glog.V(5).Infof("GRPC request: %+v", req)
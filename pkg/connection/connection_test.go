@@ -18,12 +18,28 @@ package connection
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/kubernetes-csi/csi-test/driver"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func createMockServer(t *testing.T) (
@@ -56,6 +72,41 @@ func createMockServer(t *testing.T) (
 	return mockController, drv, identityServer, controllerServer, nodeServer, csiConn, nil
 }
 
+func TestConnectUsesConfiguredKeepalive(t *testing.T) {
+	oldTime, oldTimeout := KeepaliveTime, KeepaliveTimeout
+	defer func() { KeepaliveTime, KeepaliveTimeout = oldTime, oldTimeout }()
+
+	KeepaliveTime = 7 * time.Second
+	KeepaliveTimeout = 3 * time.Second
+
+	params := keepaliveParams()
+	if params.Time != KeepaliveTime || params.Timeout != KeepaliveTimeout {
+		t.Errorf("expected dial options to use the configured keepalive (time=%s, timeout=%s), got %+v", KeepaliveTime, KeepaliveTimeout, params)
+	}
+}
+
+func TestClose(t *testing.T) {
+	mockController, drv, identityServer, _, _, csiConn, err := createMockServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer drv.Stop()
+
+	identityServer.EXPECT().GetPluginInfo(gomock.Any(), gomock.Any()).Return(&csi.GetPluginInfoResponse{Name: "csi/example"}, nil).Times(1)
+	if _, err := csiConn.GetDriverName(context.Background()); err != nil {
+		t.Fatalf("unexpected error before Close: %v", err)
+	}
+
+	if err := csiConn.Close(); err != nil {
+		t.Fatalf("unexpected error from Close: %v", err)
+	}
+
+	if _, err := csiConn.GetDriverName(context.Background()); err == nil {
+		t.Error("expected an error calling GetDriverName after Close, got none")
+	}
+}
+
 func TestGetNodeID(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -77,11 +128,14 @@ func TestGetNodeID(t *testing.T) {
 			expectError: true,
 		},
 		{
+			// NodeGetId passes an empty node ID through rather than treating it
+			// as an error; it is up to callers (see node_register.go's
+			// validateDiscoveredNodeID) to decide whether that is fatal.
 			name: "empty ID",
 			output: &csi.NodeGetInfoResponse{
 				NodeId: "",
 			},
-			expectError: true,
+			expectError: false,
 		},
 	}
 
@@ -113,12 +167,89 @@ func TestGetNodeID(t *testing.T) {
 		if !test.expectError && err != nil {
 			t.Errorf("test %q: got error: %v", test.name, err)
 		}
-		if err == nil && nodeID != "mock_node_id" {
+		if err == nil && nodeID != test.output.GetNodeId() {
 			t.Errorf("got unexpected node ID: %q", nodeID)
 		}
 	}
 }
 
+func TestNodeGetInfo(t *testing.T) {
+	tests := []struct {
+		name        string
+		output      *csi.NodeGetInfoResponse
+		injectError bool
+		expectError bool
+	}{
+		{
+			name: "success",
+			output: &csi.NodeGetInfoResponse{
+				NodeId:            "mock_node_id",
+				MaxVolumesPerNode: 16,
+				AccessibleTopology: &csi.Topology{
+					Segments: map[string]string{"zone": "us-east-1a"},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name:        "gRPC error",
+			output:      nil,
+			injectError: true,
+			expectError: true,
+		},
+		{
+			// NodeGetInfo passes an empty node ID through rather than treating
+			// it as an error; see the equivalent case in TestGetNodeID.
+			name: "empty ID",
+			output: &csi.NodeGetInfoResponse{
+				NodeId: "",
+			},
+			expectError: false,
+		},
+	}
+
+	mockController, driver, _, _, nodeServer, csiConn, err := createMockServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+	defer csiConn.Close()
+
+	for _, test := range tests {
+		in := &csi.NodeGetInfoRequest{}
+
+		out := test.output
+		var injectedErr error
+		if test.injectError {
+			injectedErr = fmt.Errorf("mock error")
+		}
+
+		nodeServer.EXPECT().NodeGetInfo(gomock.Any(), in).Return(out, injectedErr).Times(1)
+
+		nodeID, maxVolumes, topology, err := csiConn.NodeGetInfo(context.Background())
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if err == nil {
+			if nodeID != test.output.GetNodeId() {
+				t.Errorf("got unexpected node ID: %q", nodeID)
+			}
+			if test.output.GetNodeId() != "" {
+				if maxVolumes != 16 {
+					t.Errorf("got unexpected max volumes: %d", maxVolumes)
+				}
+				if topology.GetSegments()["zone"] != "us-east-1a" {
+					t.Errorf("got unexpected topology: %+v", topology)
+				}
+			}
+		}
+	}
+}
+
 func TestGetPluginInfo(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -185,3 +316,614 @@ func TestGetPluginInfo(t *testing.T) {
 		}
 	}
 }
+
+func TestDiscoverIdentity(t *testing.T) {
+	tests := []struct {
+		name                string
+		driverNameErr       error
+		vendorVersionErr    error
+		nodeIDErr           error
+		expectError         bool
+		expectVendorVersion string
+	}{
+		{
+			name:                "success",
+			expectVendorVersion: "0.2.0",
+		},
+		{
+			name:          "GetDriverName failure fails the whole call",
+			driverNameErr: fmt.Errorf("mock GetDriverName error"),
+			expectError:   true,
+		},
+		{
+			name:      "NodeGetId failure fails the whole call",
+			nodeIDErr: fmt.Errorf("mock NodeGetId error"),
+			// GetPluginVendorVersion uses a separate GetPluginInfo call
+			// before NodeGetId ever runs, so it still completes.
+			expectError: true,
+		},
+		{
+			// A driver's vendor_version field is optional; a failure
+			// fetching it does not fail the overall call, it just leaves
+			// VendorVersion empty.
+			name:                "GetPluginVendorVersion failure is tolerated",
+			vendorVersionErr:    fmt.Errorf("mock GetPluginVendorVersion error"),
+			expectVendorVersion: "",
+		},
+	}
+
+	for _, test := range tests {
+		mockController, driver, identityServer, _, nodeServer, csiConn, err := createMockServer(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		driverNameResp := &csi.GetPluginInfoResponse{Name: "csi/example", VendorVersion: "0.2.0"}
+		var driverNameCallErr, vendorVersionCallErr error
+		if test.driverNameErr != nil {
+			driverNameResp, driverNameCallErr = nil, test.driverNameErr
+		}
+		if test.vendorVersionErr != nil {
+			vendorVersionCallErr = test.vendorVersionErr
+		}
+		identityServer.EXPECT().GetPluginInfo(gomock.Any(), gomock.Any()).Return(driverNameResp, driverNameCallErr).Times(1)
+		if test.driverNameErr == nil {
+			identityServer.EXPECT().GetPluginInfo(gomock.Any(), gomock.Any()).Return(driverNameResp, vendorVersionCallErr).Times(1)
+		}
+
+		if test.driverNameErr == nil {
+			nodeIDResp := &csi.NodeGetInfoResponse{NodeId: "mock_node_id"}
+			var nodeIDCallErr error
+			if test.nodeIDErr != nil {
+				nodeIDResp, nodeIDCallErr = nil, test.nodeIDErr
+			}
+			nodeServer.EXPECT().NodeGetInfo(gomock.Any(), gomock.Any()).Return(nodeIDResp, nodeIDCallErr).Times(1)
+		}
+
+		identity, err := DiscoverIdentity(context.Background(), csiConn, time.Minute, time.Minute)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("test %q: expected error, got none", test.name)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("test %q: unexpected error: %v", test.name, err)
+			} else {
+				if identity.DriverName != "csi/example" {
+					t.Errorf("test %q: got unexpected driver name: %q", test.name, identity.DriverName)
+				}
+				if identity.NodeID != "mock_node_id" {
+					t.Errorf("test %q: got unexpected node ID: %q", test.name, identity.NodeID)
+				}
+				if identity.VendorVersion != test.expectVendorVersion {
+					t.Errorf("test %q: got unexpected vendor version: %q", test.name, identity.VendorVersion)
+				}
+			}
+		}
+
+		mockController.Finish()
+		csiConn.Close()
+		driver.Stop()
+	}
+}
+
+func TestClassifyCSIError(t *testing.T) {
+	mockController, driver, identityServer, _, nodeServer, csiConn, err := createMockServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+	defer csiConn.Close()
+
+	identityServer.EXPECT().GetPluginInfo(gomock.Any(), gomock.Any()).Return(nil, status.Error(codes.Unimplemented, "not implemented")).Times(1)
+	_, err = csiConn.GetDriverName(context.Background())
+	var unimplemented *UnimplementedError
+	if !errors.As(err, &unimplemented) {
+		t.Errorf("expected a *UnimplementedError for a codes.Unimplemented failure, got %v (%T)", err, err)
+	}
+
+	nodeServer.EXPECT().NodeGetInfo(gomock.Any(), gomock.Any()).Return(nil, status.Error(codes.Unavailable, "driver restarting")).Times(1)
+	_, _, _, err = csiConn.NodeGetInfo(context.Background())
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) {
+		t.Errorf("expected a *UnavailableError for a codes.Unavailable failure, got %v (%T)", err, err)
+	}
+
+	identityServer.EXPECT().GetPluginInfo(gomock.Any(), gomock.Any()).Return(nil, status.Error(codes.InvalidArgument, "bad request")).Times(1)
+	_, err = csiConn.GetDriverName(context.Background())
+	if errors.As(err, &unimplemented) || errors.As(err, &unavailable) {
+		t.Errorf("expected an unwrapped error for a codes.InvalidArgument failure, got %v (%T)", err, err)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name        string
+		output      *csi.ProbeResponse
+		injectError error
+		wantReady   bool
+		wantErr     bool
+	}{
+		{
+			name:      "ready",
+			output:    &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}},
+			wantReady: true,
+		},
+		{
+			name:      "not ready",
+			output:    &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: false}},
+			wantReady: false,
+		},
+		{
+			name:      "ready field unset means assume ready",
+			output:    &csi.ProbeResponse{},
+			wantReady: true,
+		},
+		{
+			name:        "unimplemented means assume ready",
+			injectError: status.Error(codes.Unimplemented, "not implemented"),
+			wantReady:   true,
+		},
+		{
+			name:        "other error propagates",
+			injectError: status.Error(codes.Unavailable, "mock error"),
+			wantErr:     true,
+		},
+	}
+
+	mockController, driver, identityServer, _, _, csiConn, err := createMockServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+	defer csiConn.Close()
+
+	for _, test := range tests {
+		identityServer.EXPECT().Probe(gomock.Any(), gomock.Any()).Return(test.output, test.injectError).Times(1)
+
+		ready, err := csiConn.Probe(context.Background())
+		if test.wantErr && err == nil {
+			t.Errorf("test %q: expected error, got none", test.name)
+		}
+		if !test.wantErr && err != nil {
+			t.Errorf("test %q: unexpected error: %v", test.name, err)
+		}
+		if !test.wantErr && ready != test.wantReady {
+			t.Errorf("test %q: got ready=%v, want %v", test.name, ready, test.wantReady)
+		}
+	}
+}
+
+func TestWaitForReady(t *testing.T) {
+	mockController, driver, identityServer, _, _, csiConn, err := createMockServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+	defer csiConn.Close()
+
+	notReady := identityServer.EXPECT().Probe(gomock.Any(), gomock.Any()).Return(&csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: false}}, nil).Times(2)
+	identityServer.EXPECT().Probe(gomock.Any(), gomock.Any()).Return(&csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil).After(notReady)
+
+	if err := WaitForReady(context.Background(), csiConn, "test-address"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestWaitForReadyTimesOut(t *testing.T) {
+	mockController, driver, identityServer, _, _, csiConn, err := createMockServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+	defer csiConn.Close()
+
+	identityServer.EXPECT().Probe(gomock.Any(), gomock.Any()).Return(&csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: false}}, nil).AnyTimes()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := WaitForReady(ctx, csiConn, "test-address"); err == nil {
+		t.Error("expected an error once ctx expires waiting for the driver to report ready")
+	}
+}
+
+// fakeIdentityServer is a minimal csi.IdentityServer answering Probe and
+// GetPluginInfo, for exercising transport security (TestWaitForServerOverTLS)
+// without pulling in the full gomock-based driver.MockCSIDriver, which only
+// listens on a unix socket.
+type fakeIdentityServer struct{}
+
+func (fakeIdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{Name: "csi.example.com"}, nil
+}
+
+func (fakeIdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{}, nil
+}
+
+func (fakeIdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{}, nil
+}
+
+// selfSignedCert generates an in-memory, CA-less self-signed certificate
+// valid for "127.0.0.1", for TestWaitForServerOverTLS to stand up a TLS
+// listener without touching the filesystem.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := tls.X509KeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	)
+	if err != nil {
+		t.Fatalf("failed to load generated key pair: %v", err)
+	}
+	return cert
+}
+
+// TestWaitForServerOverTLS exercises transportCredentialsDialOption's TCP
+// path end to end: a fake CSI driver is served over TLS, and WaitForServer
+// is expected to fail against it with TLSConfig unset (insecure dial to a
+// TLS listener) but succeed once TLSConfig trusts the server's certificate.
+func TestWaitForServerOverTLS(t *testing.T) {
+	oldTLSConfig := TLSConfig
+	defer func() { TLSConfig = oldTLSConfig }()
+
+	cert := selfSignedCert(t)
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer lis.Close()
+
+	grpcServer := grpc.NewServer()
+	csi.RegisterIdentityServer(grpcServer, fakeIdentityServer{})
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	address := lis.Addr().String()
+
+	t.Run("insecure dial to a TLS listener fails", func(t *testing.T) {
+		TLSConfig = nil
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if _, err := WaitForServer(ctx, address); err == nil {
+			t.Error("expected an error dialing a TLS listener insecurely, got none")
+		}
+	})
+
+	t.Run("TLS dial trusting the server certificate succeeds", func(t *testing.T) {
+		parsedCert, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("failed to parse generated certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(parsedCert)
+		TLSConfig = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		csiConn, err := WaitForServer(ctx, address)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer csiConn.Close()
+
+		name, err := csiConn.GetDriverName(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error calling GetDriverName: %v", err)
+		}
+		if name != "csi.example.com" {
+			t.Errorf("got unexpected name: %q", name)
+		}
+	})
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		name        string
+		address     string
+		wantNetwork string
+		wantTarget  string
+		wantErr     bool
+	}{
+		{
+			name:        "explicit unix scheme",
+			address:     "unix:///run/csi/socket",
+			wantNetwork: "unix",
+			wantTarget:  "/run/csi/socket",
+		},
+		{
+			name:        "explicit tcp scheme",
+			address:     "tcp://127.0.0.1:1234",
+			wantNetwork: "tcp",
+			wantTarget:  "127.0.0.1:1234",
+		},
+		{
+			name:        "bare absolute path defaults to unix",
+			address:     "/run/csi/socket",
+			wantNetwork: "unix",
+			wantTarget:  "/run/csi/socket",
+		},
+		{
+			name:        "bare host:port defaults to tcp",
+			address:     "127.0.0.1:1234",
+			wantNetwork: "tcp",
+			wantTarget:  "127.0.0.1:1234",
+		},
+		{
+			name:    "unsupported scheme is rejected",
+			address: "http://127.0.0.1:1234",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			network, target, err := ParseAddress(test.address)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error for address %q, got none", test.address)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if network != test.wantNetwork {
+				t.Errorf("got network %q, want %q", network, test.wantNetwork)
+			}
+			if target != test.wantTarget {
+				t.Errorf("got target %q, want %q", target, test.wantTarget)
+			}
+		})
+	}
+}
+
+func TestWaitForServerAddressSchemes(t *testing.T) {
+	t.Run("unix:// scheme dials a unix socket", func(t *testing.T) {
+		dir := t.TempDir()
+		socketPath := filepath.Join(dir, "csi.sock")
+		lis, err := net.Listen("unix", socketPath)
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		grpcServer := grpc.NewServer()
+		csi.RegisterIdentityServer(grpcServer, fakeIdentityServer{})
+		go grpcServer.Serve(lis)
+		defer grpcServer.Stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		csiConn, err := WaitForServer(ctx, "unix://"+socketPath)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer csiConn.Close()
+
+		if name, err := csiConn.GetDriverName(context.Background()); err != nil || name != "csi.example.com" {
+			t.Errorf("got name %q, err %v", name, err)
+		}
+	})
+
+	t.Run("tcp:// scheme dials a TCP listener", func(t *testing.T) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		grpcServer := grpc.NewServer()
+		csi.RegisterIdentityServer(grpcServer, fakeIdentityServer{})
+		go grpcServer.Serve(lis)
+		defer grpcServer.Stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		csiConn, err := WaitForServer(ctx, "tcp://"+lis.Addr().String())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer csiConn.Close()
+
+		if name, err := csiConn.GetDriverName(context.Background()); err != nil || name != "csi.example.com" {
+			t.Errorf("got name %q, err %v", name, err)
+		}
+	})
+
+	t.Run("unsupported scheme is rejected without dialing", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if _, err := WaitForServer(ctx, "http://127.0.0.1:1234"); err == nil {
+			t.Error("expected an error for an unsupported scheme, got none")
+		}
+	})
+}
+
+func TestResolveSocketAddress(t *testing.T) {
+	t.Run("non-path address is returned unchanged", func(t *testing.T) {
+		if got := resolveSocketAddress("127.0.0.1:1234"); got != "127.0.0.1:1234" {
+			t.Errorf("got %q, want it unchanged", got)
+		}
+	})
+
+	t.Run("plain socket path is returned unchanged (not a symlink)", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "csi.sock")
+		if err := os.WriteFile(target, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if got := resolveSocketAddress(target); got != target {
+			t.Errorf("got %q, want %q", got, target)
+		}
+	})
+
+	t.Run("symlink is resolved to its target", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "csi-20260101.sock")
+		if err := os.WriteFile(target, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		link := filepath.Join(dir, "csi.sock")
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+		if got := resolveSocketAddress(link); got != target {
+			t.Errorf("got %q, want the symlink's target %q", got, target)
+		}
+	})
+
+	t.Run("dangling symlink is returned unchanged", func(t *testing.T) {
+		dir := t.TempDir()
+		link := filepath.Join(dir, "csi.sock")
+		if err := os.Symlink(filepath.Join(dir, "does-not-exist.sock"), link); err != nil {
+			t.Fatal(err)
+		}
+		if got := resolveSocketAddress(link); got != link {
+			t.Errorf("got %q, want the unresolved symlink path %q back", got, link)
+		}
+	})
+
+	t.Run("re-resolves to a new target after the symlink is repointed", func(t *testing.T) {
+		dir := t.TempDir()
+		oldTarget := filepath.Join(dir, "csi-old.sock")
+		newTarget := filepath.Join(dir, "csi-new.sock")
+		if err := os.WriteFile(oldTarget, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(newTarget, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		link := filepath.Join(dir, "csi.sock")
+		if err := os.Symlink(oldTarget, link); err != nil {
+			t.Fatal(err)
+		}
+		if got := resolveSocketAddress(link); got != oldTarget {
+			t.Fatalf("got %q, want %q before repointing", got, oldTarget)
+		}
+
+		// Simulate the driver restarting and atomically repointing the
+		// symlink at a freshly created socket, the way synth-598's request
+		// describes.
+		tmpLink := link + ".tmp"
+		if err := os.Symlink(newTarget, tmpLink); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmpLink, link); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := resolveSocketAddress(link); got != newTarget {
+			t.Errorf("got %q, want the repointed target %q", got, newTarget)
+		}
+	})
+}
+
+func TestSocketTargetExists(t *testing.T) {
+	t.Run("missing path", func(t *testing.T) {
+		if socketTargetExists(filepath.Join(t.TempDir(), "does-not-exist.sock")) {
+			t.Error("expected false for a path that does not exist")
+		}
+	})
+
+	t.Run("plain existing file", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "csi.sock")
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if !socketTargetExists(path) {
+			t.Error("expected true for an existing plain file")
+		}
+	})
+
+	t.Run("symlink to an existing target", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "csi-real.sock")
+		if err := os.WriteFile(target, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		link := filepath.Join(dir, "csi.sock")
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+		if !socketTargetExists(link) {
+			t.Error("expected true for a symlink whose target exists")
+		}
+	})
+
+	t.Run("dangling symlink", func(t *testing.T) {
+		dir := t.TempDir()
+		link := filepath.Join(dir, "csi.sock")
+		if err := os.Symlink(filepath.Join(dir, "does-not-exist.sock"), link); err != nil {
+			t.Fatal(err)
+		}
+		if socketTargetExists(link) {
+			t.Error("expected false for a dangling symlink")
+		}
+	})
+}
+
+// TestWaitForServerOverSymlinkedSocket exercises WaitForServer end to end
+// against a real unix socket exposed only via a symlink that starts out
+// dangling and is repointed partway through, the way a driver that
+// atomically cuts over to a freshly created socket on restart would behave.
+func TestWaitForServerOverSymlinkedSocket(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "csi-real.sock")
+	link := filepath.Join(dir, "csi.sock")
+
+	// Start out with a dangling symlink, as if the driver has not created
+	// its socket yet, and only create the real listener shortly after
+	// WaitForServer has already started polling on it.
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	grpcServer := grpc.NewServer()
+	csi.RegisterIdentityServer(grpcServer, fakeIdentityServer{})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		lis, err := net.Listen("unix", target)
+		if err != nil {
+			t.Errorf("failed to listen: %v", err)
+			return
+		}
+		grpcServer.Serve(lis)
+	}()
+	defer grpcServer.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	csiConn, err := WaitForServer(ctx, link)
+	if err != nil {
+		t.Fatalf("unexpected error waiting on a socket behind a dangling-then-created symlink: %v", err)
+	}
+	defer csiConn.Close()
+
+	name, err := csiConn.GetDriverName(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error calling GetDriverName through a symlinked socket: %v", err)
+	}
+	if name != "csi.example.com" {
+		t.Errorf("got unexpected name: %q", name)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fake provides an in-process fake CSI Identity/Node server for
+// exercising pkg/connection without a real driver or unix socket.
+package fake
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/kubernetes-csi/node-driver-registrar/pkg/connection"
+)
+
+const bufSize = 1024 * 1024
+
+// CSIDriver is an in-process fake implementing the CSI Identity and Node
+// services, served over a bufconn listener. Callers configure the driver
+// name, node ID, and error responses, then use Connect to obtain a
+// connection.CSIConnection wired to it.
+type CSIDriver struct {
+	// DriverName is returned by GetPluginInfo.
+	DriverName string
+	// VendorVersion is returned by GetPluginInfo.
+	VendorVersion string
+	// NodeID is returned by NodeGetInfo.
+	NodeID string
+	// MaxVolumesPerNode is returned by NodeGetInfo.
+	MaxVolumesPerNode int64
+	// AccessibleTopology is returned by NodeGetInfo.
+	AccessibleTopology *csi.Topology
+	// GetPluginInfoError, if set, is returned by GetPluginInfo instead of a
+	// successful response.
+	GetPluginInfoError error
+	// NodeGetInfoError, if set, is returned by NodeGetInfo instead of a
+	// successful response.
+	NodeGetInfoError error
+	// GetPluginInfoBlock, if set, causes GetPluginInfo to block until the
+	// channel is closed or the call's context is done, for exercising
+	// client-side timeout handling against a driver that hangs.
+	GetPluginInfoBlock chan struct{}
+
+	listener *bufconn.Listener
+	server   *grpc.Server
+}
+
+var (
+	_ csi.IdentityServer = &CSIDriver{}
+	_ csi.NodeServer     = &CSIDriver{}
+)
+
+// NewCSIDriver starts an in-process fake CSI driver.
+func NewCSIDriver() *CSIDriver {
+	d := &CSIDriver{
+		listener: bufconn.Listen(bufSize),
+		server:   grpc.NewServer(),
+	}
+	csi.RegisterIdentityServer(d.server, d)
+	csi.RegisterNodeServer(d.server, d)
+	go d.server.Serve(d.listener)
+	return d
+}
+
+// Stop shuts down the fake driver and releases its listener.
+func (d *CSIDriver) Stop() {
+	d.server.Stop()
+}
+
+// ServeUnix additionally serves the fake driver on a real unix socket at
+// path, for tests that need the socket file to actually appear on disk (the
+// default bufconn transport has no such file).
+func (d *CSIDriver) ServeUnix(path string) error {
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	go d.server.Serve(lis)
+	return nil
+}
+
+// ClientConn dials the fake driver over its bufconn listener.
+func (d *CSIDriver) ClientConn() (*grpc.ClientConn, error) {
+	return grpc.Dial(
+		"bufnet",
+		grpc.WithInsecure(),
+		grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+			return d.listener.Dial()
+		}),
+	)
+}
+
+// Connect dials the fake driver and wraps the connection in a
+// connection.CSIConnection, ready for use by callers under test.
+func (d *CSIDriver) Connect() (connection.CSIConnection, error) {
+	conn, err := d.ClientConn()
+	if err != nil {
+		return nil, err
+	}
+	return connection.NewConnectionFromClientConn(conn), nil
+}
+
+func (d *CSIDriver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	if d.GetPluginInfoBlock != nil {
+		select {
+		case <-d.GetPluginInfoBlock:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if d.GetPluginInfoError != nil {
+		return nil, d.GetPluginInfoError
+	}
+	return &csi.GetPluginInfoResponse{Name: d.DriverName, VendorVersion: d.VendorVersion}, nil
+}
+
+func (d *CSIDriver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{}, nil
+}
+
+func (d *CSIDriver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{}, nil
+}
+
+func (d *CSIDriver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	if d.NodeGetInfoError != nil {
+		return nil, d.NodeGetInfoError
+	}
+	return &csi.NodeGetInfoResponse{
+		NodeId:             d.NodeID,
+		MaxVolumesPerNode:  d.MaxVolumesPerNode,
+		AccessibleTopology: d.AccessibleTopology,
+	}, nil
+}
+
+func (d *CSIDriver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *CSIDriver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *CSIDriver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *CSIDriver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *CSIDriver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *CSIDriver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{}, nil
+}
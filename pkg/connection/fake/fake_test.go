@@ -0,0 +1,157 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-csi/node-driver-registrar/pkg/connection"
+)
+
+func TestFakeGetDriverName(t *testing.T) {
+	tests := []struct {
+		name        string
+		driverName  string
+		injectError bool
+		expectError bool
+	}{
+		{
+			name:       "success",
+			driverName: "csi.example.com",
+		},
+		{
+			name:        "gRPC error",
+			injectError: true,
+			expectError: true,
+		},
+		{
+			name:        "empty name",
+			driverName:  "",
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		drv := NewCSIDriver()
+		drv.DriverName = test.driverName
+		if test.injectError {
+			drv.GetPluginInfoError = fmt.Errorf("mock error")
+		}
+
+		csiConn, err := drv.Connect()
+		if err != nil {
+			t.Fatalf("test %q: failed to connect: %v", test.name, err)
+		}
+
+		name, err := csiConn.GetDriverName(context.Background())
+		if test.expectError && err == nil {
+			t.Errorf("test %q: expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: unexpected error: %v", test.name, err)
+		}
+		if err == nil && name != test.driverName {
+			t.Errorf("test %q: got unexpected name: %q", test.name, name)
+		}
+
+		drv.Stop()
+	}
+}
+
+func TestWaitForServerNonexistentSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node-driver-registrar-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = connection.WaitForServer(ctx, filepath.Join(dir, "does-not-exist.sock"))
+	if err == nil {
+		t.Fatal("expected an error, got none")
+	}
+	if _, ok := err.(*connection.SocketNotFoundError); !ok {
+		t.Errorf("expected a *connection.SocketNotFoundError, got %T: %v", err, err)
+	}
+}
+
+func TestWaitForServerSuccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node-driver-registrar-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "csi.sock")
+
+	drv := NewCSIDriver()
+	defer drv.Stop()
+	drv.DriverName = "csi.example.com"
+	if err := drv.ServeUnix(socketPath); err != nil {
+		t.Fatalf("failed to serve on unix socket: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	csiConn, err := connection.WaitForServer(ctx, socketPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer csiConn.Close()
+
+	name, err := csiConn.GetDriverName(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error calling GetDriverName: %v", err)
+	}
+	if name != "csi.example.com" {
+		t.Errorf("got unexpected driver name: %q", name)
+	}
+}
+
+func TestFakeNodeGetIdTimeout(t *testing.T) {
+	drv := NewCSIDriver()
+	defer drv.Stop()
+	drv.NodeID = "mock-node"
+
+	csiConn, err := drv.Connect()
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	// A near-zero deadline races with the in-process dial; either a
+	// deadline-exceeded error or a successful call is acceptable, but the
+	// call must not hang.
+	done := make(chan struct{})
+	go func() {
+		csiConn.NodeGetId(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("NodeGetId did not return before the test timeout")
+	}
+}